@@ -0,0 +1,299 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package launcher
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/environment"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/modes"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+)
+
+// The max number of restarts that are kept in the restart history.
+const maxRestartHistory = 50
+
+// Describes a restart of an agent (as shown in the restart history).
+type restartRecord struct {
+	Time        time.Time `json:"time"`
+	Agent       string    `json:"agent,omitempty"`
+	Cause       string    `json:"cause"`
+	ExitCode    int       `json:"exitCode"`
+	Signal      string    `json:"signal,omitempty"`
+	Uptime      float64   `json:"uptimeSeconds"`
+	Sleep       float64   `json:"sleepSeconds"`
+	CrashLoop   bool      `json:"crashLoop,omitempty"`
+	Diagnostics []string  `json:"diagnostics,omitempty"`
+}
+
+// Holds the configs of the agents that are currently run and allows to restart, stop or reload them.
+type agentRegistry struct {
+	mutex            sync.Mutex
+	configs          []*util.Config
+	restarts         []restartRecord
+	cancelLauncher   context.CancelFunc
+	cancelGeneration context.CancelFunc
+	reloaded         []*util.Config
+
+	// Loads and validates the configs of all agents from the config file.
+	load func() ([]*util.Config, error)
+}
+
+func newAgentRegistry(cancelLauncher context.CancelFunc, load func() ([]*util.Config, error)) *agentRegistry {
+	return &agentRegistry{cancelLauncher: cancelLauncher, load: load}
+}
+
+// Sets the configs that are run until "cancel" is called.
+// A reload that was requested while the agents were prepared cancels them right away.
+func (self *agentRegistry) started(configs []*util.Config, cancel context.CancelFunc) {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	self.configs, self.cancelGeneration = configs, cancel
+	if self.reloaded != nil {
+		cancel()
+	}
+}
+
+// Returns the configs of all agents that are currently run.
+func (self *agentRegistry) Configs() []*util.Config {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	return self.configs
+}
+
+// Returns the config of the named agent ("" for the main config) or nil if no such agent is run.
+func (self *agentRegistry) Config(agent string) *util.Config {
+	for _, config := range self.Configs() {
+		if config.State().Name == agent {
+			return config
+		}
+	}
+	return nil
+}
+
+// Adds a restart of the agent of the specified config to the restart history.
+func (self *agentRegistry) recordRestart(config *util.Config, reason *modes.StopReason, uptime, sleep time.Duration, crashLoop bool) {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	self.restarts = append(self.restarts, restartRecord{
+		Time: time.Now(), Agent: config.State().Name,
+		Cause: reason.Cause, ExitCode: reason.ExitCode, Signal: reason.Signal,
+		Uptime: uptime.Seconds(), Sleep: sleep.Seconds(), CrashLoop: crashLoop,
+		Diagnostics: reason.Diagnostics,
+	})
+	if len(self.restarts) > maxRestartHistory {
+		self.restarts = self.restarts[len(self.restarts) - maxRestartHistory:]
+	}
+}
+
+// Returns the restart history (oldest first).
+func (self *agentRegistry) Restarts() []restartRecord {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	return append([]restartRecord{}, self.restarts...)
+}
+
+// Restarts the Jenkins client of the named agent or of all agents if "agent" is empty.
+func (self *agentRegistry) Restart(agent string) error {
+	if agent != "" {
+		config := self.Config(agent)
+		if config == nil {
+			return fmt.Errorf("No agent named '%s' is run by this launcher.", agent)
+		}
+		modes.StopConfiguredMode(config, util.RestartReasonManual)
+		return nil
+	}
+
+	for _, config := range self.Configs() {
+		modes.StopConfiguredMode(config, util.RestartReasonManual)
+	}
+	return nil
+}
+
+// Stops all agents and lets the launcher exit.
+func (self *agentRegistry) Stop() {
+	self.cancelLauncher()
+}
+
+// Loads the config file and restarts all agents with the new config when the config is valid.
+func (self *agentRegistry) Reload() error {
+	configs, err := self.load()
+	if err != nil {
+		return err
+	}
+
+	for _, config := range configs {
+		if !modes.GetConfiguredMode(config).IsConfigAcceptable(config) {
+			return fmt.Errorf("The run mode of agent '%s' does not accept the config.", config.ClientName)
+		}
+	}
+
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	self.reloaded = configs
+	if self.cancelGeneration != nil {
+		self.cancelGeneration()
+	}
+	return nil
+}
+
+// Returns the configs that were loaded by Reload (or nil if no reload was requested).
+func (self *agentRegistry) takeReloaded() []*util.Config {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	configs := self.reloaded
+	self.reloaded = nil
+	return configs
+}
+
+// Describes the state of an agent (as shown in the status).
+type agentStatus struct {
+	Agent       string `json:"agent,omitempty"`
+	Node        string `json:"node"`
+	Mode        string `json:"mode"`
+	Status      string `json:"status"`
+	Idle        bool   `json:"idle"`
+	Draining    bool   `json:"draining"`
+	Unhealthy   bool   `json:"unhealthy"`
+	HeldOffline bool   `json:"heldOffline"`
+}
+
+// Returns the state of all agents.
+func (self *agentRegistry) Status() []agentStatus {
+	status := []agentStatus{}
+	for _, config := range self.Configs() {
+		mode, state := modes.GetConfiguredMode(config), config.State()
+		status = append(status, agentStatus{
+			Agent: state.Name, Node: config.ClientName,
+			Mode: mode.Name(), Status: modes.StatusName(mode.Status().Get()),
+			Idle: state.NodeIsIdle.Get(), Draining: state.Draining.Get(), Unhealthy: state.Unhealthy.Get(),
+			HeldOffline: state.HeldOffline.Get(),
+		})
+	}
+	return status
+}
+
+// Serves the control API until the context is done.
+func serveControl(ctx context.Context, config *util.Config, registry *agentRegistry) {
+	server := &http.Server{Addr: config.ControlAddress, Handler: newControlHandler(config.ControlToken, registry)}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	util.GOut("control", "Serving the control API on http://%v", config.ControlAddress)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		util.GOut("control", "ERROR: Failed serving the control API on %v. Cause: %v", config.ControlAddress, err)
+	}
+}
+
+// Returns the handler of the control API that requires the specified token with every request.
+func newControlHandler(token string, registry *agentRegistry) http.Handler {
+	handler := http.NewServeMux()
+
+	handle := func(path, method string, fn func(writer http.ResponseWriter, request *http.Request)) {
+		handler.HandleFunc(path, func(writer http.ResponseWriter, request *http.Request) {
+			if !isAuthorized(request, token) {
+				writer.Header().Set("WWW-Authenticate", `Bearer realm="jcl"`)
+				writeJSON(writer, http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+			} else if request.Method != method {
+				writer.Header().Set("Allow", method)
+				writeJSON(writer, http.StatusMethodNotAllowed, map[string]string{"error": "Use " + method})
+			} else {
+				fn(writer, request)
+			}
+		})
+	}
+
+	action := func(path string, fn func(request *http.Request) error) {
+		handle(path, "POST", func(writer http.ResponseWriter, request *http.Request) {
+			util.GOut("control", "Received %v %v from %v", request.Method, request.URL.RequestURI(), request.RemoteAddr)
+			if err := fn(request); err != nil {
+				writeJSON(writer, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			} else {
+				writeJSON(writer, http.StatusAccepted, map[string]string{"result": "accepted"})
+			}
+		})
+	}
+
+	handle("/status", "GET", func(writer http.ResponseWriter, request *http.Request) {
+		writeJSON(writer, http.StatusOK, map[string]interface{}{
+			"version": AppVersion,
+			"agents": registry.Status(),
+			"restarts": registry.Restarts(),
+			"nextRuns": util.NextRuns(),
+		})
+	})
+
+	handle("/config", "GET", func(writer http.ResponseWriter, request *http.Request) {
+		config := registry.Config(request.URL.Query().Get("agent"))
+		if config == nil {
+			writeJSON(writer, http.StatusNotFound, map[string]string{"error": "Unknown agent"})
+		} else if masked, err := config.MaskedCopy(); err != nil {
+			writeJSON(writer, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		} else {
+			writeJSON(writer, http.StatusOK, masked)
+		}
+	})
+
+	handle("/stacks", "GET", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		util.WriteAllStackTraces(writer)
+	})
+
+	action("/restart", func(request *http.Request) error {
+		return registry.Restart(request.URL.Query().Get("agent"))
+	})
+
+	action("/stop", func(request *http.Request) error {
+		registry.Stop()
+		return nil
+	})
+
+	action("/cleanup", func(request *http.Request) error {
+		for _, config := range registry.Configs() {
+			go environment.RunCleanup(config)
+		}
+		return nil
+	})
+
+	action("/gc", func(request *http.Request) error {
+		for _, config := range registry.Configs() {
+			if !config.HasCIConnection() {
+				return fmt.Errorf("No Jenkins URI defined. System.GC() cannot be called inside the Jenkins client.")
+			}
+			if err := environment.InvokeFullGC(config); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	action("/reload", func(request *http.Request) error {
+		return registry.Reload()
+	})
+
+	return handler
+}
+
+// Returns true if the request contains the bearer token.
+func isAuthorized(request *http.Request, token string) bool {
+	header := request.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(header[len("Bearer "):])), []byte(token)) == 1
+}
+
+// Writes the value as JSON response with the specified status code.
+func writeJSON(writer http.ResponseWriter, statusCode int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(statusCode)
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		util.GOut("control", "WARN: Failed writing the response. Cause: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package launcher
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/modes"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+)
+
+func newControlTestServer() (*httptest.Server, *agentRegistry) {
+	config := util.NewDefaultConfig()
+	config.ClientName, config.SecretKey = "my-node", "secret"
+
+	registry := newAgentRegistry(func() {}, func() ([]*util.Config, error) { return nil, nil })
+	registry.started([]*util.Config{config}, func() {})
+	return httptest.NewServer(newControlHandler("token", registry)), registry
+}
+
+func controlRequest(t *testing.T, server *httptest.Server, method, path, token string) *http.Response {
+	request, _ := http.NewRequest(method, server.URL + path, nil)
+	if token != "" { request.Header.Set("Authorization", "Bearer " + token) }
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("%v %v failed: %v", method, path, err)
+	}
+	return response
+}
+
+func TestControlAPIRequiresToken(t *testing.T) {
+	server, _ := newControlTestServer()
+	defer server.Close()
+
+	for _, token := range []string{"", "wrong"} {
+		if response := controlRequest(t, server, "GET", "/status", token); response.StatusCode != http.StatusUnauthorized {
+			t.Errorf("GET /status with token '%v' = %v, want 401", token, response.Status)
+		}
+	}
+	if response := controlRequest(t, server, "GET", "/restart", "token"); response.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /restart = %v, want 405", response.Status)
+	}
+	if response := controlRequest(t, server, "POST", "/restart?agent=unknown", "token"); response.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST /restart?agent=unknown = %v, want 400", response.Status)
+	}
+}
+
+func TestControlAPIReturnsStatusAndMaskedConfig(t *testing.T) {
+	server, registry := newControlTestServer()
+	defer server.Close()
+	registry.recordRestart(registry.Config(""), &modes.StopReason{Cause: util.RestartReasonManual}, 0, 0, false)
+
+	status := struct {
+		Agents   []agentStatus
+		Restarts []restartRecord
+	}{}
+	response := controlRequest(t, server, "GET", "/status", "token")
+	if err := json.NewDecoder(response.Body).Decode(&status); err != nil || len(status.Agents) != 1 || len(status.Restarts) != 1 {
+		t.Fatalf("GET /status = %+v, %v; want 1 agent and 1 restart", status, err)
+	}
+	if status.Agents[0].Node != "my-node" || status.Restarts[0].Cause != util.RestartReasonManual {
+		t.Errorf("GET /status = %+v; want node my-node restarted manually", status)
+	}
+
+	config := util.Config{}
+	response = controlRequest(t, server, "GET", "/config", "token")
+	if err := json.NewDecoder(response.Body).Decode(&config); err != nil || config.ClientName != "my-node" || config.SecretKey != util.MaskedValue {
+		t.Errorf("GET /config = %v, %v, %v; want masked config of my-node", config.ClientName, config.SecretKey, err)
+	}
+}
+
+func TestReloadDuringPreparationIsNotLost(t *testing.T) {
+	config := util.NewDefaultConfig()
+	config.CIHostURI, config.ClientName, config.SecretKey = "http://localhost:1", "my-node", "secret"
+
+	registry := newAgentRegistry(func() {}, func() ([]*util.Config, error) { return []*util.Config{config}, nil })
+	if err := registry.Reload(); err != nil {
+		t.Fatalf("registry.Reload() failed: %v", err)
+	}
+
+	cancelled := false
+	registry.started([]*util.Config{config}, func() { cancelled = true })
+
+	if reloaded := registry.takeReloaded(); !cancelled || len(reloaded) != 1 {
+		t.Errorf("cancelled = %v, reloaded = %v; want the started agents to be cancelled for the pending reload", cancelled, reloaded)
+	}
+}
@@ -4,6 +4,7 @@
 package environment
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"io/ioutil"
@@ -59,7 +60,7 @@ func (self *AutostartHandler) Name() string {
 }
 
 // Performs registration & deregistration for autostart on windows.
-func (self *AutostartHandler) Prepare(config *util.Config) {
+func (self *AutostartHandler) Prepare(ctx context.Context, config *util.Config) {
 	cwd, _ := os.Getwd()
 	self.commandline = fmt.Sprintf("\"%s\" \"-directory=%s\"", os.Args[0], cwd)
 
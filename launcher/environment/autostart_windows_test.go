@@ -4,6 +4,7 @@
 package environment
 
 import (
+	"context"
 	"testing"
 	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
 )
@@ -18,12 +19,12 @@ func TestCanRegisterAutoStart(t *testing.T) {
 	config := util.NewDefaultConfig()
 
 	config.Autostart = true
-	handler.Prepare(config)
+	handler.Prepare(context.Background(), config)
 
 	if !handler.isRegistered() { t.Errorf("Handler did not register for autostart when requested.") }
 
 	config.Autostart = false
-	handler.Prepare(config)
+	handler.Prepare(context.Background(), config)
 
 	if handler.isRegistered() { t.Errorf("Handler did not unregister from autostart when requested.") }
 }
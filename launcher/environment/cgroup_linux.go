@@ -0,0 +1,203 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"context"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/modes"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The mount point of the unified cgroup (v2) hierarchy.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// The interval when "memory.events" is checked for OOM kills.
+var cgroupEventsMonitoringInterval = time.Second * 5
+
+// The period used for "cpu.max" in microseconds.
+const cgroupCPUPeriod = 100000
+
+// Places the Jenkins client into a dedicated cgroup (v2) with configurable resource limits.
+type CGroupLimiter struct {
+	once    *sync.Once
+	path    string
+	stopped chan bool
+}
+
+func NewCGroupLimiter() *CGroupLimiter {
+	p := new(CGroupLimiter)
+	p.once = new(sync.Once)
+	return p
+}
+
+func (self *CGroupLimiter) Name() string {
+	return "CGroup Limiter"
+}
+
+func (self *CGroupLimiter) IsConfigAcceptable(config *util.Config) bool {
+	if !config.CGroupEnabled {
+		return true
+	}
+
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		util.GOut("cgroup", "WARN: cgroup v2 is not available at %v, resource limits cannot be applied.", cgroupRoot)
+		return false
+	}
+
+	if config.CGroupMemoryMax != "" {
+		if _, err := util.ParseByteSize(config.CGroupMemoryMax); err != nil {
+			util.GOut("cgroup", "WARN: Invalid memoryMax. Cause: %v", err)
+			return false
+		}
+	}
+
+	return true
+}
+
+func (self *CGroupLimiter) Prepare(ctx context.Context, config *util.Config) {
+	if !config.CGroupEnabled {
+		return
+	}
+
+	self.once.Do(func() {
+		modes.RegisterModeListenerFor(config, func(mode modes.ExecutableMode, nextStatus int32, config *util.Config, reason *modes.StopReason) {
+			if mode.Name() != "client" {
+				return
+			}
+
+			agent := config.State()
+			if nextStatus == modes.ModeStarting {
+				if err := self.createGroup(config); err == nil {
+					agent.ClientCGroup = self.path
+					self.stopped = make(chan bool)
+					go self.monitorOutOfMemoryKills(config, self.stopped)
+				} else {
+					util.GOut("cgroup", "ERROR: Failed creating cgroup %v, client runs without resource limits. Cause: %v", self.path, err)
+					agent.ClientCGroup = ""
+				}
+			} else if nextStatus == modes.ModeStopped && agent.ClientCGroup != "" {
+				close(self.stopped)
+				agent.ClientCGroup = ""
+				self.removeGroup()
+			}
+		})
+	})
+}
+
+// Creates the cgroup of the client (if missing) and applies the configured limits.
+func (self *CGroupLimiter) createGroup(config *util.Config) error {
+	name := regexp.MustCompile(`[^A-Za-z0-9_.-]+`).ReplaceAllString(config.ClientName, "_")
+	if name == "" { name = "client" }
+
+	relativeParent := filepath.Clean("/" + config.CGroupParent)
+	self.path = filepath.Join(cgroupRoot, relativeParent, name)
+
+	if err := os.MkdirAll(self.path, 0755); err != nil {
+		return err
+	}
+
+	// Limits can only be applied when the controllers are enabled in all ancestors.
+	ancestors := []string{cgroupRoot}
+	for _, element := range strings.Split(strings.Trim(relativeParent, "/"), "/") {
+		if element != "" {
+			ancestors = append(ancestors, filepath.Join(ancestors[len(ancestors) - 1], element))
+		}
+	}
+
+	for _, dir := range ancestors {
+		if err := self.write(dir, "cgroup.subtree_control", "+memory +cpu +pids"); err != nil {
+			util.GOut("cgroup", "WARN: Failed enabling controllers in %v. Cause: %v", dir, err)
+		}
+	}
+
+	memoryMax, cpuMax, pidsMax := "max", "max", "max"
+
+	if config.CGroupMemoryMax != "" {
+		bytes, _ := util.ParseByteSize(config.CGroupMemoryMax)
+		memoryMax = strconv.FormatInt(bytes, 10)
+	}
+	if config.CGroupCPUMax > 0 {
+		cpuMax = fmt.Sprintf("%d %d", int64(config.CGroupCPUMax * cgroupCPUPeriod), cgroupCPUPeriod)
+	}
+	if config.CGroupPidsMax > 0 {
+		pidsMax = strconv.FormatInt(config.CGroupPidsMax, 10)
+	}
+
+	for file, value := range map[string]string{"memory.max": memoryMax, "cpu.max": cpuMax, "pids.max": pidsMax} {
+		if err := self.write(self.path, file, value); err != nil {
+			return fmt.Errorf("Failed writing %v=%v. Cause: %v", file, value, err)
+		}
+	}
+
+	util.GOut("cgroup", "Client runs in %v (memory.max: %v, cpu.max: %v, pids.max: %v).", self.path, memoryMax, cpuMax, pidsMax)
+	return nil
+}
+
+// Kills all processes that remain in the cgroup of the client and removes the group.
+func (self *CGroupLimiter) removeGroup() {
+	if err := self.write(self.path, "cgroup.kill", "1"); err != nil && !os.IsNotExist(err) {
+		util.GOut("cgroup", "WARN: Failed killing remaining processes in %v. Cause: %v", self.path, err)
+	}
+
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		if err = os.Remove(self.path); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(time.Millisecond * 500)
+	}
+
+	util.GOut("cgroup", "WARN: Failed removing cgroup %v. Cause: %v", self.path, err)
+}
+
+// Watches the "oom_kill" counter in "memory.events" and restarts the client when it increases.
+func (self *CGroupLimiter) monitorOutOfMemoryKills(config *util.Config, stopped chan bool) {
+	ticker := time.NewTicker(cgroupEventsMonitoringInterval)
+	defer ticker.Stop()
+
+	path := self.path
+	kills := self.readOutOfMemoryKills(path)
+
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-ticker.C:
+			if count := self.readOutOfMemoryKills(path); count > kills {
+				util.GOut("cgroup", "WARN: %v process(es) were killed as the client's cgroup ran out of memory. Forcing a restart.", count - kills)
+				modes.StopConfiguredMode(config, util.RestartReasonCGroupOutOfMemory)
+				return
+			}
+		}
+	}
+}
+
+// Returns the number of processes that were killed by the OOM killer within the cgroup.
+func (self *CGroupLimiter) readOutOfMemoryKills(path string) int64 {
+	if content, err := ioutil.ReadFile(filepath.Join(path, "memory.events")); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "oom_kill" {
+				count, _ := strconv.ParseInt(fields[1], 10, 64)
+				return count
+			}
+		}
+	}
+	return 0
+}
+
+func (self *CGroupLimiter) write(dir, file, value string) error {
+	return ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644)
+}
+
+// Registering the limiter.
+var _ = RegisterAgentPreparer(func() EnvironmentPreparer { return NewCGroupLimiter() })
@@ -0,0 +1,26 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func TestCanReadOutOfMemoryKills(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cgroup")
+	defer os.RemoveAll(dir)
+
+	limiter := NewCGroupLimiter()
+	if in := limiter.readOutOfMemoryKills(dir); in != 0 {
+		t.Errorf("limiter.readOutOfMemoryKills(missing) = %v, want 0", in)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "memory.events"), []byte("low 0\nhigh 0\nmax 12\noom 3\noom_kill 2\n"), 0644)
+	if in := limiter.readOutOfMemoryKills(dir); in != 2 {
+		t.Errorf("limiter.readOutOfMemoryKills(dir) = %v, want 2", in)
+	}
+}
@@ -4,6 +4,7 @@
 package environment
 
 import (
+	"context"
 	"os"
 	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
 	"path/filepath"
@@ -50,100 +51,162 @@ func GetJenkinsNodeConfig(config *util.Config) (*JenkinsNodeConfig, error) {
 // Defines an object which continuously watches and cleans the temporary directory of
 // files that haven't been modified for maxTTLInTempDirectories (default 24 hours).
 type LocationCleaner struct {
-	util.AnyConfigAcceptor
-
-	tickers       []*time.Ticker
+	config        *util.Config
+	nodeName      string
 	workspacePath string
+	remotingPaths map[string]string
 }
 
 func NewLocationCleaner() *LocationCleaner {
-	p := new(LocationCleaner)
-	p.tickers = []*time.Ticker{}
-	return p
+	return new(LocationCleaner)
 }
 
 func (self *LocationCleaner) Name() string {
 	return "Directory Cleaner"
 }
 
-func (self *LocationCleaner) Prepare(config *util.Config) {
-	for _, ticker := range self.tickers {
-		ticker.Stop()
+func (self *LocationCleaner) IsConfigAcceptable(config *util.Config) (bool) {
+	for _, setting := range config.Maintenance.CleanupSettingsList {
+		if !setting.Enabled || setting.Schedule == "" {
+			continue
+		}
+		if _, err := config.Schedule(setting.Schedule, 0); err != nil {
+			util.GOut("cleanup", "WARN: Invalid schedule of the cleanup of %v. Cause: %v", setting.Location, err)
+			return false
+		}
+	}
+	return true
+}
+
+func (self *LocationCleaner) Prepare(ctx context.Context, config *util.Config) {
+	self.initializePaths(config)
+
+	for _, setting := range config.Maintenance.CleanupSettingsList {
+		if !setting.Enabled {
+			continue
+		}
+		self.initializeLocation(ctx, config, setting)
 	}
+}
 
-	self.tickers = self.tickers[0:0]
-	self.workspacePath = self.getWorkspacePath(config)
+// Runs all enabled cleanup settings of the agent of the specified config now (e.g. when triggered via the control API).
+// Settings that should only run when IDLE are skipped while any agent is busy.
+func RunCleanup(config *util.Config) {
+	cleaner := NewLocationCleaner()
+	cleaner.initializePaths(config)
 
 	for _, setting := range config.Maintenance.CleanupSettingsList {
 		if !setting.Enabled {
 			continue
 		}
-		self.initializeLocation(setting)
+		if setting.OnlyWhenIDLE && !util.AllAgentsAreIdle() {
+			util.GOut("cleanup", "WARN: Skipping the cleanup of %v as not all nodes are IDLE.", setting.Location)
+			continue
+		}
+		cleaner.cleanupLocations(cleaner.findLocations(setting), setting.Exclusions, setting.Mode, cleaner.maxTTL(setting))
+	}
+}
+
+func (self *LocationCleaner) initializePaths(config *util.Config) {
+	self.config, self.nodeName = config, config.ClientName
+	self.workspacePath = getWorkspacePath(config)
+	self.remotingPaths = map[string]string{
+		"REMOTING_WORKDIR": config.RemotingWorkDirPath(),
+		"JAR_CACHE": config.RemotingJarCachePath(),
 	}
 }
 
-func (self *LocationCleaner) getWorkspacePath(config *util.Config) string {
-	baseDir := ""
+// Returns the path of the workspace folder of the Jenkins node (from the node config in Jenkins if available).
+func getWorkspacePath(config *util.Config) string {
 	if nodeConfig, err := GetJenkinsNodeConfig(config); err == nil && nodeConfig.RemoteFS != "" {
-		baseDir = filepath.FromSlash(nodeConfig.RemoteFS)
-	} else {
-		baseDir, _ = os.Getwd()
+		return filepath.Join(filepath.FromSlash(nodeConfig.RemoteFS), "workspace")
 	}
-	return filepath.Join(baseDir, "workspace")
+	return getLocalWorkspacePath(config)
 }
 
-func (self *LocationCleaner) initializeLocation(setting util.CleanupSettings) {
-	maxTTL := time.Hour * time.Duration(setting.TTLHours)
-	if maxTTL < minCleanupTTL { maxTTL = minCleanupTTL }
+// Returns the path of the workspace folder inside the directory of the agent (without asking Jenkins).
+func getLocalWorkspacePath(config *util.Config) string {
+	baseDir, _ := filepath.Abs(config.State().Path("."))
+	return filepath.Join(baseDir, "workspace")
+}
 
+func (self *LocationCleaner) initializeLocation(ctx context.Context, config *util.Config, setting util.CleanupSettings) {
 	monitoringInterval := time.Hour * time.Duration(setting.IntervalHours)
 	if monitoringInterval < minMonitoringInterval { monitoringInterval = minMonitoringInterval }
 
-	ticker := time.NewTicker(monitoringInterval)
-	self.tickers = append(self.tickers, ticker)
-
-	findLocations := func() []string {
-		loc := os.Expand(setting.Location, func(name string) string {
-				if strings.EqualFold(name, "workspace") {
-					return self.workspacePath
-				} else {
-					return os.Getenv(name)
-				}
-			})
+	schedule, _ := config.Schedule(setting.Schedule, monitoringInterval)
 
-		if matches, err := filepath.Glob(loc); err == nil {
-			return matches
-		} else if fi, err := os.Stat(loc); err == nil && fi.IsDir() {
-			return []string{loc}
-		} else {
-			return []string{}
+	cleanup := func(ctx context.Context) {
+		if skipMaintenance(config, "cleanup", "the cleanup of " + setting.Location) {
+			return
 		}
-	}
-
-	waitForIdle := func() {
-		if setting.OnlyWhenIDLE && len(findLocations()) > 0 {
-			self.waitForIdle()
+		if setting.OnlyWhenIDLE && len(self.findLocations(setting)) > 0 && !self.waitForIdle(ctx) {
+			return
 		}
+		self.cleanupLocations(self.findLocations(setting), setting.Exclusions, setting.Mode, self.maxTTL(setting))
 	}
 
 	go func() {
-		// Run first
-		waitForIdle()
-		self.cleanupLocations(findLocations(), setting.Exclusions, setting.Mode, maxTTL)
+		// Run first (unless the cleanup is scheduled for specific times)
+		if setting.Schedule == "" {
+			cleanup(ctx)
+		}
 
 		// Run in schedule
-		for _ = range ticker.C {
-			waitForIdle()
-			self.cleanupLocations(findLocations(), setting.Exclusions, setting.Mode, maxTTL)
-		}
+		util.RunScheduled(ctx, "cleanup", scheduledTaskName(config, "Cleanup of " + setting.Location), schedule, cleanup)
 	}()
 }
 
-func (self *LocationCleaner) waitForIdle() {
-	for !util.NodeIsIdle.Get() {
-		util.GOut("cleanup", "Waiting for node to become IDLE before cleaning configured locations.")
-		time.Sleep(time.Minute * 5)
+// Returns the TTL of files in the locations of the setting.
+func (self *LocationCleaner) maxTTL(setting util.CleanupSettings) time.Duration {
+	maxTTL := time.Hour * time.Duration(setting.TTLHours)
+	if maxTTL < minCleanupTTL { maxTTL = minCleanupTTL }
+	return maxTTL
+}
+
+// Returns the existing locations that match the location of the setting.
+// Locations referencing a variable that is not set (or empty) are skipped as they would resolve to the wrong place
+// (e.g. "${remoting_workdir}/remoting/logs" to "/remoting/logs").
+func (self *LocationCleaner) findLocations(setting util.CleanupSettings) []string {
+	unresolved := []string{}
+	loc := os.Expand(setting.Location, func(name string) (value string) {
+			if strings.EqualFold(name, "workspace") {
+				value = self.workspacePath
+			} else if path, found := self.remotingPaths[strings.ToUpper(name)]; found {
+				value = path
+			} else {
+				value = os.Getenv(name)
+			}
+			if value == "" { unresolved = append(unresolved, name) }
+			return
+		})
+
+	if len(unresolved) > 0 {
+		util.GOut("cleanup", "WARN: Skipping cleanup location %v as ${%v} is not set.", setting.Location, strings.Join(unresolved, "}, ${"))
+		return []string{}
+	}
+
+	if loc == "" {
+		return []string{}
+	} else if matches, err := filepath.Glob(loc); err == nil {
+		return matches
+	} else if fi, err := os.Stat(loc); err == nil && fi.IsDir() {
+		return []string{loc}
+	} else {
+		return []string{}
+	}
+}
+
+// Waits until all agents are idle as locations (e.g. ${TEMP}) may be shared between agents.
+// Returns false if the context is done before.
+func (self *LocationCleaner) waitForIdle(ctx context.Context) bool {
+	for !util.AllAgentsAreIdle() {
+		util.GOut("cleanup", "Waiting for nodes to become IDLE before cleaning configured locations.")
+		if !util.Sleep(ctx, time.Minute * 5) {
+			return false
+		}
 	}
+	return true
 }
 
 func (self *LocationCleaner) cleanupLocations(dirsToKeepClean, exclusions []string, mode string, maxTTL time.Duration) {
@@ -154,7 +217,7 @@ func (self *LocationCleaner) cleanupLocations(dirsToKeepClean, exclusions []stri
 
 		if mode == ModeTTLPerLocation {
 			util.GOut("cleanup", "Checking %v for expiration.", rootDir)
-			exclusionCount := self.cleanupFiles(rootDir, expiredTimeOffset, true, exclusions, dirToEmptyMap)
+			exclusionCount, _, _ := self.cleanupFiles(rootDir, expiredTimeOffset, true, exclusions, dirToEmptyMap)
 			if exclusionCount > 0 {
 				return
 			}
@@ -164,7 +227,11 @@ func (self *LocationCleaner) cleanupLocations(dirsToKeepClean, exclusions []stri
 		}
 
 		// Handling outdated temporary files
-		_ = self.cleanupFiles(rootDir, expiredTimeOffset, false, exclusions, dirToEmptyMap)
+		_, removedFiles, freedBytes := self.cleanupFiles(rootDir, expiredTimeOffset, false, exclusions, dirToEmptyMap)
+		if removedFiles > 0 && self.config != nil {
+			util.Notify(self.config, util.EventCleanup, fmt.Sprintf("Removed %d expired files (%s) in %s.", removedFiles, util.FormatByteSize(freedBytes), rootDir),
+				map[string]interface{}{"location": rootDir, "files": removedFiles, "bytes": freedBytes})
+		}
 
 		// Handling all directories that are known to be empty
 		for dirPath, emptyDir := range dirToEmptyMap {
@@ -183,7 +250,7 @@ func (self *LocationCleaner) cleanupLocations(dirsToKeepClean, exclusions []stri
 }
 
 func (self *LocationCleaner) cleanupFiles(rootDir string, expiredTimeOffset time.Time, dryRun bool,
-	exclusions []string, dirToEmptyMap map[string]bool) (exclusionCount int64) {
+	exclusions []string, dirToEmptyMap map[string]bool) (exclusionCount, removedFiles, freedBytes int64) {
 
 	filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
 			if err == nil {
@@ -211,6 +278,8 @@ func (self *LocationCleaner) cleanupFiles(rootDir string, expiredTimeOffset time
 						if !dryRun {
 							if err := os.Remove(path); err == nil {
 								util.GOut("cleanup", "\x1b[39mRemoved expired: %v", path)
+								util.AddMetric(util.MetricCleanupFreedBytes, float64(info.Size()), "node", self.nodeName)
+								removedFiles, freedBytes = removedFiles + 1, freedBytes + info.Size()
 							}
 						}
 					} else {
@@ -224,4 +293,4 @@ func (self *LocationCleaner) cleanupFiles(rootDir string, expiredTimeOffset time
 }
 
 // Registering the cleaner.
-var _ = RegisterPreparer(NewLocationCleaner())
+var _ = RegisterAgentPreparer(func() EnvironmentPreparer { return NewLocationCleaner() })
@@ -0,0 +1,35 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocationsWithUnsetVariablesAreSkipped(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cleanup")
+	defer os.RemoveAll(dir)
+
+	logs := filepath.Join(dir, "remoting", "logs")
+	os.MkdirAll(logs, 0755)
+
+	cleaner := NewLocationCleaner()
+	cleaner.remotingPaths = map[string]string{"REMOTING_WORKDIR": "", "JAR_CACHE": ""}
+
+	for _, location := range []string{"${remoting_workdir}/remoting/logs", "${JCL_TEST_UNSET_VARIABLE}/remoting/logs"} {
+		if locations := cleaner.findLocations(util.CleanupSettings{Location: location}); len(locations) != 0 {
+			t.Errorf("cleaner.findLocations(%v) = %v, want []", location, locations)
+		}
+	}
+
+	cleaner.remotingPaths["REMOTING_WORKDIR"] = dir
+	location := "${remoting_workdir}/remoting/logs"
+	if locations := cleaner.findLocations(util.CleanupSettings{Location: location}); len(locations) != 1 || locations[0] != logs {
+		t.Errorf("cleaner.findLocations(%v) = %v, want [%v]", location, locations, logs)
+	}
+}
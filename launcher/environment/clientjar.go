@@ -4,6 +4,7 @@
 package environment
 
 import (
+	"context"
 	"github.com/jkellerer/jenkins-client-launcher/launcher/modes"
 	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
 	"io"
@@ -30,13 +31,14 @@ func (self *JenkinsClientDownloader) Name() string {
 	return "Jenkins Client Downloader"
 }
 
-func (self *JenkinsClientDownloader) Prepare(config *util.Config) {
-	util.ClientJar, _ = filepath.Abs(ClientJarName)
+func (self *JenkinsClientDownloader) Prepare(ctx context.Context, config *util.Config) {
+	config.State().ClientJar, _ = filepath.Abs(config.State().Path(ClientJarName))
 
-	modes.RegisterModeListener(func(mode modes.ExecutableMode, nextStatus int32, config *util.Config) {
+	modes.RegisterModeListenerFor(config, func(mode modes.ExecutableMode, nextStatus int32, config *util.Config, reason *modes.StopReason) {
 		if mode.Name() == "client" && nextStatus == modes.ModeStarting && config.HasCIConnection() {
 			if err := self.downloadJar(config); err != nil {
-				jar, e := os.Open(ClientJarName); defer jar.Close()
+				util.CountMetric(util.MetricClientJarDownloads, "node", config.ClientName, "result", "failed")
+				jar, e := os.Open(config.State().ClientJar); defer jar.Close()
 				if os.IsNotExist(e) {
 					panic(fmt.Sprintf("No jenkins client: %s", err))
 				} else {
@@ -56,7 +58,9 @@ func (self *JenkinsClientDownloader) downloadJar(config *util.Config) error {
 		return err
 	}
 
-	if fi, err := os.Stat(ClientJarName); err == nil {
+	jarName, downloadName := config.State().ClientJar, config.State().Path(ClientJarDownloadName)
+
+	if fi, err := os.Stat(jarName); err == nil {
 		request.Header.Add("If-Modified-Since", fi.ModTime().Format(http.TimeFormat))
 	}
 
@@ -70,6 +74,7 @@ func (self *JenkinsClientDownloader) downloadJar(config *util.Config) error {
 
 		if response.StatusCode == 304 {
 			util.GOut("DOWNLOAD", "Jenkins client is up-to-date, no need to download.")
+			util.CountMetric(util.MetricClientJarDownloads, "node", config.ClientName, "result", "unchanged")
 			return nil
 		} else if response.StatusCode != 200 {
 			return fmt.Errorf("Failed downloading jenkins client. Cause: HTTP-%v %v", response.StatusCode, response.Status)
@@ -84,7 +89,7 @@ func (self *JenkinsClientDownloader) downloadJar(config *util.Config) error {
 		return fmt.Errorf("Failed downloading jenkins client. Connect failed. Cause: %v", err)
 	}
 
-	target, err := os.Create(ClientJarDownloadName); defer target.Close()
+	target, err := os.Create(downloadName); defer target.Close()
 
 	if err != nil {
 		return fmt.Errorf("Failed downloading jenkins client. Cannot create local file. Cause: %v", err)
@@ -92,9 +97,10 @@ func (self *JenkinsClientDownloader) downloadJar(config *util.Config) error {
 
 	if _, err = io.Copy(target, source); err == nil {
 		target.Close()
-		if err = os.Remove(ClientJarName); err == nil || os.IsNotExist(err) {
-			if err = os.Rename(ClientJarDownloadName, ClientJarName); err == nil {
-				os.Chtimes(ClientJarName, sourceTime, sourceTime)
+		if err = os.Remove(jarName); err == nil || os.IsNotExist(err) {
+			if err = os.Rename(downloadName, jarName); err == nil {
+				os.Chtimes(jarName, sourceTime, sourceTime)
+				util.CountMetric(util.MetricClientJarDownloads, "node", config.ClientName, "result", "downloaded")
 			}
 		}
 		return err
@@ -104,4 +110,4 @@ func (self *JenkinsClientDownloader) downloadJar(config *util.Config) error {
 }
 
 // Registering the downloader.
-var _ = RegisterPreparer(new(JenkinsClientDownloader))
+var _ = RegisterAgentPreparer(func() EnvironmentPreparer { return new(JenkinsClientDownloader) })
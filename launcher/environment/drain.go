@@ -0,0 +1,137 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/modes"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+)
+
+// The interval when Jenkins is asked whether a drained node finished its builds.
+var drainPollInterval = time.Second * 30
+
+// The interval when the local IDLE state is checked if the node cannot be drained in Jenkins.
+var idlePollInterval = time.Minute * 5
+
+// The max time to wait for the restarted client to reconnect before the node is brought back online.
+var drainReconnectTimeout = time.Minute * 10
+
+// Triggers a planned restart of the Jenkins client, "cause" is one of util.RestartReason*.
+// When "onlyWhenIdle" is set running builds may finish before and the node is drained in Jenkins (if enabled).
+// Returns false if the context was done before the restart was triggered.
+func restartPlanned(ctx context.Context, config *util.Config, group, cause string, onlyWhenIdle bool) bool {
+	if onlyWhenIdle {
+		if config.PlannedRestartDrainEnabled && config.HasCIConnection() {
+			if !config.State().Draining.CompareAndSet(false, true) {
+				util.GOut(group, "Node is drained for another restart already, skipping this one.")
+				return true
+			}
+			defer config.State().Draining.Set(false)
+
+			if restarted, err := drainAndRestart(ctx, config, group, cause); err == nil {
+				return restarted
+			} else {
+				util.GOut(group, "WARN: Cannot drain the node in Jenkins, waiting for IDLE instead. Cause: %v", err)
+			}
+		}
+
+		for !config.State().NodeIsIdle.Get() {
+			util.GOut(group, "Waiting for node to become IDLE before triggering a restart.")
+			if !util.Sleep(ctx, idlePollInterval) {
+				return false
+			}
+		}
+	}
+
+	// Stopping the mode as this will automatically do a restart.
+	modes.StopConfiguredMode(config, cause)
+	return true
+}
+
+// Marks the node temporarily offline in Jenkins, waits for running builds to finish (up to the configured timeout)
+// and restarts the client. The node is brought back online after the client reconnected (unless it was offline before).
+// Returns an error if the node could not be marked offline.
+func drainAndRestart(ctx context.Context, config *util.Config, group, cause string) (restarted bool, err error) {
+	wasOffline, err := isNodeOfflineBeforeDrain(config, group)
+	if err != nil {
+		return false, err
+	}
+
+	if !wasOffline {
+		message := fmt.Sprintf(util.OfflineMessagePrefix + "Draining node for a planned restart (%s).", cause)
+		if err = config.SetNodeTemporarilyOffline(config.ClientName, true, message); err != nil {
+			return false, err
+		}
+		util.GOut(group, "Marked the node temporarily offline in Jenkins to let running builds finish.")
+
+		defer func() {
+			if err := config.SetNodeTemporarilyOffline(config.ClientName, false, ""); err != nil {
+				util.GOut(group, "ERROR: Failed bringing the node back online in Jenkins. Cause: %v", err)
+			} else {
+				util.GOut(group, "Node is back online in Jenkins.")
+			}
+		}()
+	}
+
+	if !waitForRunningBuilds(ctx, config, group) {
+		return false, nil
+	}
+
+	modes.StopConfiguredMode(config, cause)
+	waitForReconnect(ctx, config)
+	return true, nil
+}
+
+// Returns true if the node is temporarily offline in Jenkins for a reason that outlasts the restart.
+// Offline causes left by the launcher (e.g. by an interrupted drain) do not count, unless the host is unhealthy.
+func isNodeOfflineBeforeDrain(config *util.Config, group string) (bool, error) {
+	status, err := GetJenkinsNodeStatus(config)
+	if err != nil {
+		return false, err
+	}
+	if status.TemporarilyOffline && util.IsLauncherOfflineMessage(status.OfflineCauseReason) && !config.State().Unhealthy.Get() {
+		util.GOut(group, "Node is offline by a previous run of the launcher (%v), bringing it online after the restart.", status.OfflineCauseReason)
+		return false, nil
+	}
+	return status.TemporarilyOffline, nil
+}
+
+// Waits until Jenkins shows no running builds on the node or the drain timeout elapsed.
+// Returns false if the context is done before.
+func waitForRunningBuilds(ctx context.Context, config *util.Config, group string) bool {
+	deadline := time.Now().Add(time.Minute * time.Duration(config.PlannedRestartDrainTimeoutMinutes))
+
+	for {
+		if status, err := GetJenkinsNodeStatus(config); err == nil && status.Idle {
+			return true
+		} else if err != nil {
+			util.GOut(group, "WARN: Failed reading the node state from Jenkins. Cause: %v", err)
+		}
+
+		if config.PlannedRestartDrainTimeoutMinutes > 0 && time.Now().After(deadline) {
+			util.GOut(group, "WARN: Running builds did not finish within %v minutes, restarting anyway.", config.PlannedRestartDrainTimeoutMinutes)
+			return true
+		}
+
+		util.GOut(group, "Waiting for running builds to finish before triggering a restart.")
+		if !util.Sleep(ctx, drainPollInterval) {
+			return false
+		}
+	}
+}
+
+// Waits until the restarted client is connected again, the reconnect timeout elapsed or the context is done.
+func waitForReconnect(ctx context.Context, config *util.Config) {
+	mode := modes.GetConfiguredMode(config)
+	deadline := time.Now().Add(drainReconnectTimeout)
+
+	for !modes.IsConnected(mode.Status().Get()) && time.Now().Before(deadline) {
+		if !util.Sleep(ctx, time.Second) {
+			return
+		}
+	}
+}
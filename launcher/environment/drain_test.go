@@ -0,0 +1,113 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+)
+
+// Simulates the node API of Jenkins, the node has running builds until "busyPolls" state requests were made.
+type fakeJenkinsNode struct {
+	mutex          sync.Mutex
+	offline        bool
+	offlineMessage string
+	busyPolls      int
+	toggles        []string
+}
+
+func (self *fakeJenkinsNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/toggleOffline"):
+		self.offline, self.offlineMessage = !self.offline, r.URL.Query().Get("offlineMessage")
+		self.toggles = append(self.toggles, fmt.Sprintf("offline=%v busy=%v", self.offline, self.busyPolls > 0))
+	case strings.Contains(r.URL.Path, "/crumbIssuer/"):
+		http.NotFound(w, r)
+	case strings.HasSuffix(r.URL.Path, "/api/xml"):
+		if self.busyPolls > 0 && r.URL.Query().Get("tree") == "" { self.busyPolls-- }
+		fmt.Fprintf(w, "<slave><idle>%v</idle><offline>%v</offline><temporarilyOffline>%v</temporarilyOffline>" +
+			"<offlineCauseReason>%s</offlineCauseReason></slave>", self.busyPolls == 0, self.offline, self.offline, self.offlineMessage)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newDrainTestConfig(t *testing.T, node *fakeJenkinsNode) (*util.Config, func()) {
+	pollInterval, reconnectTimeout := drainPollInterval, drainReconnectTimeout
+	t.Cleanup(func() { drainPollInterval, drainReconnectTimeout = pollInterval, reconnectTimeout })
+
+	drainPollInterval, drainReconnectTimeout = time.Millisecond, time.Millisecond
+	server := httptest.NewServer(node)
+
+	config := util.NewDefaultConfig()
+	config.CIHostURI, config.ClientName = server.URL, "my-node"
+	return config, server.Close
+}
+
+func TestPlannedRestartDrainsTheNode(t *testing.T) {
+	node := &fakeJenkinsNode{busyPolls: 3}
+	config, closeServer := newDrainTestConfig(t, node)
+	defer closeServer()
+
+	if !restartPlanned(context.Background(), config, "test", util.RestartReasonPeriodic, true) {
+		t.Fatal("restartPlanned(...) = false, want true")
+	}
+
+	expected := []string{"offline=true busy=true", "offline=false busy=false"}
+	if fmt.Sprint(node.toggles) != fmt.Sprint(expected) {
+		t.Errorf("toggles = %v, want %v", node.toggles, expected)
+	}
+	if config.State().Draining.Get() {
+		t.Error("Draining = true after the restart, want false")
+	}
+}
+
+func TestPlannedRestartKeepsNodeOfflineWhenItWasOfflineBefore(t *testing.T) {
+	node := &fakeJenkinsNode{offline: true}
+	config, closeServer := newDrainTestConfig(t, node)
+	defer closeServer()
+
+	restartPlanned(context.Background(), config, "test", util.RestartReasonPeriodic, true)
+
+	if len(node.toggles) != 0 || !node.offline {
+		t.Errorf("toggles = %v, want none and the node to stay offline", node.toggles)
+	}
+}
+
+func TestPlannedRestartBringsNodeOnlineThatWasLeftOfflineByTheLauncher(t *testing.T) {
+	node := &fakeJenkinsNode{offline: true, offlineMessage: util.OfflineMessagePrefix + "Draining node for a planned restart (periodic)."}
+	config, closeServer := newDrainTestConfig(t, node)
+	defer closeServer()
+
+	restartPlanned(context.Background(), config, "test", util.RestartReasonPeriodic, true)
+
+	if node.offline {
+		t.Errorf("toggles = %v, want the node to be brought online", node.toggles)
+	}
+}
+
+func TestPlannedRestartBringsNodeOnlineWhenCancelled(t *testing.T) {
+	node := &fakeJenkinsNode{busyPolls: 1000}
+	config, closeServer := newDrainTestConfig(t, node)
+	defer closeServer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond * 50, cancel)
+
+	if restartPlanned(ctx, config, "test", util.RestartReasonPeriodic, true) {
+		t.Error("restartPlanned(...) = true after the context was cancelled, want false")
+	}
+	if node.offline {
+		t.Error("Node is still offline after the drain was cancelled.")
+	}
+}
@@ -4,6 +4,7 @@
 package environment
 
 import (
+	"context"
 	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
 	"sync"
 )
@@ -13,8 +14,8 @@ type EnvironmentPreparer interface {
 util.ConfigVerifier
 	// Returns the name of the mode.
 	Name() (string)
-	// Prepares the environment.
-	Prepare(config *util.Config)
+	// Prepares the environment, goroutines started by the preparer must end when the context is done.
+	Prepare(ctx context.Context, config *util.Config)
 }
 
 // Contains all registered preparers.
@@ -26,6 +27,17 @@ func RegisterPreparer(preparer EnvironmentPreparer) EnvironmentPreparer {
 	return preparer
 }
 
+// Contains the factories of preparers that operate on a single agent (by preparer name).
+var agentPreparerFactories = map[string]func() EnvironmentPreparer{}
+
+// Registers a new preparer that operates on a single agent and returns it.
+// The returned preparer is used with the main config, additional agents use new instances created by the factory.
+func RegisterAgentPreparer(factory func() EnvironmentPreparer) EnvironmentPreparer {
+	preparer := factory()
+	agentPreparerFactories[preparer.Name()] = factory
+	return RegisterPreparer(preparer)
+}
+
 // Passes all registered preparers to the specified callback.
 func VisitAllPreparers(fn func(EnvironmentPreparer)) {
 	for _, preparer := range AllEnvironmentPreparers {
@@ -33,38 +45,89 @@ func VisitAllPreparers(fn func(EnvironmentPreparer)) {
 	}
 }
 
-// Runs all registered preparers.
-func RunPreparers(config *util.Config) {
+// Is set when the registered preparers were used with the main config.
+var registeredPreparersUsed = false
+
+// Passes the preparers that operate on the agent of the specified config to the callback.
+// All registered preparers operate on the main config, additional agents (and the main config after it was
+// reloaded) get new instances of agent preparers.
+func visitPreparersFor(config *util.Config, fn func(EnvironmentPreparer)) {
+	main := config.State().Name == ""
+	useRegistered := main && !registeredPreparersUsed
+	if main { registeredPreparersUsed = true }
+
+	VisitAllPreparers(func(p EnvironmentPreparer) {
+		if factory, found := agentPreparerFactories[p.Name()]; found && !useRegistered {
+			fn(factory())
+		} else if main {
+			fn(p)
+		}
+	})
+}
+
+// Returns the name of a scheduled task of the agent of the specified config as shown in the status output.
+func scheduledTaskName(config *util.Config, task string) string {
+	if name := config.State().Name; name != "" {
+		return task + " (agent " + name + ")"
+	}
+	return task
+}
+
+// Returns true (and logs it) if a scheduled maintenance task is skipped as a user holds the node offline in Jenkins.
+func skipMaintenance(config *util.Config, group, task string) bool {
+	if config.IsMaintenancePaused() {
+		util.GOut(group, "Skipping %v as the node is held offline in Jenkins.", task)
+		return true
+	}
+	return false
+}
+
+// Runs all registered preparers for the agent of the specified config.
+// Monitoring started by the preparers ends when the context is done.
+func RunPreparers(ctx context.Context, config *util.Config) {
+	preparers := []EnvironmentPreparer{}
+	visitPreparersFor(config, func(p EnvironmentPreparer) {
+		preparers = append(preparers, p)
+	})
+
+	group := "ENV"
+	if config.State().Name != "" { group += ":" + config.State().Name }
+
 	work := new(sync.WaitGroup)
-	work.Add(len(AllEnvironmentPreparers))
+	work.Add(len(preparers))
 
 	enabledPreparers := map[string]bool{}
+	visit := func(fn func(EnvironmentPreparer)) {
+		for _, preparer := range preparers {
+			fn(preparer)
+		}
+	}
 
-	VisitAllPreparers(func(p EnvironmentPreparer) {
+	visit(func(p EnvironmentPreparer) {
 		if p.IsConfigAcceptable(config) {
 			enabledPreparers[p.Name()] = true
 		} else {
-			util.GOut("ENV", "WARN: Environment preparer %s does not accept the current config and won't operate.", p.Name())
-			util.GOut("ENV", "Adjust the configuration to prevent the warning above.")
+			util.GOut(group, "WARN: Environment preparer %s does not accept the current config and won't operate.", p.Name())
+			util.GOut(group, "Adjust the configuration to prevent the warning above.")
 		}
 	})
 
-	VisitAllPreparers(func(p EnvironmentPreparer) {
+	visit(func(p EnvironmentPreparer) {
 		if enabledPreparers[p.Name()] {
-			util.GOut("ENV", "Preparing %v", p.Name())
+			util.GOut(group, "Preparing %v", p.Name())
 			go func() {
 				defer func() {
 					work.Done()
 				}()
-				p.Prepare(config)
+				p.Prepare(ctx, config)
 			}()
 		} else {
-			util.GOut("ENV", "Skipping %v", p.Name())
+			util.GOut(group, "Skipping %v", p.Name())
 			work.Done()
 		}
 	})
 
 	work.Wait()
 
-	util.GOut("ENV", "Finished preparing the environment.")
+	util.GOut(group, "Finished preparing the environment.")
 }
@@ -0,0 +1,240 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+)
+
+// The min interval between 2 health checks.
+const minHealthCheckInterval = time.Second * 10
+
+// The start of the offline message that is set in Jenkins when the host is unhealthy.
+const unhealthyOfflineMessage = util.OfflineMessagePrefix + "Host is unhealthy"
+
+// Implements checks of the host (disk, memory, load, clock) that mark the node temporarily offline
+// in Jenkins when a threshold is exceeded.
+type HostHealthChecker struct {
+	healthyChecks int
+	lastProblems  string
+}
+
+func (self *HostHealthChecker) Name() string {
+	return "Host Health Checker"
+}
+
+func (self *HostHealthChecker) IsConfigAcceptable(config *util.Config) (bool) {
+	if !config.HealthChecksEnabled {
+		return true
+	}
+	if !config.HasCIConnection() {
+		util.GOut("health", "WARN: No Jenkins URI defined. The node cannot be taken offline when the host is unhealthy.")
+		return false
+	}
+	for _, threshold := range []string{config.HealthMinFreeDiskSpace, config.HealthMinFreeInodes, config.HealthMinFreeMemory} {
+		if _, err := util.ParseThreshold(threshold, 0); err != nil {
+			util.GOut("health", "WARN: Invalid health check threshold. Cause: %v", err)
+			return false
+		}
+	}
+	return true
+}
+
+func (self *HostHealthChecker) Prepare(ctx context.Context, config *util.Config) {
+	if !config.HealthChecksEnabled {
+		return
+	}
+
+	interval := time.Second * time.Duration(config.HealthCheckIntervalSeconds)
+	if interval < minHealthCheckInterval { interval = minHealthCheckInterval }
+
+	go func() {
+		self.adoptOfflineState(config)
+
+		// Run in schedule
+		util.Every(ctx, interval, func() {
+			self.check(config)
+		})
+	}()
+}
+
+// Marks the host unhealthy when Jenkins still shows the node offline by a health check of a previous run
+// (e.g. after the launcher was restarted), so that it is brought back online when the host is healthy.
+func (self *HostHealthChecker) adoptOfflineState(config *util.Config) {
+	if status, err := GetJenkinsNodeStatus(config); err != nil {
+		util.GOut("health", "WARN: Failed reading the offline state of the node from Jenkins. Cause: %v", err)
+	} else if status.TemporarilyOffline && strings.HasPrefix(status.OfflineReason(), unhealthyOfflineMessage) {
+		util.GOut("health", "Node was marked offline by a previous health check: %v", status.OfflineReason())
+		config.State().Unhealthy.Set(true)
+	}
+}
+
+// Checks the host and marks the node offline in Jenkins when it is unhealthy or online when it is healthy again.
+func (self *HostHealthChecker) check(config *util.Config) {
+	problems := strings.Join(self.findProblems(config), "; ")
+	state := config.State()
+
+	if problems != self.lastProblems {
+		if problems != "" {
+			util.GOut("health", "WARN: Host is unhealthy: %s", problems)
+		} else if self.lastProblems != "" {
+			util.GOut("health", "Host is healthy again.")
+		}
+		self.lastProblems = problems
+	}
+
+	if problems != "" {
+		self.healthyChecks = 0
+		if !state.Unhealthy.Get() && !state.Draining.Get() {
+			self.markOffline(config, problems)
+		}
+	} else if state.Unhealthy.Get() {
+		if self.healthyChecks++; self.healthyChecks >= config.HealthRecoverAfterChecks {
+			self.bringOnline(config)
+		}
+	}
+}
+
+// Marks the node temporarily offline in Jenkins unless it is offline already.
+func (self *HostHealthChecker) markOffline(config *util.Config, problems string) {
+	if offline, err := config.IsNodeTemporarilyOffline(config.ClientName); err != nil {
+		util.GOut("health", "ERROR: Failed reading the offline state of the node from Jenkins. Cause: %v", err)
+	} else if !offline {
+		if err = config.SetNodeTemporarilyOffline(config.ClientName, true, unhealthyOfflineMessage + ": " + problems); err != nil {
+			util.GOut("health", "ERROR: Failed marking the node offline in Jenkins. Cause: %v", err)
+		} else {
+			util.GOut("health", "WARN: Marked the node temporarily offline in Jenkins.")
+			config.State().Unhealthy.Set(true)
+		}
+	}
+}
+
+// Brings the node back online in Jenkins after it was marked offline by the health checks.
+func (self *HostHealthChecker) bringOnline(config *util.Config) {
+	if err := config.SetNodeTemporarilyOffline(config.ClientName, false, ""); err != nil {
+		util.GOut("health", "ERROR: Failed bringing the node back online in Jenkins. Cause: %v", err)
+	} else {
+		util.GOut("health", "Node is back online in Jenkins.")
+		config.State().Unhealthy.Set(false)
+	}
+}
+
+// Runs all configured checks and returns a description of every exceeded threshold.
+func (self *HostHealthChecker) findProblems(config *util.Config) []string {
+	problems := []string{}
+	problems = append(problems, self.checkDisks(config)...)
+
+	if config.HealthMinFreeMemory != "" {
+		if total, err := util.TotalMemory(); err == nil {
+			minFree, _ := util.ParseThreshold(config.HealthMinFreeMemory, total)
+			if free, err := util.FreeMemory(); err == nil && free < minFree {
+				problems = append(problems, fmt.Sprintf("free memory is %s (min %s)", util.FormatByteSize(free), config.HealthMinFreeMemory))
+			}
+		}
+	}
+
+	if config.HealthMaxLoadPerCPU > 0 {
+		if load, err := util.LoadAverage(); err == nil && load / float64(runtime.NumCPU()) > config.HealthMaxLoadPerCPU {
+			problems = append(problems, fmt.Sprintf("load average is %.2f on %d CPUs (max %.2f per CPU)", load, runtime.NumCPU(), config.HealthMaxLoadPerCPU))
+		}
+	}
+
+	if config.HealthMaxClockSkewSeconds > 0 {
+		if skew, err := self.clockSkew(config); err != nil {
+			util.GOut("health", "WARN: Failed reading the time of the Jenkins server. Cause: %v", err)
+		} else if skew > time.Second * time.Duration(config.HealthMaxClockSkewSeconds) || -skew > time.Second * time.Duration(config.HealthMaxClockSkewSeconds) {
+			problems = append(problems, fmt.Sprintf("clock differs from Jenkins by %v (max %vs)", skew, config.HealthMaxClockSkewSeconds))
+		}
+	}
+
+	return problems
+}
+
+// Checks free space and inodes of the filesystems that contain the configured locations.
+func (self *HostHealthChecker) checkDisks(config *util.Config) []string {
+	problems, checked := []string{}, map[string]bool{}
+
+	for _, location := range config.HealthDiskLocations {
+		path := self.existingPath(self.expandLocation(config, location))
+		if path == "" || checked[path] {
+			continue
+		}
+		checked[path] = true
+
+		usage, err := util.GetDiskUsage(path)
+		if err != nil {
+			util.GOut("health", "WARN: Failed reading the disk usage of %v. Cause: %v", path, err)
+			continue
+		}
+
+		if minFree, _ := util.ParseThreshold(config.HealthMinFreeDiskSpace, usage.Total); usage.Free < minFree {
+			problems = append(problems, fmt.Sprintf("free disk space on %s is %s (min %s)", path, util.FormatByteSize(usage.Free), config.HealthMinFreeDiskSpace))
+		}
+
+		if usage.TotalInodes > 0 {
+			if minFree, _ := util.ParseThreshold(config.HealthMinFreeInodes, usage.TotalInodes); usage.FreeInodes < minFree {
+				problems = append(problems, fmt.Sprintf("free inodes on %s are %d (min %s)", path, usage.FreeInodes, config.HealthMinFreeInodes))
+			}
+		}
+	}
+
+	return problems
+}
+
+// Expands ${workspace}, ${temp} and environment variables in the location.
+func (self *HostHealthChecker) expandLocation(config *util.Config, location string) string {
+	return os.Expand(location, func(name string) string {
+		if strings.EqualFold(name, "workspace") {
+			return getWorkspacePath(config)
+		} else if strings.EqualFold(name, "temp") {
+			return os.TempDir()
+		}
+		return os.Getenv(name)
+	})
+}
+
+// Returns the path or its nearest existing parent directory (e.g. when the workspace was not created yet).
+func (self *HostHealthChecker) existingPath(path string) string {
+	if path == "" {
+		return ""
+	}
+
+	for path, _ = filepath.Abs(path); ; path = filepath.Dir(path) {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		} else if filepath.Dir(path) == path {
+			return ""
+		}
+	}
+}
+
+// Returns the difference between the time of the Jenkins server (from the "Date" header) and the local time.
+func (self *HostHealthChecker) clockSkew(config *util.Config) (time.Duration, error) {
+	start := time.Now()
+	response, err := config.CIGet(fmt.Sprintf(NodeMonitoringURI, config.ClientName))
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	roundTrip := time.Since(start)
+
+	serverTime, err := http.ParseTime(response.Header.Get("Date"))
+	if err != nil {
+		return 0, err
+	}
+
+	// The header has a resolution of seconds, comparing it with the local time in the middle of the request.
+	return serverTime.Sub(start.Add(roundTrip / 2).Truncate(time.Second)), nil
+}
+
+// Registering the health checker.
+var _ = RegisterAgentPreparer(func() EnvironmentPreparer { return new(HostHealthChecker) })
@@ -0,0 +1,87 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"testing"
+	"time"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+)
+
+func TestUnhealthyHostIsTakenOfflineUntilRecovered(t *testing.T) {
+	node := &fakeJenkinsNode{}
+	config, closeServer := newDrainTestConfig(t, node)
+	defer closeServer()
+
+	config.HealthDiskLocations = []string{"${temp}"}
+	config.HealthMinFreeDiskSpace, config.HealthRecoverAfterChecks = "1000000t", 2
+	checker := new(HostHealthChecker)
+
+	checker.check(config)
+	checker.check(config)
+	if !node.offline || !config.State().Unhealthy.Get() || len(node.toggles) != 1 {
+		t.Fatalf("offline = %v, toggles = %v; want the node to be marked offline once", node.offline, node.toggles)
+	}
+
+	config.HealthMinFreeDiskSpace = ""
+	checker.check(config)
+	if !node.offline {
+		t.Error("Node was brought online before 2 healthy checks.")
+	}
+	checker.check(config)
+	if node.offline || config.State().Unhealthy.Get() {
+		t.Error("Node was not brought online after 2 healthy checks.")
+	}
+}
+
+func TestHealthChecksKeepNodesOfflineThatWereOfflineBefore(t *testing.T) {
+	node := &fakeJenkinsNode{offline: true}
+	config, closeServer := newDrainTestConfig(t, node)
+	defer closeServer()
+
+	config.HealthDiskLocations = []string{"${temp}"}
+	config.HealthMinFreeDiskSpace, config.HealthRecoverAfterChecks = "1000000t", 1
+	checker := new(HostHealthChecker)
+
+	checker.check(config)
+	config.HealthMinFreeDiskSpace = ""
+	checker.check(config)
+
+	if !node.offline || len(node.toggles) != 0 {
+		t.Errorf("offline = %v, toggles = %v; want the node to stay offline", node.offline, node.toggles)
+	}
+}
+
+func TestHealthChecksRecoverNodesMarkedOfflineByAPreviousRun(t *testing.T) {
+	node := &fakeJenkinsNode{offline: true, offlineMessage: util.OfflineMessagePrefix + "Host is unhealthy: disk full"}
+	config, closeServer := newDrainTestConfig(t, node)
+	defer closeServer()
+
+	config.HealthDiskLocations, config.HealthMinFreeDiskSpace, config.HealthRecoverAfterChecks = []string{"${temp}"}, "", 1
+	checker := new(HostHealthChecker)
+
+	checker.adoptOfflineState(config)
+	if !config.State().Unhealthy.Get() {
+		t.Fatal("adoptOfflineState(...) did not mark the host unhealthy.")
+	}
+
+	checker.check(config)
+	if node.offline || config.State().Unhealthy.Get() {
+		t.Errorf("offline = %v, toggles = %v; want the node to be brought online", node.offline, node.toggles)
+	}
+}
+
+func TestClockSkewIsSmallWithSynchronizedClocks(t *testing.T) {
+	config, closeServer := newDrainTestConfig(t, &fakeJenkinsNode{})
+	defer closeServer()
+
+	if skew, err := new(HostHealthChecker).clockSkew(config); err != nil || skew < -time.Second * 2 || skew > time.Second * 2 {
+		t.Errorf("clockSkew(...) = %v, %v; want less than 2s", skew, err)
+	}
+
+	config.HealthDiskLocations, config.HealthMaxClockSkewSeconds = nil, 5
+	if problems := new(HostHealthChecker).findProblems(config); len(problems) != 0 {
+		t.Errorf("findProblems(...) = %v, want none", problems)
+	}
+}
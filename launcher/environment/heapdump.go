@@ -0,0 +1,149 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Is the prefix of managed heap dump file names.
+const heapDumpPrefix = "heapdump-"
+
+// Creates the heap dump directory and adds the JVM options that write heap dumps on OutOfMemoryErrors.
+func (self *OutOfMemoryErrorRestarter) prepareHeapDumps(cwd string, config *util.Config) error {
+	directory := config.HeapDumpDirectory
+	if !filepath.IsAbs(directory) {
+		directory = filepath.Join(cwd, directory)
+	}
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+
+	self.heapDumpDirectory = directory
+	config.State().WritableDirectories = append(config.State().WritableDirectories, directory)
+	config.State().JavaArgs = append(config.State().JavaArgs, "-XX:+HeapDumpOnOutOfMemoryError", "-XX:HeapDumpPath=" + directory)
+	return nil
+}
+
+// Renames heap dumps that were written by the JVM (java_pid*.hprof) into managed dumps, compresses them
+// in background (if enabled) and returns the final paths of the dumps.
+func (self *OutOfMemoryErrorRestarter) collectHeapDumps(config *util.Config) (paths []string) {
+	dumps, _ := filepath.Glob(filepath.Join(self.heapDumpDirectory, "*.hprof"))
+	pending := []string{}
+
+	for _, dump := range dumps {
+		if strings.HasPrefix(filepath.Base(dump), heapDumpPrefix) {
+			continue
+		}
+
+		info, err := os.Stat(dump)
+		if err != nil {
+			continue
+		}
+
+		name := fmt.Sprintf("%s%s-%s", heapDumpPrefix, info.ModTime().Format("20060102-150405"), filepath.Base(dump))
+		path := filepath.Join(self.heapDumpDirectory, name)
+		if err := os.Rename(dump, path); err != nil {
+			util.GOut("OOM", "ERROR: Failed moving heap dump %v. Cause: %v", dump, err)
+			continue
+		}
+
+		util.GOut("OOM", "Found heap dump %v (%v).", path, util.FormatByteSize(info.Size()))
+		pending = append(pending, path)
+
+		if config.HeapDumpCompress {
+			path += ".gz"
+		}
+		paths = append(paths, path)
+	}
+
+	if len(pending) > 0 {
+		// Compressing may take a while, it must not delay the restart.
+		go func() {
+			self.heapDumpMutex.Lock(); defer self.heapDumpMutex.Unlock()
+			if config.HeapDumpCompress {
+				for _, path := range pending {
+					if err := self.compressHeapDump(path); err != nil {
+						util.GOut("OOM", "ERROR: Failed compressing heap dump %v. Cause: %v", path, err)
+					}
+				}
+			}
+			self.pruneHeapDumps(config)
+		}()
+	}
+
+	return
+}
+
+// Compresses the specified dump to "path.gz" and removes the uncompressed dump.
+func (self *OutOfMemoryErrorRestarter) compressHeapDump(path string) (err error) {
+	input, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	output, err := os.OpenFile(path + ".gz.tmp", os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+
+	writer := gzip.NewWriter(output)
+	if _, err = io.Copy(writer, input); err == nil {
+		err = writer.Close()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		if err = os.Rename(path + ".gz.tmp", path + ".gz"); err == nil {
+			input.Close()
+			return os.Remove(path)
+		}
+	}
+
+	os.Remove(path + ".gz.tmp")
+	return
+}
+
+// Removes the oldest managed dumps exceeding the number of dumps to keep or the configured size budget.
+func (self *OutOfMemoryErrorRestarter) pruneHeapDumps(config *util.Config) {
+	dumps := []string{}
+	for _, pattern := range []string{"*.hprof", "*.hprof.gz"} {
+		matches, _ := filepath.Glob(filepath.Join(self.heapDumpDirectory, heapDumpPrefix + pattern))
+		dumps = append(dumps, matches...)
+	}
+
+	// Names start with the timestamp, sorting them newest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(dumps)))
+
+	totalSize, maxTotalSize := int64(0), config.HeapDumpMaxTotalMB * 1024 * 1024
+	for index, dump := range dumps {
+		info, err := os.Stat(dump)
+		if err != nil {
+			continue
+		}
+		totalSize += info.Size()
+
+		exceedsCount := config.HeapDumpsToKeep > 0 && index >= config.HeapDumpsToKeep
+		exceedsSize := maxTotalSize > 0 && totalSize > maxTotalSize
+
+		if exceedsCount || exceedsSize {
+			util.GOut("OOM", "Removing heap dump %v.", dump)
+			if err := os.Remove(dump); err != nil {
+				util.GOut("OOM", "WARN: Failed removing heap dump %v. Cause: %v", dump, err)
+			}
+			totalSize -= info.Size()
+		}
+	}
+}
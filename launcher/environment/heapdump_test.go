@@ -0,0 +1,49 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeapDumpsAreCompressedAndPruned(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "heapdumps")
+	defer os.RemoveAll(dir)
+
+	config := &util.Config{}
+	config.HeapDumpCompress, config.HeapDumpsToKeep = true, 2
+
+	restarter := NewOutOfMemoryErrorRestarter()
+	restarter.heapDumpDirectory = dir
+
+	for i, name := range []string{"heapdump-20140101-000000-java_pid1.hprof.gz", "heapdump-20140102-000000-java_pid2.hprof.gz"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte{byte(i)}, 0600)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "java_pid3.hprof"), []byte(strings.Repeat("heap", 1024)), 0600)
+
+	paths := restarter.collectHeapDumps(config)
+	if len(paths) != 1 || !strings.HasSuffix(paths[0], "-java_pid3.hprof.gz") {
+		t.Fatalf("restarter.collectHeapDumps(config) = %v, want [.../heapdump-*-java_pid3.hprof.gz]", paths)
+	}
+
+	for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); time.Sleep(time.Millisecond * 50) {
+		if _, err := os.Stat(filepath.Join(dir, "heapdump-20140101-000000-java_pid1.hprof.gz")); os.IsNotExist(err) {
+			break
+		}
+	}
+
+	restarter.heapDumpMutex.Lock(); defer restarter.heapDumpMutex.Unlock()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 2 || files[0] != filepath.Join(dir, "heapdump-20140102-000000-java_pid2.hprof.gz") || files[1] != paths[0] {
+		t.Errorf("Heap dump directory contains %v, want [heapdump-20140102-...-java_pid2.hprof.gz %v]", files, paths[0])
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"context"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/modes"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	HookPreStart = "preStart"
+	HookPostStop = "postStop"
+)
+
+// The time after which hook commands are killed when no timeout is configured.
+var defaultHookTimeout = time.Minute * 5
+
+// Executes the configured hook commands before the Jenkins client starts and after it stopped.
+type HookRunner struct {
+	util.AnyConfigAcceptor
+	once *sync.Once
+}
+
+func NewHookRunner() *HookRunner {
+	p := new(HookRunner)
+	p.once = new(sync.Once)
+	return p
+}
+
+func (self *HookRunner) Name() string {
+	return "Client Hook Runner"
+}
+
+func (self *HookRunner) Prepare(ctx context.Context, config *util.Config) {
+	self.once.Do(func() {
+		modes.RegisterModeListenerFor(config, func(mode modes.ExecutableMode, nextStatus int32, config *util.Config, reason *modes.StopReason) {
+			if mode.Name() != "client" {
+				return
+			}
+
+			if nextStatus == modes.ModeStarting {
+				for _, hook := range config.PreStartHooks {
+					if err := self.run(hook, HookPreStart, config, nil); err != nil {
+						if hook.AbortStartOnFailure {
+							modes.AbortStart(mode, fmt.Errorf("Hook '%s' failed: %v", hook.Command, err))
+							return
+						}
+						util.GOut("hook", "WARN: Hook '%s' failed: %v", hook.Command, err)
+					}
+				}
+			} else if nextStatus == modes.ModeStopped {
+				for _, hook := range config.PostStopHooks {
+					if err := self.run(hook, HookPostStop, config, reason); err != nil {
+						util.GOut("hook", "WARN: Hook '%s' failed: %v", hook.Command, err)
+					}
+				}
+			}
+		})
+	})
+}
+
+// Runs the hook command, waits until it finished or timed out and returns an error if it did not succeed.
+func (self *HookRunner) run(hook util.Hook, name string, config *util.Config, reason *modes.StopReason) (err error) {
+	if hook.Command == "" {
+		return nil
+	}
+
+	timeout := time.Second * time.Duration(hook.TimeoutSeconds)
+	if timeout <= 0 { timeout = defaultHookTimeout }
+
+	util.GOut("hook", "Running %s hook: %s", name, hook.Command)
+	return util.RunShellCommand("hook", hook.Command, self.hookEnvironment(name, config, reason), timeout)
+}
+
+// Returns the environment variables ("name=value") that describe the node and stop reason to hook commands.
+func (self *HookRunner) hookEnvironment(name string, config *util.Config, reason *modes.StopReason) []string {
+	env := []string{
+		"JCL_HOOK=" + name,
+		"JCL_NODE_NAME=" + config.ClientName,
+		"JCL_CI_URL=" + config.CIHostURI,
+		"JCL_RUN_MODE=" + config.RunMode,
+	}
+
+	if reason != nil {
+		env = append(env,
+			"JCL_STOP_REASON=" + reason.Cause,
+			fmt.Sprintf("JCL_EXIT_CODE=%d", reason.ExitCode),
+			"JCL_SIGNAL=" + reason.Signal)
+	}
+
+	return env
+}
+
+// Registering the hook runner.
+var _ = RegisterAgentPreparer(func() EnvironmentPreparer { return NewHookRunner() })
@@ -0,0 +1,41 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+// +build !windows
+
+package environment
+
+import (
+	"testing"
+	"time"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+)
+
+var hookRunner = NewHookRunner()
+
+func TestHookFailsWithNonZeroExitCode(t *testing.T) {
+	config := util.NewDefaultConfig()
+	if err := hookRunner.run(util.Hook{Command: "exit 3"}, HookPreStart, config, nil); err == nil {
+		t.Errorf("hookRunner.run('exit 3') did not fail.")
+	}
+	if err := hookRunner.run(util.Hook{Command: "echo ok"}, HookPreStart, config, nil); err != nil {
+		t.Errorf("hookRunner.run('echo ok') = %v, want nil", err)
+	}
+}
+
+func TestHookReceivesEnvironment(t *testing.T) {
+	config := util.NewDefaultConfig()
+	config.ClientName = "my-node"
+	hook := util.Hook{Command: `test "$JCL_NODE_NAME" = "my-node" && test "$JCL_HOOK" = "preStart"`}
+	if err := hookRunner.run(hook, HookPreStart, config, nil); err != nil {
+		t.Errorf("hookRunner.run(...) = %v, want nil", err)
+	}
+}
+
+func TestHookIsKilledOnTimeout(t *testing.T) {
+	start := time.Now()
+	hook := util.Hook{Command: "sleep 10", TimeoutSeconds: 1}
+	if err := hookRunner.run(hook, HookPostStop, util.NewDefaultConfig(), nil); err == nil || time.Since(start) > time.Second * 5 {
+		t.Errorf("hookRunner.run('sleep 10') = %v after %v, want timeout after 1s", err, time.Since(start))
+	}
+}
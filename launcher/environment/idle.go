@@ -0,0 +1,147 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/modes"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+)
+
+// The interval when the IDLE state is detected locally.
+var localIdleDetectionInterval = time.Second * 30
+
+// The max depth and number of entries that are checked for recent modifications inside the workspace.
+const (
+	maxWorkspaceScanDepth   = 4
+	maxWorkspaceScanEntries = 20000
+)
+
+// Ends walking the workspace.
+var errStopWalking = errors.New("stop walking")
+
+// Detects the IDLE state of the node from the processes started by the Jenkins client and the
+// activity inside the workspace (used when the node state is not monitored on Jenkins).
+type LocalIdleDetector struct {
+	workspacePath string
+	lastBusyCause string
+}
+
+func (self *LocalIdleDetector) Name() string {
+	return "Local IDLE Detector"
+}
+
+func (self *LocalIdleDetector) IsConfigAcceptable(config *util.Config) (bool) {
+	for _, pattern := range config.ClientLocalIdleIgnoredProcesses {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			util.GOut("idle", "WARN: Invalid process name pattern '%v'. Cause: %v", pattern, err)
+			return false
+		}
+	}
+	return true
+}
+
+func (self *LocalIdleDetector) Prepare(ctx context.Context, config *util.Config) {
+	if config.ClientMonitorStateOnServer || !config.ClientLocalIdleDetection {
+		return
+	}
+
+	// The node is not monitored on Jenkins, the workspace is expected in the directory of the agent.
+	self.workspacePath = getLocalWorkspacePath(config)
+	util.GOut("idle", "Detecting the IDLE state locally from client processes and activity in %v.", self.workspacePath)
+
+	self.detect(config)
+	go util.Every(ctx, localIdleDetectionInterval, func() {
+		self.detect(config)
+	})
+}
+
+// Updates the IDLE state of the node and logs changes.
+func (self *LocalIdleDetector) detect(config *util.Config) {
+	busyCause := self.findBusyCause(config)
+
+	if busyCause != self.lastBusyCause {
+		if busyCause != "" {
+			util.GOut("idle", "Node is BUSY locally: %v", busyCause)
+		} else {
+			util.GOut("idle", "Node is IDLE locally.")
+		}
+		self.lastBusyCause = busyCause
+	}
+
+	config.State().NodeIsIdle.Set(busyCause == "")
+}
+
+// Returns why the node is considered busy or "" if it is IDLE.
+func (self *LocalIdleDetector) findBusyCause(config *util.Config) string {
+	if client, ok := modes.GetConfiguredMode(config).(*modes.ClientMode); ok && client.Pid() > 0 {
+		if processes, err := util.DescendantProcesses(client.Pid()); err != nil {
+			util.GOut("idle", "WARN: Failed listing the processes of the Jenkins client. Cause: %v", err)
+		} else if names := self.buildProcesses(config, processes); len(names) > 0 {
+			return fmt.Sprintf("%d processes started by the Jenkins client (%s)", len(names), strings.Join(names, ", "))
+		}
+	}
+
+	quietTime := time.Minute * time.Duration(config.ClientLocalIdleQuietMinutes)
+	if quietTime > 0 && self.workspacePath != "" && recentlyModified(self.workspacePath, time.Now().Add(-quietTime)) {
+		return fmt.Sprintf("files in %v were modified within the last %v", self.workspacePath, quietTime)
+	}
+
+	return ""
+}
+
+// Returns the names of processes that are not ignored.
+func (self *LocalIdleDetector) buildProcesses(config *util.Config, processes []util.ProcessInfo) []string {
+	names := []string{}
+
+	for _, process := range processes {
+		ignored := false
+		for _, pattern := range config.ClientLocalIdleIgnoredProcesses {
+			if matches, _ := filepath.Match(strings.ToLower(pattern), strings.ToLower(process.Name)); matches {
+				ignored = true
+				break
+			}
+		}
+		if !ignored {
+			names = append(names, process.Name)
+		}
+	}
+	return names
+}
+
+// Returns true if a file or directory below root (up to maxWorkspaceScanDepth) was modified after "since".
+// Access times are not considered as reading files (e.g. by backups) does not indicate a running build.
+func recentlyModified(root string, since time.Time) (modified bool) {
+	root, entries := filepath.Clean(root), 0
+
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil // Files may be removed by running builds while walking.
+		}
+
+		if info.ModTime().After(since) {
+			modified = true
+			return errStopWalking
+		}
+
+		if entries++; entries > maxWorkspaceScanEntries {
+			return errStopWalking
+		}
+
+		if info.IsDir() && path != root && strings.Count(path[len(root):], string(filepath.Separator)) >= maxWorkspaceScanDepth {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return
+}
+
+// Registering the detector.
+var _ = RegisterAgentPreparer(func() EnvironmentPreparer { return new(LocalIdleDetector) })
@@ -0,0 +1,48 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+)
+
+func TestRecentlyModifiedDetectsWorkspaceActivity(t *testing.T) {
+	workspace, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workspace)
+
+	file := filepath.Join(workspace, "job", "build.log")
+	os.MkdirAll(filepath.Dir(file), 0755)
+	ioutil.WriteFile(file, []byte("building"), 0644)
+
+	if !recentlyModified(workspace, time.Now().Add(-time.Minute)) {
+		t.Error("recentlyModified(...) = false, want true for a file written now")
+	}
+
+	past := time.Now().Add(-time.Hour)
+	for _, path := range []string{file, filepath.Dir(file), workspace} {
+		os.Chtimes(path, past, past)
+	}
+	if recentlyModified(workspace, time.Now().Add(-time.Minute)) {
+		t.Error("recentlyModified(...) = true, want false for files modified an hour ago")
+	}
+}
+
+func TestIgnoredProcessesDoNotMakeTheNodeBusy(t *testing.T) {
+	config := util.NewDefaultConfig()
+	processes := []util.ProcessInfo{{Pid: 2, Name: "conhost.exe"}, {Pid: 3, Name: "sh"}, {Pid: 4, Name: "ssh-agent"}}
+
+	config.ClientLocalIdleIgnoredProcesses = append(config.ClientLocalIdleIgnoredProcesses, "ssh-*")
+	if names := new(LocalIdleDetector).buildProcesses(config, processes); fmt.Sprint(names) != "[sh]" {
+		t.Errorf("buildProcesses(...) = %v, want [sh]", names)
+	}
+}
@@ -4,15 +4,25 @@
 package environment
 
 import (
+	"context"
 	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"strings"
 	"github.com/mcuadros/go-version"
 )
 
 const (
 	MinJavaVersion = "1.6.0"
+	// Names the directories of the current and previous managed java installation (inside java>install>directory).
+	CurrentJavaDir, PreviousJavaDir = "current", "previous"
+	// Is the name of the file that records the source of a managed java installation.
+	JavaSourceMarkerName = ".jcl-source"
 )
 
 // Defines an interface for implementations that can install java.
@@ -25,16 +35,32 @@ type JavaDownloader struct {
 	util.AnyConfigAcceptor
 }
 
+// Describes a java installation that was found on this machine.
+type javaInstallation struct {
+	// Absolute path to the java executable.
+	Java    string
+	// The version as reported by "java -version".
+	Version string
+	// Describes where the installation was found (e.g. "JAVA_HOME").
+	Source  string
+}
+
 func (self *JavaDownloader) Name() string {
 	return "Java Downloader"
 }
 
-func (self *JavaDownloader) Prepare(config *util.Config) {
-	if !self.javaIsInstalled() {
-		var i interface{}; i = self
+func (self *JavaDownloader) Prepare(ctx context.Context, config *util.Config) {
+	var i interface{}; i = self
 
+	if installer, implemented := i.(JavaInstaller); implemented && config.JavaInstallSource != "" && !self.managedJavaIsUpToDate(config) {
+		if err := installer.InstallJava(config); err != nil {
+			util.GOut("java", "ERROR: Failed installing java from %v. Cause: %v", config.JavaInstallSource, err)
+		}
+	}
+
+	if !self.javaIsInstalled(config) {
 		if installer, implemented := i.(JavaInstaller); implemented {
-			if err := installer.InstallJava(config); err != nil || !self.javaIsInstalled() {
+			if err := installer.InstallJava(config); err != nil || !self.javaIsInstalled(config) {
 				panic(fmt.Sprintf("Java installation failed, cannot continue. Cause: %v", err))
 			}
 		} else {
@@ -43,28 +69,259 @@ func (self *JavaDownloader) Prepare(config *util.Config) {
 	}
 }
 
-// Checks if java is installed and if the java version is greater or equals the required version.
-func (self *JavaDownloader) javaIsInstalled() bool {
+// Searches all known java locations, selects the best installation that matches the configured
+// version requirements and sets it as the java of the agent. Returns false if no matching installation was found.
+func (self *JavaDownloader) javaIsInstalled(config *util.Config) bool {
+	installations := []javaInstallation{}
+
+	for _, candidate := range self.findJavaCandidates(config) {
+		if javaVersion, err := self.readJavaVersion(candidate.Java); err == nil {
+			candidate.Version = javaVersion
+			installations = append(installations, candidate)
+		} else {
+			util.GOut("java", "WARN: Ignoring %v (%v). Cause: %v", candidate.Java, candidate.Source, err)
+		}
+	}
+
+	if selected := self.selectJava(config, installations); selected != nil {
+		config.State().Java = selected.Java
+		util.GOut("java", "Using java version %v from %v (%v).", selected.Version, selected.Java, selected.Source)
+		return true
+	}
+
+	for _, installation := range installations {
+		util.GOut("java", "Found java version %v at %v, which does not match the required version (min: %v, max: %v).",
+			installation.Version, installation.Java, self.minVersion(config), config.JavaMaxVersion)
+	}
+
+	return false
+}
+
+// Returns the java executables found in the configured java home, JAVA_HOME, PATH and common install locations.
+func (self *JavaDownloader) findJavaCandidates(config *util.Config) (candidates []javaInstallation) {
+	known := map[string]bool{}
+	add := func(java, source string) {
+		if info, err := os.Stat(java); err != nil || info.IsDir() {
+			return
+		}
+
+		key := java
+		if resolved, err := filepath.EvalSymlinks(java); err == nil {
+			key = resolved
+		}
+
+		if !known[key] {
+			known[key] = true
+			candidates = append(candidates, javaInstallation{Java: java, Source: source})
+		}
+	}
+
+	if config.JavaHome != "" {
+		add(self.javaExecutable(os.ExpandEnv(config.JavaHome)), "java>home")
+	}
+
+	if config.JavaInstallSource != "" {
+		add(self.javaExecutable(self.managedJavaHome(config, CurrentJavaDir)), "java>install")
+		add(self.javaExecutable(self.managedJavaHome(config, PreviousJavaDir)), "java>install (previous)")
+	}
+
+	if home := os.Getenv("JAVA_HOME"); home != "" {
+		add(self.javaExecutable(home), "JAVA_HOME")
+	}
+
 	if java, err := exec.LookPath("java"); err == nil {
-		// Set absolute path to java
-		util.Java = java
-		// Check the version
-		if output, err := exec.Command(java, "-version").CombinedOutput(); err == nil {
-			if pattern, err := regexp.Compile(`(?i)java version "([^"]+)"`); err == nil {
-				if matches := pattern.FindSubmatch(output); matches != nil && len(matches) == 2 {
-					javaVersion := string(matches[1])
-					if version.Compare(javaVersion, MinJavaVersion, ">=") {
-						util.GOut("java", "Found java version %v, no need to install a newer version.", javaVersion)
-						return true
-					}
-					util.GOut("java", "Found java version %v. A newer version is required to run the Jenkins client.", javaVersion)
+		if absolute, err := filepath.Abs(java); err == nil {
+			java = absolute
+		}
+		add(java, "PATH")
+	}
+
+	for _, pattern := range self.javaSearchPatterns() {
+		if homes, err := filepath.Glob(pattern); err == nil {
+			for _, home := range homes {
+				add(self.javaExecutable(home), "installed")
+			}
+		}
+	}
+
+	return
+}
+
+// Returns the path of the java executable inside the given java home.
+func (self *JavaDownloader) javaExecutable(home string) string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(home, "bin", "java.exe")
+	}
+	return filepath.Join(home, "bin", "java")
+}
+
+// Returns glob patterns of java homes in the common install locations of the current OS.
+func (self *JavaDownloader) javaSearchPatterns() []string {
+	switch runtime.GOOS {
+	case "windows":
+		patterns := []string{}
+		for _, programFiles := range []string{os.Getenv("ProgramFiles"), os.Getenv("ProgramW6432"), os.Getenv("ProgramFiles(x86)")} {
+			if programFiles != "" {
+				for _, vendor := range []string{"Java", "Eclipse Adoptium", "Eclipse Foundation", "AdoptOpenJDK", "Zulu", "Amazon Corretto", "Microsoft"} {
+					patterns = append(patterns, filepath.Join(programFiles, vendor, "*"))
 				}
 			}
 		}
+		return patterns
+	case "darwin":
+		return []string{
+			"/Library/Java/JavaVirtualMachines/*/Contents/Home",
+			filepath.Join(os.Getenv("HOME"), "Library/Java/JavaVirtualMachines/*/Contents/Home"),
+		}
+	default:
+		return []string{"/usr/lib/jvm/*", "/usr/java/*", "/opt/java/*", "/opt/jdk*", "/opt/*/jdk*", "/usr/local/java/*"}
+	}
+}
+
+// Runs "java -version" and returns the reported version.
+func (self *JavaDownloader) readJavaVersion(java string) (string, error) {
+	output, err := exec.Command(java, "-version").CombinedOutput()
+	if err != nil {
+		return "", err
 	}
 
-	return false
+	if javaVersion := parseJavaVersion(string(output)); javaVersion != "" {
+		return javaVersion, nil
+	}
+	return "", fmt.Errorf("Unknown version output: %s", strings.TrimSpace(string(output)))
+}
+
+// Returns the java home inside the managed install directory "name" (current or previous).
+func (self *JavaDownloader) managedJavaHome(config *util.Config, name string) string {
+	directory, _ := filepath.Abs(filepath.Join(config.State().Path(config.JavaInstallDirectory), name))
+	return self.findJavaHome(directory)
+}
+
+// Returns the java home inside an extracted archive. Archives usually contain a single
+// top level directory (e.g. "jdk-17.0.2+8") which is the java home.
+func (self *JavaDownloader) findJavaHome(directory string) string {
+	if _, err := os.Stat(self.javaExecutable(directory)); err == nil {
+		return directory
+	}
+
+	if homes, err := filepath.Glob(filepath.Join(directory, "*")); err == nil {
+		for _, home := range homes {
+			if _, err := os.Stat(self.javaExecutable(home)); err == nil {
+				return home
+			}
+		}
+	}
+	return directory
+}
+
+// Returns true if the current managed java installation was installed from the configured source.
+func (self *JavaDownloader) managedJavaIsUpToDate(config *util.Config) bool {
+	content, err := ioutil.ReadFile(filepath.Join(config.State().Path(config.JavaInstallDirectory), CurrentJavaDir, JavaSourceMarkerName))
+	return err == nil && string(content) == self.javaSourceMarker(config)
+}
+
+func (self *JavaDownloader) javaSourceMarker(config *util.Config) string {
+	return config.JavaInstallSource + "\n" + strings.ToLower(config.JavaInstallSHA256) + "\n"
+}
+
+// Selects the installation to use: "java>home" or "java>install" when it matches the requirements, otherwise
+// the highest matching version, preferring installations of the preferred version.
+func (self *JavaDownloader) selectJava(config *util.Config, installations []javaInstallation) (selected *javaInstallation) {
+	isPreferred := func(installation *javaInstallation) bool {
+		return config.JavaPreferredVersion != "" && javaVersionHasPrefix(installation.Version, config.JavaPreferredVersion)
+	}
+
+	for index := range installations {
+		installation := &installations[index]
+		if !self.isAcceptable(config, installation.Version) {
+			continue
+		}
+
+		if installation.Source == "java>home" {
+			return installation
+		}
+
+		if installation.Source == "java>install" && (selected == nil || selected.Source != "java>install") {
+			selected = installation
+			continue
+		} else if selected != nil && selected.Source == "java>install" {
+			continue
+		}
+
+		if selected == nil || (isPreferred(installation) && !isPreferred(selected)) {
+			selected = installation
+		} else if isPreferred(installation) == isPreferred(selected) &&
+			version.Compare(normalizeJavaVersion(installation.Version), normalizeJavaVersion(selected.Version), ">") {
+			selected = installation
+		}
+	}
+
+	return
+}
+
+// Returns true if the java version matches the configured min and max version.
+// The max version includes all updates of it (e.g. max "11" accepts "11.0.12").
+func (self *JavaDownloader) isAcceptable(config *util.Config, javaVersion string) bool {
+	normalized := normalizeJavaVersion(javaVersion)
+
+	if !version.Compare(normalized, normalizeJavaVersion(self.minVersion(config)), ">=") {
+		return false
+	}
+
+	if config.JavaMaxVersion != "" && !javaVersionHasPrefix(javaVersion, config.JavaMaxVersion) &&
+		!version.Compare(normalized, normalizeJavaVersion(config.JavaMaxVersion), "<=") {
+		return false
+	}
+
+	return true
+}
+
+func (self *JavaDownloader) minVersion(config *util.Config) string {
+	if config.JavaMinVersion != "" {
+		return config.JavaMinVersion
+	}
+	return MinJavaVersion
+}
+
+var javaVersionPattern = regexp.MustCompile(`(?i)(?:java|openjdk|jdk) version "([^"]+)"`)
+
+// Extracts the version from the output of "java -version", e.g. 'java version "1.8.0_292"'
+// or 'openjdk version "17.0.2" 2022-01-18'.
+func parseJavaVersion(output string) string {
+	if matches := javaVersionPattern.FindStringSubmatch(output); len(matches) == 2 {
+		return matches[1]
+	}
+	return ""
+}
+
+// Converts java versions to a comparable format by removing the legacy "1." prefix
+// (1.8.0_292 becomes 8.0.292) and build suffixes.
+func normalizeJavaVersion(javaVersion string) string {
+	javaVersion = strings.SplitN(strings.TrimSpace(javaVersion), "+", 2)[0]
+	javaVersion = strings.Replace(javaVersion, "_", ".", -1)
+
+	if strings.HasPrefix(javaVersion, "1.") && len(javaVersion) > 2 {
+		javaVersion = javaVersion[2:]
+	}
+	return javaVersion
+}
+
+// Returns true if the version starts with all components of the given prefix (e.g. "17" matches "17.0.2").
+func javaVersionHasPrefix(javaVersion, prefix string) bool {
+	versionParts := strings.FieldsFunc(normalizeJavaVersion(javaVersion), func(r rune) bool { return r == '.' || r == '-' })
+	prefixParts := strings.Split(normalizeJavaVersion(prefix), ".")
+
+	if len(prefixParts) > len(versionParts) {
+		return false
+	}
+
+	for index, part := range prefixParts {
+		if part != versionParts[index] {
+			return false
+		}
+	}
+	return true
 }
 
 // Registering the downloader.
-var _ = RegisterPreparer(new(JavaDownloader))
+var _ = RegisterAgentPreparer(func() EnvironmentPreparer { return new(JavaDownloader) })
@@ -0,0 +1,273 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	javaDownloadName = "~download.tar.gz"
+	javaExtractName  = "~extract"
+)
+
+// Implements Java installation for Linux by extracting a JDK or JRE tarball from "java>install>source".
+// The previous installation is kept to allow a rollback when the new one does not work.
+func (self *JavaDownloader) InstallJava(config *util.Config) error {
+	if config.JavaInstallSource == "" {
+		return fmt.Errorf("No java install source configured (java>install>source).")
+	}
+
+	directory, err := filepath.Abs(config.State().Path(config.JavaInstallDirectory))
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+
+	archive := filepath.Join(directory, javaDownloadName)
+	defer os.Remove(archive)
+
+	util.GOut("DOWNLOAD", "Getting %v", config.JavaInstallSource)
+	checksum, err := self.fetchJavaArchive(config.JavaInstallSource, archive)
+	if err != nil {
+		return err
+	}
+
+	if expected := strings.ToLower(strings.TrimSpace(config.JavaInstallSHA256)); expected != "" {
+		if checksum != expected {
+			return fmt.Errorf("Checksum mismatch for %v, expected SHA-256 %v but was %v.", config.JavaInstallSource, expected, checksum)
+		}
+	} else if self.isRemoteSource(config.JavaInstallSource) {
+		return fmt.Errorf("Downloading java requires a SHA-256 checksum (java>install>sha256), the archive's checksum is %v.", checksum)
+	} else {
+		util.GOut("INSTALL", "WARN: No SHA-256 checksum configured, installing %v unverified.", config.JavaInstallSource)
+	}
+
+	extracted := filepath.Join(directory, javaExtractName)
+	os.RemoveAll(extracted)
+	defer os.RemoveAll(extracted)
+
+	util.GOut("INSTALL", "Extracting %v to %v", config.JavaInstallSource, directory)
+	if err = extractTarGz(archive, extracted); err != nil {
+		return fmt.Errorf("Failed extracting %v. Cause: %v", config.JavaInstallSource, err)
+	}
+
+	// Verifying the new installation before replacing the current one.
+	if err = ioutil.WriteFile(filepath.Join(extracted, JavaSourceMarkerName), []byte(self.javaSourceMarker(config)), 0644); err != nil {
+		return err
+	}
+
+	java := self.javaExecutable(self.findJavaHome(extracted))
+	javaVersion, err := self.readJavaVersion(java)
+	if err != nil {
+		return fmt.Errorf("The installed java does not work (%v). Cause: %v", java, err)
+	}
+	if !self.isAcceptable(config, javaVersion) {
+		return fmt.Errorf("The installed java version %v does not match the required version.", javaVersion)
+	}
+
+	current, previous := filepath.Join(directory, CurrentJavaDir), filepath.Join(directory, PreviousJavaDir)
+	if _, err := os.Stat(current); err == nil {
+		if err = os.RemoveAll(previous); err != nil {
+			return err
+		}
+		if err = os.Rename(current, previous); err != nil {
+			return err
+		}
+	}
+
+	if err = os.Rename(extracted, current); err != nil {
+		// Rolling back to the previous installation.
+		os.Rename(previous, current)
+		return err
+	}
+
+	config.State().Java = self.javaExecutable(self.managedJavaHome(config, CurrentJavaDir))
+	util.GOut("INSTALL", "Installed java version %v at %v", javaVersion, config.State().Java)
+	return nil
+}
+
+// Returns true if the source must be downloaded.
+func (self *JavaDownloader) isRemoteSource(source string) bool {
+	source = strings.ToLower(source)
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// Copies the archive from the source URL or path to "target" and returns its SHA-256 checksum (hex).
+func (self *JavaDownloader) fetchJavaArchive(source, target string) (string, error) {
+	var input io.ReadCloser
+
+	if self.isRemoteSource(source) {
+		response, err := http.Get(source)
+		if err != nil {
+			return "", fmt.Errorf("Failed downloading %v. Cause: %v", source, err)
+		}
+		if response.StatusCode != 200 {
+			response.Body.Close()
+			return "", fmt.Errorf("Failed downloading %v. Cause: HTTP-%v %v", source, response.StatusCode, response.Status)
+		}
+		input = response.Body
+	} else {
+		file, err := os.Open(strings.TrimPrefix(source, "file://"))
+		if err != nil {
+			return "", err
+		}
+		input = file
+	}
+	defer input.Close()
+
+	output, err := os.Create(target)
+	if err != nil {
+		return "", err
+	}
+	defer output.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(output, hash), input); err != nil {
+		return "", fmt.Errorf("Failed transferring %v. Cause: %v", source, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Extracts the ".tar.gz" archive into the target directory.
+// Links are created after all files were extracted (so that nothing is written through a link) and must
+// not point outside of the target directory.
+func extractTarGz(archive, target string) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	uncompressed, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+
+	target = filepath.Clean(target)
+	links := []*tar.Header{}
+
+	reader := tar.NewReader(uncompressed)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		path := filepath.Join(target, header.Name)
+		if !isInsideDirectory(target, path) {
+			return fmt.Errorf("Archive entry %v points outside of the target directory.", header.Name)
+		}
+		if err = checkNoSymlinkParents(target, path); err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, os.FileMode(header.Mode) | 0700)
+		case tar.TypeSymlink, tar.TypeLink:
+			links = append(links, header)
+		case tar.TypeReg, tar.TypeRegA:
+			if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+				err = writeFile(path, reader, os.FileMode(header.Mode))
+			}
+		default:
+			return fmt.Errorf("Archive entry %v has the unsupported type %v.", header.Name, string(header.Typeflag))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// Hard links reference files of the archive, symbolic links are created last.
+	for _, typeflag := range []byte{tar.TypeLink, tar.TypeSymlink} {
+		for _, header := range links {
+			if header.Typeflag != typeflag {
+				continue
+			}
+			if err := extractLink(target, header); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Creates the hard or symbolic link of the archive entry when it points to a location inside the target directory.
+func extractLink(target string, header *tar.Header) (err error) {
+	path := filepath.Join(target, header.Name)
+
+	if header.Typeflag == tar.TypeLink {
+		source := filepath.Join(target, header.Linkname)
+		if !isInsideDirectory(target, source) {
+			return fmt.Errorf("Archive entry %v links to %v outside of the target directory.", header.Name, header.Linkname)
+		}
+		if err = checkNoSymlinkParents(target, source); err != nil {
+			return err
+		}
+		if info, err := os.Lstat(source); err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("Archive entry %v links to %v which is not a regular file of the archive.", header.Name, header.Linkname)
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+			err = os.Link(source, path)
+		}
+		return
+	}
+
+	if filepath.IsAbs(header.Linkname) {
+		return fmt.Errorf("Archive entry %v links to absolute path %v.", header.Name, header.Linkname)
+	}
+	if !isInsideDirectory(target, filepath.Join(filepath.Dir(path), header.Linkname)) {
+		return fmt.Errorf("Archive entry %v links to %v outside of the target directory.", header.Name, header.Linkname)
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+		err = os.Symlink(header.Linkname, path)
+	}
+	return
+}
+
+// Returns true if the (clean) path is the directory or inside of it.
+func isInsideDirectory(directory, path string) bool {
+	return path == directory || strings.HasPrefix(path, directory + string(os.PathSeparator))
+}
+
+// Returns an error if any existing parent of path (below target) is a symbolic link.
+func checkNoSymlinkParents(target, path string) error {
+	for parent := filepath.Dir(path); isInsideDirectory(target, parent) && parent != target; parent = filepath.Dir(parent) {
+		if info, err := os.Lstat(parent); err == nil && info.Mode() & os.ModeSymlink != 0 {
+			return fmt.Errorf("Cannot extract %v as its parent %v is a symbolic link.", path, parent)
+		}
+	}
+	return nil
+}
+
+func writeFile(path string, content io.Reader, mode os.FileMode) error {
+	output, err := os.OpenFile(path, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, mode & os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(output, content); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
@@ -0,0 +1,155 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Creates a tarball containing a fake java executable that reports the given version.
+func createJavaArchive(t *testing.T, path, javaVersion string) string {
+	script := "#!/bin/sh\necho 'openjdk version \"" + javaVersion + "\" 2022-01-18' >&2\n"
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	compressed := gzip.NewWriter(file)
+	archive := tar.NewWriter(compressed)
+	archive.WriteHeader(&tar.Header{Name: "jdk-" + javaVersion + "/", Typeflag: tar.TypeDir, Mode: 0755})
+	archive.WriteHeader(&tar.Header{Name: "jdk-" + javaVersion + "/bin/java", Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(script))})
+	archive.Write([]byte(script))
+	archive.Close()
+	compressed.Close()
+	file.Close()
+
+	content, _ := ioutil.ReadFile(path)
+	checksum := sha256.Sum256(content)
+	return hex.EncodeToString(checksum[:])
+}
+
+func TestCanInstallJavaFromArchive(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "java")
+	defer os.RemoveAll(dir)
+
+	downloader, config := new(JavaDownloader), &util.Config{}
+	config.JavaInstallDirectory = filepath.Join(dir, "java")
+
+	for _, javaVersion := range []string{"11.0.12", "17.0.2"} {
+		config.JavaInstallSource = filepath.Join(dir, "jdk-" + javaVersion + ".tar.gz")
+		config.JavaInstallSHA256 = createJavaArchive(t, config.JavaInstallSource, javaVersion)
+
+		if err := downloader.InstallJava(config); err != nil {
+			t.Fatalf("downloader.InstallJava(config) failed for %v: %v", javaVersion, err)
+		}
+
+		if !strings.HasSuffix(config.State().Java, filepath.Join("current", "jdk-" + javaVersion, "bin", "java")) {
+			t.Errorf("config.State().Java = %v, want .../current/jdk-%v/bin/java", config.State().Java, javaVersion)
+		}
+
+		if !downloader.managedJavaIsUpToDate(config) {
+			t.Errorf("downloader.managedJavaIsUpToDate(config) = false after installing %v", javaVersion)
+		}
+	}
+
+	if previous := downloader.managedJavaHome(config, PreviousJavaDir); filepath.Base(previous) != "jdk-11.0.12" {
+		t.Errorf("Previous java home is %v, want .../jdk-11.0.12", previous)
+	}
+
+	config.JavaInstallSHA256 = strings.Repeat("0", 64)
+	if err := downloader.InstallJava(config); err == nil || !strings.Contains(err.Error(), "Checksum mismatch") {
+		t.Errorf("downloader.InstallJava(config) = %v, want checksum mismatch", err)
+	}
+
+	if current := downloader.managedJavaHome(config, CurrentJavaDir); filepath.Base(current) != "jdk-17.0.2" {
+		t.Errorf("Current java home is %v after a failed install, want .../jdk-17.0.2", current)
+	}
+}
+
+// Creates a tarball with the specified entries (regular files are filled with zeros).
+func createArchive(t *testing.T, path string, entries []tar.Header) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	compressed := gzip.NewWriter(file)
+	archive := tar.NewWriter(compressed)
+	for _, entry := range entries {
+		header := entry
+		if header.Mode == 0 { header.Mode = 0644 }
+		archive.WriteHeader(&header)
+		if header.Typeflag == tar.TypeReg {
+			archive.Write(make([]byte, header.Size))
+		}
+	}
+	archive.Close()
+	compressed.Close()
+}
+
+func TestArchiveLinksMustNotEscapeTheTarget(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "java")
+	defer os.RemoveAll(dir)
+	archive, target := filepath.Join(dir, "evil.tar.gz"), filepath.Join(dir, "a", "b", "target")
+
+	tests := map[string][]tar.Header{
+		"relative symlink": {
+			{Name: "jdk/x", Typeflag: tar.TypeSymlink, Linkname: "../../../.."},
+			{Name: "jdk/x/escaped", Typeflag: tar.TypeReg, Size: 4},
+		},
+		"symlink written through": {
+			{Name: "jdk/x", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "jdk/x/../../../escaped", Typeflag: tar.TypeReg, Size: 4},
+		},
+		"hard link": {
+			{Name: "jdk/passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"},
+		},
+	}
+
+	for name, entries := range tests {
+		os.RemoveAll(filepath.Join(dir, "a"))
+		os.MkdirAll(target, 0755)
+		createArchive(t, archive, entries)
+
+		if err := extractTarGz(archive, target); err == nil {
+			t.Errorf("extractTarGz(%v) did not fail.", name)
+		}
+		if matches, _ := filepath.Glob(filepath.Join(dir, "*", "escaped")); len(matches) > 0 {
+			t.Errorf("extractTarGz(%v) wrote %v", name, matches)
+		}
+	}
+}
+
+func TestArchiveLinksInsideTheTargetAreExtracted(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "java")
+	defer os.RemoveAll(dir)
+	archive, target := filepath.Join(dir, "jdk.tar.gz"), filepath.Join(dir, "target")
+
+	createArchive(t, archive, []tar.Header{
+		{Name: "jdk/bin/java", Typeflag: tar.TypeReg, Size: 4, Mode: 0755},
+		{Name: "jdk/java", Typeflag: tar.TypeSymlink, Linkname: "bin/java"},
+		{Name: "jdk/bin/java-copy", Typeflag: tar.TypeLink, Linkname: "jdk/bin/java"},
+	})
+
+	if err := extractTarGz(archive, target); err != nil {
+		t.Fatalf("extractTarGz(...) failed: %v", err)
+	}
+	for _, path := range []string{"jdk/java", "jdk/bin/java-copy"} {
+		if info, err := os.Stat(filepath.Join(target, path)); err != nil || info.Size() != 4 {
+			t.Errorf("os.Stat(%v) = %v, %v; want a 4 byte file", path, info, err)
+		}
+	}
+}
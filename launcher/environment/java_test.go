@@ -0,0 +1,77 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+	"testing"
+)
+
+func TestCanParseJavaVersions(t *testing.T) {
+	tests := map[string]string{
+		"java version \"1.8.0_292\"\nJava(TM) SE Runtime Environment (build 1.8.0_292-b10)": "1.8.0_292",
+		"openjdk version \"17.0.2\" 2022-01-18\nOpenJDK Runtime Environment (build 17.0.2+8-86)": "17.0.2",
+		"openjdk version \"21\" 2023-09-19": "21",
+		"Picked up JAVA_TOOL_OPTIONS: -Dx=y\nopenjdk version \"11.0.12\" 2021-07-20 LTS": "11.0.12",
+		"Error: could not find libjava.so": "",
+	}
+
+	for output, out := range tests {
+		if in := parseJavaVersion(output); in != out {
+			t.Errorf("parseJavaVersion(%q) = %v, want %v", output, in, out)
+		}
+	}
+}
+
+func TestJavaVersionRequirementsAreApplied(t *testing.T) {
+	downloader, config := new(JavaDownloader), &util.Config{}
+	config.JavaMinVersion, config.JavaMaxVersion = "1.8", "17"
+
+	tests := map[string]bool{
+		"1.7.0_80": false,
+		"1.8.0_292": true,
+		"11.0.12": true,
+		"17": true,
+		"17.0.2": true,
+		"21": false,
+	}
+
+	for javaVersion, out := range tests {
+		if in := downloader.isAcceptable(config, javaVersion); in != out {
+			t.Errorf("downloader.isAcceptable(config, %v) = %v, want %v", javaVersion, in, out)
+		}
+	}
+}
+
+func TestBestJavaInstallationIsSelected(t *testing.T) {
+	downloader, config := new(JavaDownloader), &util.Config{}
+	installations := []javaInstallation{
+		{Java: "/usr/bin/java", Version: "1.8.0_292", Source: "PATH"},
+		{Java: "/usr/lib/jvm/jdk-11/bin/java", Version: "11.0.12", Source: "installed"},
+		{Java: "/usr/lib/jvm/jdk-17/bin/java", Version: "17.0.2", Source: "installed"},
+	}
+
+	tests := []struct {
+		preferred, max, home string
+		out                  string
+	}{
+		{"", "", "", "/usr/lib/jvm/jdk-17/bin/java"},
+		{"11", "", "", "/usr/lib/jvm/jdk-11/bin/java"},
+		{"1.8", "", "", "/usr/bin/java"},
+		{"", "11", "", "/usr/lib/jvm/jdk-11/bin/java"},
+		{"", "", "/usr/bin/java", "/usr/bin/java"},
+	}
+
+	for _, test := range tests {
+		config.JavaPreferredVersion, config.JavaMaxVersion = test.preferred, test.max
+		candidates := append([]javaInstallation{}, installations...)
+		for index := range candidates {
+			if candidates[index].Java == test.home { candidates[index].Source = "java>home" }
+		}
+
+		if in := downloader.selectJava(config, candidates); in == nil || in.Java != test.out {
+			t.Errorf("downloader.selectJava(preferred: %v, max: %v, home: %v) = %v, want %v", test.preferred, test.max, test.home, in, test.out)
+		}
+	}
+}
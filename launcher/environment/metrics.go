@@ -0,0 +1,109 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/modes"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+)
+
+// Collects the metrics of an agent and serves the metrics of all agents via HTTP (started with the main config).
+type MetricsExporter struct {
+	mutex     sync.Mutex
+	startedAt time.Time
+}
+
+func (self *MetricsExporter) Name() string {
+	return "Metrics Exporter"
+}
+
+func (self *MetricsExporter) IsConfigAcceptable(config *util.Config) (bool) {
+	if config.MetricsEnabled && config.MetricsAddress == "" {
+		util.GOut("metrics", "WARN: Metrics are enabled but the address to listen on is empty.")
+		return false
+	}
+	return true
+}
+
+func (self *MetricsExporter) Prepare(ctx context.Context, config *util.Config) {
+	if !config.MetricsEnabled {
+		return
+	}
+
+	self.collect(ctx, config)
+
+	if config.State().Name == "" {
+		go self.serve(ctx, config)
+	}
+}
+
+// Registers the listener and collector that keep the metrics of the agent up-to-date until the context is done.
+func (self *MetricsExporter) collect(ctx context.Context, config *util.Config) {
+	modes.RegisterModeListenerFor(config, func(mode modes.ExecutableMode, nextStatus int32, config *util.Config, reason *modes.StopReason) {
+		self.mutex.Lock(); defer self.mutex.Unlock()
+
+		if nextStatus == modes.ModeStarted {
+			self.startedAt = time.Now()
+		} else if nextStatus == modes.ModeStopped {
+			self.startedAt = time.Time{}
+			if reason != nil {
+				util.CountMetric(util.MetricClientRestarts, "node", config.ClientName, "reason", reason.Cause)
+			}
+		}
+	})
+
+	util.RegisterMetricsCollector(func() {
+		if ctx.Err() != nil {
+			return // The config was reloaded or the launcher is stopping.
+		}
+
+		node, mode := config.ClientName, modes.GetConfiguredMode(config)
+		status := mode.Status().Get()
+		for s := int32(modes.ModeNone); s <= modes.ModeConnected; s++ {
+			value := 0.0
+			if s == status { value = 1 }
+			util.SetMetric(util.MetricModeStatus, value, "node", node, "mode", mode.Name(), "status", modes.StatusName(s))
+		}
+
+		self.mutex.Lock()
+		uptime := 0.0
+		if !self.startedAt.IsZero() { uptime = time.Since(self.startedAt).Seconds() }
+		self.mutex.Unlock()
+		util.SetMetric(util.MetricClientUptime, uptime, "node", node)
+
+		if client, ok := mode.(*modes.ClientMode); ok && client.Pid() > 0 {
+			if memory, cpu, err := util.ProcessStats(client.Pid()); err == nil {
+				util.SetMetric(util.MetricClientMemory, float64(memory), "node", node)
+				util.SetMetric(util.MetricClientCPU, cpu, "node", node)
+			}
+		}
+	})
+}
+
+// Serves the metrics until the context is done.
+func (self *MetricsExporter) serve(ctx context.Context, config *util.Config) {
+	handler := http.NewServeMux()
+	handler.HandleFunc(config.MetricsPath, func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		util.WriteMetrics(writer)
+	})
+
+	server := &http.Server{Addr: config.MetricsAddress, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	util.GOut("metrics", "Serving metrics on http://%v%v", config.MetricsAddress, config.MetricsPath)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		util.GOut("metrics", "ERROR: Failed serving metrics on %v. Cause: %v", config.MetricsAddress, err)
+	}
+}
+
+// Registering the exporter.
+var _ = RegisterAgentPreparer(func() EnvironmentPreparer { return new(MetricsExporter) })
@@ -4,10 +4,12 @@
 package environment
 
 import (
+	"context"
 	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
 	"github.com/jkellerer/jenkins-client-launcher/launcher/modes"
 	"fmt"
 	"encoding/xml"
+	"strings"
 	"time"
 )
 
@@ -18,14 +20,31 @@ const (
 // The interval when the jenkins node is monitored.
 var nodeMonitoringInterval = time.Second * 15
 
-// The max number of offline results in a row until a reconnect is forced.
-var maxOfflineCountBeforeRestart = int16(4)
-
 type JenkinsNodeStatus struct {
 	DisplayName          string `xml:"displayName"`
 	Idle                 bool `xml:"idle"`
 	Offline              bool `xml:"offline"`
 	TemporarilyOffline   bool `xml:"temporarilyOffline"`
+	OfflineCauseReason   string `xml:"offlineCauseReason"`
+	OfflineCause         struct {
+		Class string `xml:"_class,attr"`
+	} `xml:"offlineCause"`
+}
+
+// Returns true if a user or administrator marked the node temporarily offline in Jenkins
+// (as opposed to the launcher or a disconnected client).
+func (self *JenkinsNodeStatus) IsHeldOfflineByUser() bool {
+	return self.TemporarilyOffline && !util.IsLauncherOfflineMessage(self.OfflineCauseReason)
+}
+
+// Returns a description of why the node is offline (e.g. the message given when it was marked offline).
+func (self *JenkinsNodeStatus) OfflineReason() string {
+	if self.OfflineCauseReason != "" {
+		return self.OfflineCauseReason
+	} else if class := self.OfflineCause.Class; class != "" {
+		return class[strings.LastIndexAny(class, ".$") + 1:]
+	}
+	return "no reason given"
 }
 
 // Returns the current offline and idle status of this Jenkins node from the Jenkins server.
@@ -46,9 +65,10 @@ func GetJenkinsNodeStatus(config *util.Config) (*JenkinsNodeStatus, error) {
 
 // Implements a monitor that issues a rest call on jenkins to see whether the node is online within jenkins.
 type JenkinsNodeMonitor struct {
-	ticker *time.Ticker
-	onlineShown  bool
-	offlineCount int16
+	onlineShown      bool
+	offlineNotified  bool
+	offlineCount     int16
+	heldOfflineShown string
 }
 
 func (self *JenkinsNodeMonitor) IsConfigAcceptable(config *util.Config) (bool) {
@@ -63,47 +83,57 @@ func (self *JenkinsNodeMonitor) Name() string {
 	return "Jenkins Node Monitor"
 }
 
-func (self *JenkinsNodeMonitor) Prepare(config *util.Config) {
-	if self.ticker != nil {
-		self.ticker.Stop()
-	}
-
+func (self *JenkinsNodeMonitor) Prepare(ctx context.Context, config *util.Config) {
 	if config.ClientMonitorStateOnServer {
-		maxOfflineCountBeforeRestart = config.ClientMonitorStateOnServerMaxFailures
-
-		self.ticker = time.NewTicker(nodeMonitoringInterval)
-
-		go func() {
-			// Run in schedule
-			for _ = range self.ticker.C {
-				self.monitor(config)
-			}
-		}()
-	} else {
-		// Setting IDLE to always true if active monitoring is disabled.
-		util.NodeIsIdle.Set(true)
+		// Run in schedule
+		go util.Every(ctx, nodeMonitoringInterval, func() {
+			self.monitor(config)
+		})
+	} else if !config.ClientLocalIdleDetection {
+		// Setting IDLE to always true if neither active monitoring nor local IDLE detection is enabled.
+		config.State().NodeIsIdle.Set(true)
 	}
 }
 
 // Checks if both, this side and the remote side show the node as connected and increments a offline count if not.
 // Forces a restart of the connector when offline count reaches the threshold.
 func (self *JenkinsNodeMonitor) monitor(config *util.Config) {
+	self.markConnectedIfOnlineInJenkins(config)
+
 	if self.isThisSideConnected(config) {
-		if connected, idle, serverReachable := self.isServerSideConnected(config); connected {
-			util.NodeIsIdle.Set(idle)
-			self.offlineCount = 0
+		status, serverReachable := self.serverSideStatus(config)
+
+		if serverReachable && status.TemporarilyOffline {
+			// The node is marked offline on purpose (e.g. by an administrator, or by the launcher while draining
+			// or while the host is unhealthy) and must not be reconnected. The IDLE state is still tracked.
+			config.State().NodeIsIdle.Set(status.Idle)
+			self.offlineCount, self.offlineNotified = 0, false
+			self.heldOffline(config, status)
+		} else if serverReachable && !status.Offline {
+			config.State().NodeIsIdle.Set(status.Idle)
+			self.offlineCount, self.offlineNotified = 0, false
+			self.heldOffline(config, nil)
 
 			if !self.onlineShown {
 				util.GOut("monitor", "Node is online in Jenkins.")
 				self.onlineShown = true
 			}
 		} else {
-			util.NodeIsIdle.Set(true)
+			config.State().NodeIsIdle.Set(true)
+			util.CountMetric(util.MetricMonitorFailures, "node", config.ClientName)
 
 			if serverReachable {
 				self.offlineCount++
+
+				if !self.offlineNotified {
+					util.Notify(config, util.EventOffline, "Node is offline in Jenkins while the client is running.", nil)
+					self.offlineNotified = true
+				}
 			}
 
+			// The max number of offline results in a row until a reconnect is forced.
+			maxOfflineCountBeforeRestart := config.ClientMonitorStateOnServerMaxFailures
+
 			if self.offlineCount > 3 * maxOfflineCountBeforeRestart {
 				self.offlineCount = maxOfflineCountBeforeRestart
 			}
@@ -116,7 +146,7 @@ func (self *JenkinsNodeMonitor) monitor(config *util.Config) {
 			self.onlineShown = false
 		}
 	} else {
-		util.NodeIsIdle.Set(true)
+		config.State().NodeIsIdle.Set(true)
 		self.offlineCount = 0
 
 		if self.onlineShown {
@@ -126,19 +156,55 @@ func (self *JenkinsNodeMonitor) monitor(config *util.Config) {
 	}
 }
 
-// Checks if the run mode is in started state.
-// Also updates the global "util.NodeIsIdle" state to true if run mode is not in started state.
+// Logs changes of the temporary offline state (status is nil when the node is online) and tracks
+// whether a user holds the node offline.
+func (self *JenkinsNodeMonitor) heldOffline(config *util.Config, status *JenkinsNodeStatus) {
+	byUser, reason := false, ""
+	if status != nil {
+		byUser, reason = status.IsHeldOfflineByUser(), status.OfflineReason()
+	}
+
+	if reason != self.heldOfflineShown {
+		if !byUser && reason != "" {
+			util.GOut("monitor", "Node is marked temporarily offline in Jenkins by the launcher: %v", reason)
+		} else if byUser {
+			paused := ""
+			if config.PauseWhileHeldOffline { paused = " Scheduled maintenance is paused." }
+			util.GOut("monitor", "WARN: Node is held temporarily offline in Jenkins: %v. Not reconnecting.%v", reason, paused)
+		} else {
+			util.GOut("monitor", "Node is no longer temporarily offline in Jenkins.")
+		}
+		self.heldOfflineShown = reason
+	}
+
+	config.State().HeldOffline.Set(byUser)
+}
+
+// Checks if the run mode is in started (or connected) state.
 func (self *JenkinsNodeMonitor) isThisSideConnected(config *util.Config) bool {
-	return modes.GetConfiguredMode(config).Status().Get() == modes.ModeStarted
+	return modes.IsConnected(modes.GetConfiguredMode(config).Status().Get())
+}
+
+// Marks a connecting run mode as connected when Jenkins shows the node online already
+// (covers clients whose console output does not reveal the connection state).
+func (self *JenkinsNodeMonitor) markConnectedIfOnlineInJenkins(config *util.Config) {
+	mode := modes.GetConfiguredMode(config)
+	if mode.Status().Get() != modes.ModeConnecting {
+		return
+	}
+
+	if status, err := GetJenkinsNodeStatus(config); err == nil && !status.Offline && modes.MarkConnected(mode) {
+		util.GOut("monitor", "Node is connected according to Jenkins.")
+	}
 }
 
-// Checks if Jenkins shows this node as connected and returns the node's IDLE state as second return value.
-func (self *JenkinsNodeMonitor) isServerSideConnected(config *util.Config) (connected bool, idle bool, serverReachable bool) {
+// Returns the status of this node in Jenkins, serverReachable is false (and status is nil) if Jenkins cannot be reached.
+func (self *JenkinsNodeMonitor) serverSideStatus(config *util.Config) (status *JenkinsNodeStatus, serverReachable bool) {
 	if status, err := GetJenkinsNodeStatus(config); err == nil {
-		return !status.Offline, status.Idle, true
+		return status, true
 	} else {
 		util.GOut("monitor", "ERROR: Failed to monitor node %v using %v. Cause: %v", config.ClientName, config.CIHostURI, err)
-		return false, true, false
+		return nil, false
 	}
 }
 
@@ -146,9 +212,9 @@ func (self *JenkinsNodeMonitor) isServerSideConnected(config *util.Config) (conn
 func (self *JenkinsNodeMonitor) forceReconnect(config *util.Config) {
 	if self.isThisSideConnected(config) {
 		util.GOut("monitor", "WARN: This node appears dead in Jenkins, forcing a reconnect.")
-		modes.GetConfiguredMode(config).Stop()
+		modes.StopConfiguredModeWithDiagnostics(config, util.RestartReasonMonitorOffline)
 	}
 }
 
 // Registering the monitor.
-var _ = RegisterPreparer(new(JenkinsNodeMonitor))
+var _ = RegisterAgentPreparer(func() EnvironmentPreparer { return new(JenkinsNodeMonitor) })
@@ -0,0 +1,40 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"testing"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+)
+
+func TestNodeStatusDistinguishesUserFromLauncherOffline(t *testing.T) {
+	node := &fakeJenkinsNode{offline: true, offlineMessage: "Replacing disks"}
+	config, closeServer := newDrainTestConfig(t, node)
+	defer closeServer()
+
+	status, err := GetJenkinsNodeStatus(config)
+	if err != nil || !status.IsHeldOfflineByUser() || status.OfflineReason() != "Replacing disks" {
+		t.Fatalf("GetJenkinsNodeStatus(...) = %+v, %v; want held offline by user", status, err)
+	}
+
+	node.offlineMessage = util.OfflineMessagePrefix + "Host is unhealthy"
+	if status, err = GetJenkinsNodeStatus(config); err != nil || status.IsHeldOfflineByUser() {
+		t.Errorf("GetJenkinsNodeStatus(...) = %+v, %v; want offline by the launcher", status, err)
+	}
+}
+
+func TestMaintenanceIsPausedWhileHeldOffline(t *testing.T) {
+	config, monitor := util.NewDefaultConfig(), new(JenkinsNodeMonitor)
+	config.PauseWhileHeldOffline = true
+
+	monitor.heldOffline(config, &JenkinsNodeStatus{Offline: true, TemporarilyOffline: true, OfflineCauseReason: "Maintenance"})
+	if !config.State().HeldOffline.Get() || !skipMaintenance(config, "test", "test task") {
+		t.Error("Maintenance is not paused while the node is held offline.")
+	}
+
+	monitor.heldOffline(config, nil)
+	if config.State().HeldOffline.Get() || skipMaintenance(config, "test", "test task") {
+		t.Error("Maintenance is paused after the node is online again.")
+	}
+}
@@ -4,9 +4,10 @@
 package environment
 
 import (
+	"context"
 	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
 	"encoding/xml"
-	"os"
+	"path/filepath"
 	"strings"
 	"fmt"
 	"net/url"
@@ -51,7 +52,7 @@ func (self *NodeNameHandler) Name() string {
 	return "Node Name Normalizer"
 }
 
-func (self *NodeNameHandler) Prepare(config *util.Config) {
+func (self *NodeNameHandler) Prepare(ctx context.Context, config *util.Config) {
 	if !config.HasCIConnection() {
 		return
 	}
@@ -125,7 +126,7 @@ func (self *NodeNameHandler) createNode(config *util.Config) error {
 		}
 	}
 
-	cwd, _ := os.Getwd()
+	cwd, _ := filepath.Abs(config.State().Path("."))
 	mode := "EXCLUSIVE"                                    // NORMAL or EXCLUSIVE (tied jobs only)
 	retention := "hudson.slaves.RetentionStrategy$Always"  // Always on
 
@@ -158,5 +159,5 @@ func (self *NodeNameHandler) createNode(config *util.Config) error {
 }
 
 // Registering the handler.
-var _ = RegisterPreparer(new(NodeNameHandler))
+var _ = RegisterAgentPreparer(func() EnvironmentPreparer { return new(NodeNameHandler) })
 
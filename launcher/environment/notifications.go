@@ -0,0 +1,75 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package environment
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/modes"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+)
+
+// Posts start and stop events of the run mode to the configured webhooks.
+// Other events are posted by the components that detect them.
+type Notifier struct {
+}
+
+func (self *Notifier) Name() string {
+	return "Notifier"
+}
+
+func (self *Notifier) IsConfigAcceptable(config *util.Config) (bool) {
+	for index, webhook := range config.Webhooks {
+		name := util.WebhookName(index)
+		if target, err := url.Parse(webhook.URL); err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+			util.GOut("notify", "WARN: Invalid URL of %v, expected an http(s) URL.", name)
+			return false
+		}
+		if _, err := webhook.ParseTemplate(name); err != nil {
+			util.GOut("notify", "WARN: Invalid template of %v (%v). Cause: %v", name, webhook.RedactedURL(), err)
+			return false
+		}
+		for _, event := range strings.Split(webhook.Events, ",") {
+			if event = strings.TrimSpace(event); event != "" && !self.isKnownEvent(event) {
+				util.GOut("notify", "WARN: Unknown event '%v' in %v (%v), supported are %v.", event, name, webhook.RedactedURL(), util.AllEvents)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (self *Notifier) isKnownEvent(name string) bool {
+	for _, event := range util.AllEvents {
+		if strings.EqualFold(event, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Notifier) Prepare(ctx context.Context, config *util.Config) {
+	if len(config.Webhooks) == 0 {
+		return
+	}
+
+	modes.RegisterModeListenerFor(config, func(mode modes.ExecutableMode, nextStatus int32, config *util.Config, reason *modes.StopReason) {
+		if nextStatus == modes.ModeStarted {
+			util.Notify(config, util.EventStarted, "Started the " + mode.Name() + " mode.", map[string]interface{}{"mode": mode.Name()})
+		} else if nextStatus == modes.ModeStopped {
+			details := map[string]interface{}{"mode": mode.Name()}
+			message := "Stopped the " + mode.Name() + " mode."
+			if reason != nil {
+				details["cause"], details["exitCode"], details["signal"] = reason.Cause, reason.ExitCode, reason.Signal
+				if len(reason.Diagnostics) > 0 { details["diagnostics"] = reason.Diagnostics }
+				message = "Stopped the " + mode.Name() + " mode (" + reason.String() + ")."
+			}
+			util.Notify(config, util.EventStopped, message, details)
+		}
+	})
+}
+
+// Registering the notifier.
+var _ = RegisterAgentPreparer(func() EnvironmentPreparer { return new(Notifier) })
@@ -4,6 +4,7 @@
 package environment
 
 import (
+	"context"
 	"time"
 	"sync"
 	"fmt"
@@ -17,8 +18,9 @@ import (
 type OutOfMemoryErrorRestarter struct {
 	util.AnyConfigAcceptor
 	once *sync.Once
-	ticker *time.Ticker
 	outOfMemoryErrorMarker string
+	heapDumpDirectory string
+	heapDumpMutex sync.Mutex
 }
 
 func NewOutOfMemoryErrorRestarter() *OutOfMemoryErrorRestarter {
@@ -31,48 +33,43 @@ func (self *OutOfMemoryErrorRestarter) Name() string {
 	return "OOM-Error Client Restarter"
 }
 
-func (self *OutOfMemoryErrorRestarter) Prepare(config *util.Config) {
+func (self *OutOfMemoryErrorRestarter) Prepare(ctx context.Context, config *util.Config) {
 	if !config.OutOfMemoryRestartEnabled {
 		return
 	}
 
 	// Make sure this code runs only once.
 	self.once.Do(func() {
-		cwd, _ := os.Getwd()
+		cwd, _ := filepath.Abs(config.State().Path("."))
 		self.outOfMemoryErrorMarker = filepath.Join(cwd, ".oom-restart")
 
-		util.JavaArgs = append(util.JavaArgs, fmt.Sprintf("-XX:OnOutOfMemoryError=%s", self.createOOMErrorTriggerCommand()))
+		config.State().JavaArgs = append(config.State().JavaArgs, fmt.Sprintf("-XX:OnOutOfMemoryError=%s", self.createOOMErrorTriggerCommand()))
+
+		if config.HeapDumpOnOutOfMemoryEnabled {
+			if err := self.prepareHeapDumps(cwd, config); err != nil {
+				util.GOut("OOM", "ERROR: Heap dumps are disabled as the dump directory cannot be created. Cause: %v", err)
+			}
+		}
 
 		// Clearing OOM state when mode status is changing.
-		modes.RegisterModeListener(func(mode modes.ExecutableMode, nextStatus int32, config *util.Config) {
+		modes.RegisterModeListenerFor(config, func(mode modes.ExecutableMode, nextStatus int32, config *util.Config, reason *modes.StopReason) {
 			self.oomErrorTriggered()
-		})
 
-		self.ticker = time.NewTicker(time.Second*5)
+			if nextStatus == modes.ModeStopped && reason != nil && self.heapDumpDirectory != "" {
+				reason.Diagnostics = append(reason.Diagnostics, self.collectHeapDumps(config)...)
+			}
+		})
 
-		go func() {
-			// Run in schedule
-			for _ = range self.ticker.C {
-				if self.oomErrorTriggered() {
-					util.GOut("OOM", "WARN: A client restart is now triggered as consequence to an OutOfMemory error inside the JVM.")
-					self.waitForIdleIfRequired(config)
-					// Stopping the mode as this will automatically do a restart.
-					modes.GetConfiguredMode(config).Stop()
-				}
+		// Run in schedule
+		go util.Every(ctx, time.Second*5, func() {
+			if self.oomErrorTriggered() {
+				util.GOut("OOM", "WARN: A client restart is now triggered as consequence to an OutOfMemory error inside the JVM.")
+				restartPlanned(ctx, config, "OOM", util.RestartReasonOutOfMemory, config.OutOfMemoryRestartOnlyWhenIDLE)
 			}
-		}()
+		})
 	})
 }
 
-func (self *OutOfMemoryErrorRestarter) waitForIdleIfRequired(config *util.Config) {
-	if config.OutOfMemoryRestartOnlyWhenIDLE {
-		for !util.NodeIsIdle.Get() {
-			util.GOut("OOM", "Waiting for node to become IDLE before triggering a restart.")
-			time.Sleep(time.Minute * 5)
-		}
-	}
-}
-
 // Returns true if a OOM error triggered a restart and resets the error state to false.
 // Executing this method multiple times when OOM error was triggered returns true first and false
 // with every subsequent call until the error is triggered again.
@@ -85,4 +82,4 @@ func (self *OutOfMemoryErrorRestarter) oomErrorTriggered() bool {
 }
 
 // Registering the restarter.
-var _ = RegisterPreparer(NewOutOfMemoryErrorRestarter())
+var _ = RegisterAgentPreparer(func() EnvironmentPreparer { return NewOutOfMemoryErrorRestarter() })
@@ -4,52 +4,52 @@
 package environment
 
 import (
+	"context"
 	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
-	"github.com/jkellerer/jenkins-client-launcher/launcher/modes"
 	"time"
 )
 
 // Defines an object which triggers a periodic restart of the Jenkins client when enabled.
 type PeriodicRestarter struct {
-	util.AnyConfigAcceptor
-
-	ticker *time.Ticker
 }
 
 func (self *PeriodicRestarter) Name() string {
 	return "Periodic Client Restarter"
 }
 
-func (self *PeriodicRestarter) Prepare(config *util.Config) {
-	if self.ticker != nil {
-		self.ticker.Stop()
+func (self *PeriodicRestarter) IsConfigAcceptable(config *util.Config) (bool) {
+	if config.PeriodicClientRestartEnabled {
+		if _, err := self.schedule(config); err != nil {
+			util.GOut("periodic", "WARN: Invalid schedule of the periodic restart. Cause: %v", err)
+			return false
+		}
 	}
+	return true
+}
 
-	if !config.PeriodicClientRestartEnabled || config.PeriodicClientRestartIntervalHours <= 0 {
+func (self *PeriodicRestarter) schedule(config *util.Config) (util.Schedule, error) {
+	return config.Schedule(config.PeriodicClientRestartSchedule, time.Hour*time.Duration(config.PeriodicClientRestartIntervalHours))
+}
+
+func (self *PeriodicRestarter) Prepare(ctx context.Context, config *util.Config) {
+	if !config.PeriodicClientRestartEnabled {
 		return
 	}
 
-	self.ticker = time.NewTicker(time.Hour*time.Duration(config.PeriodicClientRestartIntervalHours))
-
-	go func() {
-		// Run in schedule
-		for time := range self.ticker.C {
-			util.GOut("periodic", "Triggering periodic restart.", time)
-			self.waitForIdleIfRequired(config)
-			// Stopping the mode as this will automatically do a restart.
-			modes.GetConfiguredMode(config).Stop()
-		}
-	}()
-}
+	schedule, _ := self.schedule(config)
+	if schedule == nil {
+		return
+	}
 
-func (self *PeriodicRestarter) waitForIdleIfRequired(config *util.Config) {
-	if config.PeriodicClientRestartOnlyWhenIDLE {
-		for !util.NodeIsIdle.Get() {
-			util.GOut("periodic", "Waiting for node to become IDLE before triggering a restart.")
-			time.Sleep(time.Minute * 5)
+	// Run in schedule
+	go util.RunScheduled(ctx, "periodic", scheduledTaskName(config, "Periodic restart"), schedule, func(ctx context.Context) {
+		if skipMaintenance(config, "periodic", "the periodic restart") {
+			return
 		}
-	}
+		util.GOut("periodic", "Triggering periodic restart.")
+		restartPlanned(ctx, config, "periodic", util.RestartReasonPeriodic, config.PeriodicClientRestartOnlyWhenIDLE)
+	})
 }
 
 // Registering the restarter.
-var _ = RegisterPreparer(new(PeriodicRestarter))
+var _ = RegisterAgentPreparer(func() EnvironmentPreparer { return new(PeriodicRestarter) })
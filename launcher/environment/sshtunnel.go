@@ -4,6 +4,7 @@
 package environment
 
 import (
+	"context"
 	"github.com/jkellerer/jenkins-client-launcher/launcher/modes"
 	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
 	"golang.org/x/crypto/ssh"
@@ -17,6 +18,7 @@ import (
 	"net/http"
 	"strings"
 	"math"
+	"sync"
 	"time"
 )
 
@@ -28,11 +30,12 @@ type SSHTunnelEstablisher struct {
 	closables []io.Closer
 	ciHostURL *url.URL
 
-	aliveTicker *time.Ticker
-	aliveTickEvaluator *time.Ticker
 	expectedAliveTick *util.AtomicInt32
 	lastAliveTick *util.AtomicInt32
 	tunnelConnected *util.AtomicBoolean
+
+	registerInMode bool
+	once *sync.Once
 }
 
 // Creates a new tunnel establisher.
@@ -41,30 +44,9 @@ func NewSSHTunnelEstablisher(registerInMode bool) *SSHTunnelEstablisher {
 	self.closables = []io.Closer{}
 	self.ciHostURL = nil
 
-	self.aliveTicker, self.aliveTickEvaluator = time.NewTicker(nodeSshTunnelAliveMonitoringInterval), time.NewTicker(nodeSshTunnelAliveMonitoringInterval)
 	self.expectedAliveTick, self.lastAliveTick = util.NewAtomicInt32(), util.NewAtomicInt32()
 	self.tunnelConnected = util.NewAtomicBoolean()
-
-	if registerInMode {
-		modes.RegisterModeListener(func(mode modes.ExecutableMode, nextStatus int32, config *util.Config) {
-			if !config.CITunnelSSHEnabled || config.CITunnelSSHAddress == "" || mode.Name() != "client" || !config.HasCIConnection() {
-				return
-			}
-
-			if nextStatus == modes.ModeStarting {
-				var err error;
-				if self.ciHostURL, err = url.Parse(config.CIHostURI); err != nil {
-					util.GOut("ssh-tunnel", "ERROR: Failed parsing Jenkins URI. Cannot tunnel connections to Jenkins. Cause: %v", err)
-					return
-				}
-
-				self.setupSSHTunnel(config)
-
-			} else if nextStatus == modes.ModeStopped {
-				self.tearDownSSHTunnel(config)
-			}
-		})
-	}
+	self.registerInMode, self.once = registerInMode, new(sync.Once)
 
 	return self
 }
@@ -85,37 +67,60 @@ func (self *SSHTunnelEstablisher) IsConfigAcceptable(config *util.Config) (bool)
 	return true
 }
 
-func (self *SSHTunnelEstablisher) Prepare(config *util.Config) {
-	self.startAliveStateMonitoring(config)
+func (self *SSHTunnelEstablisher) Prepare(ctx context.Context, config *util.Config) {
+	if self.registerInMode {
+		self.once.Do(func() { self.registerModeListener(config) })
+	}
+	self.startAliveStateMonitoring(ctx, config)
+}
+
+// Sets up the tunnel when the client mode of the agent starts and tears it down when it stopped.
+func (self *SSHTunnelEstablisher) registerModeListener(config *util.Config) {
+	modes.RegisterModeListenerFor(config, func(mode modes.ExecutableMode, nextStatus int32, config *util.Config, reason *modes.StopReason) {
+		if !config.CITunnelSSHEnabled || config.CITunnelSSHAddress == "" || mode.Name() != "client" || !config.HasCIConnection() {
+			return
+		}
+
+		if nextStatus == modes.ModeStarting {
+			var err error;
+			if self.ciHostURL, err = url.Parse(config.CIHostURI); err != nil {
+				util.GOut("ssh-tunnel", "ERROR: Failed parsing Jenkins URI. Cannot tunnel connections to Jenkins. Cause: %v", err)
+				return
+			}
+
+			self.setupSSHTunnel(config)
+
+		} else if nextStatus == modes.ModeStopped {
+			self.tearDownSSHTunnel(config)
+		}
+	})
 }
 
 // Monitors that the tunnel is alive by periodically querying the node status off Jenkins.
 // Timeout, hanging connections or connection errors lead to a restart of the current execution mode (which implicitly closes SSH tunnel as well).
-func (self *SSHTunnelEstablisher) startAliveStateMonitoring(config *util.Config) {
+func (self *SSHTunnelEstablisher) startAliveStateMonitoring(ctx context.Context, config *util.Config) {
 	// Periodically check the node status and increment lastAliveTick on success
-	go func() {
-		for _ = range self.aliveTicker.C {
-			if !self.tunnelConnected.Get() { continue }
+	go util.Every(ctx, nodeSshTunnelAliveMonitoringInterval, func() {
+		if !self.tunnelConnected.Get() { return }
 
-			if _, err := GetJenkinsNodeStatus(config); err == nil {
-				self.lastAliveTick.Set(self.expectedAliveTick.Get());
-			}
+		if _, err := GetJenkinsNodeStatus(config); err == nil {
+			self.lastAliveTick.Set(self.expectedAliveTick.Get());
 		}
-	}()
+	})
 
 	// Periodically check that lastAliveTick was incremented.
-	go func() {
-		for _ = range self.aliveTickEvaluator.C {
-			if !self.tunnelConnected.Get() { continue }
-
-			if math.Abs(float64(self.expectedAliveTick.Get() - self.lastAliveTick.Get())) > 1 {
-				util.GOut("ssh-tunnel", "WARN: The SSH tunnel appears to be dead or Jenkins is gone. Forcing restart of client and SSH tunnel.")
-				modes.GetConfiguredMode(config).Stop()
-			} else {
-				self.expectedAliveTick.AddAndGet(1)
-			}
+	go util.Every(ctx, nodeSshTunnelAliveMonitoringInterval, func() {
+		if !self.tunnelConnected.Get() { return }
+
+		if math.Abs(float64(self.expectedAliveTick.Get() - self.lastAliveTick.Get())) > 1 {
+			util.GOut("ssh-tunnel", "WARN: The SSH tunnel appears to be dead or Jenkins is gone. Forcing restart of client and SSH tunnel.")
+			util.Notify(config, util.EventTunnelLost, "The SSH tunnel to Jenkins was lost, restarting client and tunnel.",
+				map[string]interface{}{"address": config.CITunnelSSHAddress})
+			modes.StopConfiguredModeWithDiagnostics(config, util.RestartReasonTunnelLost)
+		} else {
+			self.expectedAliveTick.AddAndGet(1)
 		}
-	}()
+	})
 }
 
 func (self *SSHTunnelEstablisher) resetAliveStateMonitoring(config *util.Config) {
@@ -130,11 +135,12 @@ func (self *SSHTunnelEstablisher) tearDownSSHTunnel(config *util.Config) {
 	}
 
 	self.tunnelConnected.Set(false)
+	util.SetMetric(util.MetricTunnelConnected, 0, "node", config.ClientName)
 	self.resetAliveStateMonitoring(config)
 
 	config.CIHostURI = self.ciHostURL.String()
-	delete(util.JnlpArgs, "-url")
-	delete(util.JnlpArgs, "-tunnel")
+	delete(config.State().JnlpArgs, "-url")
+	delete(config.State().JnlpArgs, "-tunnel")
 
 	if self.closables != nil && len(self.closables) > 0 {
 		for i := len(self.closables) - 1; i >= 0; i-- {
@@ -216,11 +222,12 @@ func (self *SSHTunnelEstablisher) setupSSHTunnel(config *util.Config) {
 	localCiURL, _ := url.Parse(self.ciHostURL.String())
 	localCiURL.Host = httpListener.Addr().String()
 	config.CIHostURI = localCiURL.String()
-	util.JnlpArgs["-url"] = localCiURL.String()
-	util.JnlpArgs["-tunnel"] = jnlpListener.Addr().String()
+	config.State().JnlpArgs["-url"] = localCiURL.String()
+	config.State().JnlpArgs["-tunnel"] = jnlpListener.Addr().String()
 
 	// Mark tunnel as connected when we passed this line.
 	self.tunnelConnected.Set(true)
+	util.SetMetric(util.MetricTunnelConnected, 1, "node", config.ClientName)
 }
 
 // Opens a new local server socket.
@@ -335,4 +342,4 @@ func (self *SSHTunnelEstablisher) formatHostFingerprint(key ssh.PublicKey) strin
 }
 
 // Registering the tunnel establisher.
-var _ = RegisterPreparer(NewSSHTunnelEstablisher(true))
+var _ = RegisterAgentPreparer(func() EnvironmentPreparer { return NewSSHTunnelEstablisher(true) })
@@ -4,13 +4,17 @@
 package launcher
 
 import (
+	"context"
 	"flag"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"fmt"
 	"regexp"
 	"net/http"
 	"io"
+	"strings"
+	"sync"
 	"time"
 	"github.com/jkellerer/jenkins-client-launcher/launcher/modes"
 	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
@@ -76,73 +80,228 @@ func Run() {
 	}
 
 	config := loadConfig(*defaultConfig, *overwrite)
+	registerLauncherMetrics()
+
+	applyOverrides := func(config *util.Config) {
+		if len(*runMode) > 0 { config.RunMode = *runMode }
+		if len(*url) > 0 { config.CIHostURI = *url }
+		if len(*secretKey) > 0 { config.SecretKey = *secretKey }
+		if len(*name) > 0 { config.ClientName = *name }
+		if *create { config.CreateClientIfMissing = true }
+		if *acceptAnyCert { config.CIAcceptAnyCert = true }
+	}
+	applyOverrides(config)
 
-	if len(*runMode) > 0 { config.RunMode = *runMode }
-	if len(*url) > 0 { config.CIHostURI = *url }
-	if len(*secretKey) > 0 { config.SecretKey = *secretKey }
-	if len(*name) > 0 { config.ClientName = *name }
-	if *create { config.CreateClientIfMissing = true }
-	if *acceptAnyCert { config.CIAcceptAnyCert = true }
+	if config.GenerateControlTokenIfMissing() {
+		util.Out("Generated a token for the control API (see 'control>token' in '%v').", ConfigName)
+		config.NeedsSave = true
+	}
 
-	saveConfigIfRequired := func() {
+	saveConfigIfRequired := func(config *util.Config) {
 		if config.NeedsSave || *saveChanges || *autoStart || *overwrite {
 			config.Save(ConfigName)
 		}
 	}
 
 	if *help {
-		saveConfigIfRequired()
+		saveConfigIfRequired(config)
 		fmt.Printf(AppDescription, ConfigName, filepath.Base(os.Args[0]))
 		flag.PrintDefaults()
 		return
 	}
 
-	environment.RunPreparers(config)
+	configs, err := agentConfigs(config)
+	if err != nil {
+		util.Out("ERROR: %v", err)
+		return
+	}
+
+	// All modes and monitoring goroutines end when the root context is cancelled by a kill or interrupt.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cancelOnSignal(cancel)
+
+	registry := newAgentRegistry(cancel, func() ([]*util.Config, error) {
+		config, err := util.LoadConfig(ConfigName)
+		if err != nil {
+			return nil, err
+		}
+		applyOverrides(config)
+		return agentConfigs(config)
+	})
+
+	go listenForKeyboardInput(registry)
+
+	if config.ControlEnabled {
+		go serveControl(ctx, config, registry)
+	}
+
+	// Events (e.g. of stopping agents) are delivered before the launcher exits.
+	defer util.WaitForNotifications(time.Second * 30)
+
+	// Agents are run until the launcher stops, reloading the config restarts them with the new configs.
+	for configs != nil {
+		configs = runAgents(ctx, configs, registry, saveConfigIfRequired)
+		if configs != nil {
+			util.Out("Reloaded the configuration from '%v', restarting all agents.", ConfigName)
+			util.SetMetric(util.MetricConfigLoaded, float64(time.Now().Unix()))
+			util.Notify(configs[0], util.EventConfigReloaded, "Reloaded the configuration, restarting all agents.",
+				map[string]interface{}{"agents": len(configs)})
+		}
+	}
+}
+
+// Returns the configs of all agents that are run with the specified config or an error if the agents are invalid.
+func agentConfigs(config *util.Config) ([]*util.Config, error) {
+	configs, err := config.AgentConfigs()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid agents configuration. Cause: %v", err)
+	} else if len(configs) > 1 && config.RunMode != "client" {
+		return nil, fmt.Errorf("Additional agents are only supported in run mode 'client' (configured: '%v').", config.RunMode)
+	}
+	return configs, nil
+}
+
+// Prepares the environment and runs all agents until the context is done or the config is reloaded.
+// Returns the reloaded configs or nil when the launcher stops.
+func runAgents(ctx context.Context, configs []*util.Config, registry *agentRegistry, saveConfigIfRequired func(*util.Config)) []*util.Config {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	abort := !modes.GetConfiguredMode(config).IsConfigAcceptable(config)
-	saveConfigIfRequired()
+	states := []*util.AgentState{}
+	for _, agentConfig := range configs {
+		states = append(states, agentConfig.State())
+	}
+	util.SetAgents(states)
+
+	abort := false
+	for _, agentConfig := range configs {
+		if directory := agentConfig.State().Directory; directory != "" {
+			util.Out("Preparing agent %v in %v", agentConfig.State().Name, directory)
+			if err := os.MkdirAll(directory, 0755); err != nil {
+				util.Out("ERROR: Failed creating the directory of agent %v. Cause: %v", agentConfig.State().Name, err)
+				abort = true
+				continue
+			}
+		}
+
+		environment.RunPreparers(ctx, agentConfig)
+
+		if !modes.GetConfiguredMode(agentConfig).IsConfigAcceptable(agentConfig) {
+			abort = true
+		}
+	}
+	saveConfigIfRequired(configs[0])
 
 	if abort {
-		return
+		return nil
 	}
 
-	restartCount := int64(0)
-	sleepTimePerRestart := int64(time.Second * time.Duration(config.SleepTimeSecondsBetweenFailures))
-	runTimeAfterResettingRestartCount := time.Hour * 2
+	registry.started(configs, cancel)
+
+	agents := new(sync.WaitGroup)
+	for _, agentConfig := range configs {
+		agents.Add(1)
+		go func(config *util.Config) {
+			defer agents.Done()
+			runAgent(ctx, config, registry)
+		}(agentConfig)
+	}
+	agents.Wait()
 
+	return registry.takeReloaded()
+}
+
+// Runs the configured mode for the agent of the specified config and restarts it (according to the
+// restart policies) until the context is done.
+func runAgent(ctx context.Context, config *util.Config, registry *agentRegistry) {
+	scheduler := NewRestartScheduler()
 	timeOfLastStart := time.Now()
 
-	go listenForKeyboardInput(config, &restartCount)
+	title, agent := "Restarting Jenkins Client", ""
+	if name := config.State().Name; name != "" {
+		title, agent = "Restarting agent " + name, "agent=" + name + " "
+	}
 
-	for modes.RunConfiguredMode(config) {
-		util.FlatOut("\n:::::::::::::::::::::::::::::::::\n::  %25s  ::\n:::::::::::::::::::::::::::::::::\n", "Restarting Jenkins Client")
+	for {
+		restart, reason := modes.RunConfiguredMode(ctx, config)
+		if !restart {
+			break
+		}
+
+		util.FlatOut("\n:::::::::::::::::::::::::::::::::\n::  %25s  ::\n:::::::::::::::::::::::::::::::::\n", title)
+
+		sleepTime, crashLoop := scheduler.NextRestart(config.RestartPolicyFor(reason.Cause), time.Now())
+		uptime := time.Since(timeOfLastStart) / time.Second * time.Second
 
-		if timeOfLastStart.Before(time.Now().Add(-runTimeAfterResettingRestartCount)) {
-			restartCount = 0
+		details := map[string]interface{}{"cause": reason.Cause, "exitCode": reason.ExitCode, "signal": reason.Signal,
+			"uptimeSeconds": uptime.Seconds(), "sleepSeconds": sleepTime.Seconds()}
+
+		if crashLoop {
+			util.Out("ERROR: The Jenkins client is in a crash loop (%vlast restart reason: %v). Restarting is suspended for %v.", agent, reason.String(), sleepTime)
+			util.Notify(config, util.EventCrashLoop, fmt.Sprintf("The Jenkins client is in a crash loop (last restart reason: %v). " +
+				"Restarting is suspended for %v.", reason.String(), sleepTime), details)
+		} else {
+			util.Out("Restart: %vcause=%v exitCode=%v signal=%v uptime=%v sleep=%v%v",
+				agent, reason.Cause, reason.ExitCode, reason.Signal, uptime, sleepTime / time.Second * time.Second,
+				formatDiagnostics(reason.Diagnostics))
+			util.Notify(config, util.EventRestart, fmt.Sprintf("Restarting the Jenkins client in %v (%v).",
+				sleepTime / time.Second * time.Second, reason.String()), details)
 		}
+		registry.recordRestart(config, reason, uptime, sleepTime, crashLoop)
 
-		if sleepTime := time.Duration(restartCount * sleepTimePerRestart); sleepTime > 0 {
-			util.FlatOut("Sleeping %v seconds before restarting the client.\n\n", sleepTime.Seconds())
-			time.Sleep(sleepTime)
+		if sleepTime > 0 {
+			util.FlatOut("Sleeping %v seconds before restarting the client.\n\n", int64(sleepTime.Seconds()))
+			if !util.Sleep(ctx, sleepTime) {
+				break
+			}
 		}
 
-		restartCount++
 		timeOfLastStart = time.Now()
+		scheduler.Started(timeOfLastStart)
 	}
 }
 
+// Updates the metrics of the launcher itself.
+func registerLauncherMetrics() {
+	started := time.Now()
+	util.SetMetric(util.MetricConfigLoaded, float64(started.Unix()))
+	util.RegisterMetricsCollector(func() {
+		util.SetMetric(util.MetricLauncherUptime, time.Since(started).Seconds())
+	})
+}
+
+// Calls "cancel" when the launcher receives a kill or interrupt.
+func cancelOnSignal(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, os.Kill)
+
+	sig := <-signals // This channel receives only Interrupt or Kill and blocks until one is received.
+	util.Out("Received signal: %v, stopping...", sig)
+	cancel()
+}
+
+// Returns " diagnostics=path,..." or "" if no diagnostic files were collected.
+func formatDiagnostics(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+	return " diagnostics=" + strings.Join(paths, ",")
+}
+
 // Listens for key codes.
-func listenForKeyboardInput(config *util.Config, subsequentRestarts *int64) {
+func listenForKeyboardInput(registry *agentRegistry) {
 	var keyCode = make([]byte, 1)
-	util.Out("Listening for keys: [%s]: Print Stacktrace | [%s]: Restart client.", "D+Return", "R+Return")
+	util.Out("Listening for keys: [%s]: Print Stacktrace | [%s]: Restart client | [%s]: Print status.", "D+Return", "R+Return", "S+Return")
 	for {
 		if n, err := os.Stdin.Read(keyCode); err == nil && n == 1 {
 			switch keyCode[0] {
 			case 'r', 'R':
-				*subsequentRestarts = 0
-				modes.GetConfiguredMode(config).Stop()
+				registry.Restart("")
 			case 'd', 'D':
 				util.PrintAllStackTraces()
+			case 's', 'S':
+				printStatus(registry.Configs())
 			}
 		} else {
 			return
@@ -150,6 +309,18 @@ func listenForKeyboardInput(config *util.Config, subsequentRestarts *int64) {
 	}
 }
 
+// Prints the state of all agents and the next run times of scheduled tasks.
+func printStatus(configs []*util.Config) {
+	for _, config := range configs {
+		mode, name := modes.GetConfiguredMode(config), config.ClientName
+		util.Out("Status: node=%v mode=%v status=%v idle=%v heldOffline=%v", name, mode.Name(), modes.StatusName(mode.Status().Get()),
+			config.State().NodeIsIdle.Get(), config.State().HeldOffline.Get())
+	}
+	for _, line := range util.NextRuns() {
+		util.Out("Next run: %v", line)
+	}
+}
+
 // Handles the working directory that is used.
 func handleWorkingDirectory(dir string) {
 	wd, _ := os.Getwd()
@@ -0,0 +1,26 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+// +build !linux
+
+package modes
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// cgroups are not supported on this OS.
+func startInCGroup(command *exec.Cmd, cgroupPath string) (release func(), err error) {
+	return nil, fmt.Errorf("cgroups are only supported on Linux.")
+}
+
+// cgroups are not supported on this OS.
+func startInCGroupFailed(err error) bool {
+	return false
+}
+
+// cgroups are not supported on this OS.
+func moveToCGroup(cgroupPath string, pid int) error {
+	return fmt.Errorf("cgroups are only supported on Linux.")
+}
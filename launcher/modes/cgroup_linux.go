@@ -0,0 +1,53 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package modes
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+)
+
+// Is set when the kernel cannot start processes inside a cgroup (requires Linux 5.7).
+var cgroupStartUnsupported = new(util.AtomicBoolean)
+
+// Configures the command to start inside the cgroup (v2) at the given path, so that no child process
+// escapes the limits. The returned function must be called after the start to release the cgroup.
+func startInCGroup(command *exec.Cmd, cgroupPath string) (release func(), err error) {
+	if cgroupStartUnsupported.Get() {
+		return nil, syscall.ENOSYS
+	}
+
+	dir, err := os.Open(cgroupPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if command.SysProcAttr == nil {
+		command.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	command.SysProcAttr.UseCgroupFD, command.SysProcAttr.CgroupFD = true, int(dir.Fd())
+
+	return func() { dir.Close() }, nil
+}
+
+// Handles the failed start of a command that was configured with startInCGroup and returns true if
+// the kernel does not support it (following starts move the process into the cgroup after the start).
+func startInCGroupFailed(err error) bool {
+	if errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.E2BIG) || errors.Is(err, syscall.EINVAL) {
+		cgroupStartUnsupported.Set(true)
+		return true
+	}
+	return false
+}
+
+// Moves the process with the specified pid into the cgroup (v2) at the given path.
+func moveToCGroup(cgroupPath string, pid int) error {
+	return ioutil.WriteFile(filepath.Join(cgroupPath, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
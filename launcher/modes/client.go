@@ -4,6 +4,7 @@
 package modes
 
 import (
+	"context"
 	"time"
 	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
 	"fmt"
@@ -52,13 +53,43 @@ import (
                                    unsafe protocol like telnet`
 **/
 
+const (
+	// Is the name of the JNLP file that is created when the JNLP config from Jenkins needs to be customized.
+	CustomizedJnlpName = "~slave-agent.jnlp"
+)
+
 type ClientMode struct {
-	status *util.AtomicInt32
+	stopReasonRecorder
+	modeContext
+	group   string
+	prefix  string
+	status  *util.AtomicInt32
+	pid     *util.AtomicInt32
+	console *util.LineRingBuffer
+	capture *consoleCapture
+	mutex   sync.Mutex
+
+	// Receives a value when the connection state changed.
+	connectionChanged chan bool
 }
 
 func NewClientMode() *ClientMode {
 	r := new(ClientMode)
+	r.group = "client"
 	r.status = new(util.AtomicInt32)
+	r.pid = new(util.AtomicInt32)
+	r.connectionChanged = make(chan bool, 1)
+	return r
+}
+
+// Returns a new client mode that runs the agent of the specified config.
+// Log and console output of the agent is prefixed with the agent's name.
+func (self *ClientMode) NewInstance(config *util.Config) ExecutableMode {
+	r := NewClientMode()
+	if name := config.State().Name; name != "" {
+		r.group = "client:" + name
+		r.prefix = "[" + name + "] "
+	}
 	return r
 }
 
@@ -70,12 +101,23 @@ func (self *ClientMode) Status() *util.AtomicInt32 {
 	return self.status
 }
 
+func (self *ClientMode) Pid() int {
+	return int(self.pid.Get())
+}
+
 func (self *ClientMode) IsConfigAcceptable(config *util.Config) (bool) {
 	if !config.HasCIConnection() {
 		util.GOut(self.Name(), "ERROR: No Jenkins URI defined. Cannot connect to the CI server.")
 		return false
 	}
 
+	if config.RunAsUser != "" {
+		if err := self.checkRunAsPrivileges(config); err != nil {
+			util.GOut(self.Name(), "ERROR: Cannot run the Jenkins client as user '%v'. Cause: %v", config.RunAsUser, err)
+			return false
+		}
+	}
+
 	if config.SecretKey == "" && !self.isAuthCredentialsPassedViaCommandline(config) {
 		if config.SecretKey = self.getSecretFromJenkins(config); config.SecretKey == "" {
 			util.GOut(self.Name(), "ERROR: No secret key set for node %v and the attempt to fetch it from Jenkins failed.", config.ClientName)
@@ -86,20 +128,25 @@ func (self *ClientMode) IsConfigAcceptable(config *util.Config) (bool) {
 	return true
 }
 
-func (self *ClientMode) Start(config *util.Config) (error) {
+func (self *ClientMode) Start(ctx context.Context, config *util.Config) (*ModeHandle, error) {
 	if !self.isStopped() {
 		panic(fmt.Sprintf("Cannot start mode whose state is != ModeNone && != ModeStopped, was %v", self.status))
 	}
 
+	self.resetStopReason()
 	self.status.Set(ModeStarting)
-	go self.execute(config)
 
-	return nil
+	handle := newModeHandle()
+	go self.execute(self.startContext(ctx), config, handle)
+
+	return handle, nil
 }
 
-func (self *ClientMode) Stop() {
+func (self *ClientMode) Stop(cause string) {
 	if !self.isStopped() {
+		self.recordStopCause(cause)
 		self.status.Set(ModeStopping)
+		self.cancelContext()
 	}
 }
 
@@ -107,23 +154,36 @@ func (self *ClientMode) isStopped() bool {
 	return self.status.Get() == ModeNone || self.status.Get() == ModeStopped
 }
 
-func (self *ClientMode) execute(config *util.Config) {
+// Runs the Jenkins client until it exited or the context is done and finishes the handle afterwards.
+func (self *ClientMode) execute(ctx context.Context, config *util.Config, handle *ModeHandle) {
+	// Ends with this run (also when the client exits by itself), delayed actions of the run use it.
+	ctx, cancelRun := context.WithCancel(ctx)
+
+	var err error
+	defer func() {
+		cancelRun()
+		self.status.Set(ModeStopped)
+		handle.finish(err)
+	}()
+
+	agent := config.State()
 	commandline := []string{}
-	commandline = append(commandline, util.JavaArgs...)
+	commandline = append(commandline, agent.JavaArgs...)
 	commandline = append(commandline, config.JavaArgs...)
 
-	if config.JavaMaxMemory != "" {
-		commandline = append(commandline, "-Xmx"+config.JavaMaxMemory)
+	if maxMemory := self.getJavaMaxMemory(config); maxMemory != "" {
+		commandline = append(commandline, "-Xmx"+maxMemory)
 	}
 
-	commandline = append(commandline, "-jar", util.ClientJar)
+	commandline = append(commandline, "-jar", agent.ClientJar)
 
-	if len(util.JnlpArgs) > 0 {
-		if err := ioutil.WriteFile("~slave-agent.jnlp", self.getCustomizedAgentJnlp(config), os.ModeTemporary); err == nil {
-			defer os.Remove("~slave-agent.jnlp")
-			commandline = append(commandline, "-jnlpUrl", "file:./~slave-agent.jnlp")
+	if len(agent.JnlpArgs) > 0 {
+		jnlpFile := agent.Path(CustomizedJnlpName)
+		if err := ioutil.WriteFile(jnlpFile, self.getCustomizedAgentJnlp(config), os.ModeTemporary); err == nil {
+			defer os.Remove(jnlpFile)
+			commandline = append(commandline, "-jnlpUrl", "file:./"+CustomizedJnlpName)
 		} else {
-			util.GOut("client", "ERROR: Failed creating customized JNLP config. Cause: %v", err)
+			util.GOut(self.group, "ERROR: Failed creating customized JNLP config. Cause: %v", err)
 		}
 	} else {
 		commandline = append(commandline, "-jnlpUrl", fmt.Sprintf("%v/computer/%v/slave-agent.jnlp", config.CIHostURI, config.ClientName))
@@ -137,6 +197,18 @@ func (self *ClientMode) execute(config *util.Config) {
 		commandline = append(commandline, "-noCertificateCheck")
 	}
 
+	if workDir := config.RemotingWorkDirPath(); workDir != "" {
+		if err := os.MkdirAll(workDir, 0755); err == nil {
+			commandline = append(commandline, "-workDir", workDir)
+		} else {
+			util.GOut(self.group, "ERROR: Failed creating remoting work directory %v. Cause: %v", workDir, err)
+		}
+	}
+
+	if config.RemotingJarCache != "" {
+		commandline = append(commandline, "-jar-cache", config.RemotingJarCachePath())
+	}
+
 	if config.HandleReconnectsInLauncher {
 		commandline = append(commandline, "-noReconnect")
 	}
@@ -146,77 +218,223 @@ func (self *ClientMode) execute(config *util.Config) {
 		commandline = append(commandline, "-jnlpCredentials", fmt.Sprintf("%s:%s", config.CIUsername, config.CIPassword))
 	}
 
-	stoppingClient, clientStopped := make(chan bool), make(chan bool)
+	if config.ClientMonitorConsole {
+		if err := config.ConsoleMonitor.CompileRules(); err != nil {
+			util.GOut(self.group, "WARN: Console rules are disabled. %v", err)
+		}
+	}
 
-	go func() {
-		command := exec.Command(util.Java, commandline...)
-		if pOut, err := command.StdoutPipe(); err == nil {
-			go self.redirectConsoleOutput(config, pOut, os.Stdout, util.OutputMutex)
-		} else {
-			panic("Failed connecting stdout with console")
+	self.console = nil
+	if config.CrashSnapshotsEnabled {
+		self.console = util.NewLineRingBuffer(config.CrashSnapshotLines)
+	}
+
+	consoleClosed := &sync.WaitGroup{}
+
+	command := exec.Command(agent.Java, commandline...)
+	command.Dir = agent.Directory
+	if pOut, err := command.StdoutPipe(); err == nil {
+		consoleClosed.Add(1)
+		go func() {
+			defer consoleClosed.Done()
+			self.redirectConsoleOutput(ctx, config, pOut, os.Stdout, util.OutputMutex)
+		}()
+	} else {
+		panic("Failed connecting stdout with console")
+	}
+
+	if pErr, err := command.StderrPipe(); err == nil {
+		consoleClosed.Add(1)
+		go func() {
+			defer consoleClosed.Done()
+			self.redirectConsoleOutput(ctx, config, pErr, os.Stderr, util.OutputMutex)
+		}()
+	} else {
+		panic("Failed connecting stderr with console")
+	}
+
+	baseEnvironment := os.Environ()
+	if config.RunAsUser != "" {
+		if baseEnvironment, err = self.applyRunAs(config, command, baseEnvironment); err != nil {
+			util.GOut(self.group, "ERROR: Cannot run the Jenkins client as user '%v'. Cause: %v", config.RunAsUser, err)
+			self.recordProcessExit(nil)
+			return
 		}
+		command.Env = baseEnvironment
+	}
 
-		if pErr, err := command.StderrPipe(); err == nil {
-			go self.redirectConsoleOutput(config, pErr, os.Stderr, util.OutputMutex)
-		} else {
-			panic("Failed connecting stderr with console")
+	if self.hasCustomEnvironment(config) {
+		command.Env = self.createEnvironment(config, baseEnvironment)
+		util.GOut(self.group, "Environment: %s", strings.Join(self.describeEnvironmentChanges(config), "; "))
+	}
+
+	if ctx.Err() != nil {
+		self.recordStopCause(util.RestartReasonShutdown)
+		return
+	}
+
+	filteredCommands := self.createFilteredCommands(agent.Java, commandline, self.getSensitiveNames(config)...)
+	util.GOut(self.group, "Starting: %s", filteredCommands)
+	started := time.Now()
+
+	// Starting inside the cgroup, processes forked before moving the client would escape the limits.
+	startedInCGroup := false
+	if agent.ClientCGroup != "" {
+		if release, err := startInCGroup(command, agent.ClientCGroup); err == nil {
+			defer release()
+			startedInCGroup = true
 		}
+	}
 
-		util.GOut("client", "Starting: %s", self.createFilteredCommands(commandline))
+	if err = command.Start(); err != nil {
+		if startedInCGroup && startInCGroupFailed(err) {
+			util.GOut(self.group, "WARN: The kernel cannot start the Jenkins client inside cgroup %v, moving it after the next start.", agent.ClientCGroup)
+		}
+		util.GOut(self.group, "ERROR: Jenkins client failed to start with %v", err)
+		self.recordProcessExit(nil)
+		return
+	}
 
-		if err := command.Start(); err != nil {
-			util.GOut("client", "ERROR: Jenkins client failed to start with %v", err)
-		} else {
-			util.GOut("client", "Jenkins client was started.")
-
-			go func() {
-				<-stoppingClient
-				command.Process.Kill()
-				time.Sleep(time.Second * 1)
-			}()
-
-			if err := command.Wait(); err != nil {
-				util.GOut("client", "WARN: Jenkins client quit with %v", err)
-			} else {
-				util.GOut("client", "Jenkins client was stopped.")
-			}
+	self.pid.Set(int32(command.Process.Pid))
+	self.status.CompareAndSet(ModeStarting, ModeConnecting)
 
-			self.status.Set(ModeStopped)
-			clientStopped<-true
+	if agent.ClientCGroup != "" && !startedInCGroup {
+		if err := moveToCGroup(agent.ClientCGroup, command.Process.Pid); err != nil {
+			util.GOut(self.group, "ERROR: Failed moving the Jenkins client into cgroup %v. Cause: %v", agent.ClientCGroup, err)
 		}
-	}()
+	}
+
+	util.GOut(self.group, "Jenkins client was started.")
+
+	if err = self.supervise(ctx, config, command); err != nil {
+		util.GOut(self.group, "WARN: Jenkins client quit with %v", err)
+	} else {
+		util.GOut(self.group, "Jenkins client was stopped.")
+	}
+
+	self.pid.Set(0)
+	self.recordProcessExit(command.ProcessState)
+
+	if self.console != nil {
+		// Giving the console redirects a moment to process the remaining output.
+		self.waitWithTimeout(consoleClosed, time.Second * 2)
+		if path := self.writeCrashSnapshot(config, filteredCommands, started, time.Now()); path != "" {
+			self.recordDiagnostics(path)
+		}
+	}
+}
+
+// Waits until the started client process exited and returns the result of "command.Wait()".
+// The process is killed when the context is done, a restart is forced when the client does not connect in time.
+func (self *ClientMode) supervise(ctx context.Context, config *util.Config, command *exec.Cmd) error {
+	exited := make(chan error, 1)
+	go func() { exited <- command.Wait() }()
+
+	connectTimeout := self.connectTimeout(config)
+
+	for {
+		select {
+		case err := <-exited:
+			return err
+
+		case <-ctx.Done():
+			self.recordStopCause(util.RestartReasonShutdown)
+			command.Process.Kill()
+			return <-exited
+
+		case <-self.connectionChanged:
+			connectTimeout = self.connectTimeout(config)
+
+		case <-connectTimeout:
+			connectTimeout = nil
+			if self.status.Get() != ModeConnected {
+				util.GOut(self.group, "WARN: Jenkins client did not connect within %v seconds, forcing a restart.", config.ClientConnectTimeoutSeconds)
+				self.CollectDiagnostics(config)
+				self.Stop(util.RestartReasonConnectTimeout)
+			}
+		}
+	}
+}
 
-	// Entering main loop
-	self.status.Set(ModeStarted)
+// Returns the value of java's "-Xmx" option derived from the configured max memory or "" if not set.
+func (self *ClientMode) getJavaMaxMemory(config *util.Config) string {
+	if config.JavaMaxMemory == "" {
+		return ""
+	}
 
-	for self.status.Get() == ModeStarted {
-		time.Sleep(time.Millisecond * 100)
+	available, source, err := util.AvailableMemory(config)
+	if err != nil && strings.HasSuffix(config.JavaMaxMemory, "%") {
+		util.GOut(self.group, "WARN: Failed detecting the available memory. Cause: %v", err)
 	}
 
-	stoppingClient <- true
-	<-clientStopped
+	maxMemory, err := config.ComputeJavaMaxMemory(available)
+	if err != nil {
+		util.GOut(self.group, "ERROR: Invalid java max memory, using JVM defaults. Cause: %v", err)
+		return ""
+	}
 
-	self.status.Set(ModeStopped)
+	if available > 0 {
+		util.GOut(self.group, "Java max memory: %v (maxMemory: %v, available: %v from %v)",
+			maxMemory, config.JavaMaxMemory, util.FormatByteSize(available >> 20 << 20), source)
+	} else {
+		util.GOut(self.group, "Java max memory: %v (maxMemory: %v)", maxMemory, config.JavaMaxMemory)
+	}
+	return maxMemory
+}
+
+// Waits until the wait group is done or the timeout elapsed.
+func (self *ClientMode) waitWithTimeout(group *sync.WaitGroup, timeout time.Duration) {
+	done := make(chan bool)
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
 }
 
 func (self *ClientMode) isAuthCredentialsPassedViaCommandline(config *util.Config) bool {
 	return config.CIUsername != "" && config.CIPassword != "" && config.PassCIAuth
 }
 
-func (self *ClientMode) createFilteredCommands(commandline []string) (commands []string) {
+// Returns the commandline including the java executable with credentials masked.
+// Values assigned to sensitive names (e.g. "-Dapi.token=...") or to one of the given names are masked as well.
+func (self *ClientMode) createFilteredCommands(java string, commandline []string, sensitiveNames ...string) (commands []string) {
 	name := ""
-	commands = append([]string{util.Java}, commandline...)
+	commands = append([]string{java}, commandline...)
 	for index, value := range commands {
 		if strings.HasPrefix(value, "-") {
 			name = strings.ToLower(value)
-		} else if strings.Contains(name, "auth") || strings.Contains(name, "credentials") || strings.Contains(name, "password") {
+		} else if strings.Contains(name, "auth") || strings.Contains(name, "credentials") || strings.Contains(name, "password") || strings.Contains(name, "secret") {
 			commands[index] = "***"
+			continue
+		}
+
+		if pair := strings.SplitN(commands[index], "=", 2); len(pair) == 2 && self.isSensitiveAssignment(pair[0], sensitiveNames) {
+			commands[index] = pair[0] + "=***"
 		}
 	}
 	return
 }
 
-func (self *ClientMode) redirectConsoleOutput(config *util.Config, input io.ReadCloser, output io.Writer, outputMutex *sync.Mutex) {
+// Returns true if the name on the left side of an assignment in the commandline (e.g. "-Dname") is sensitive.
+func (self *ClientMode) isSensitiveAssignment(name string, sensitiveNames []string) bool {
+	name = strings.TrimPrefix(strings.TrimLeft(name, "-"), "D")
+	if util.IsSensitiveName(name) {
+		return true
+	}
+	for _, sensitiveName := range sensitiveNames {
+		if strings.EqualFold(name, sensitiveName) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *ClientMode) redirectConsoleOutput(ctx context.Context, config *util.Config, input io.ReadCloser, output io.Writer, outputMutex *sync.Mutex) {
 	defer input.Close()
 	reader := bufio.NewReader(input)
 
@@ -225,6 +443,7 @@ func (self *ClientMode) redirectConsoleOutput(config *util.Config, input io.Read
 		if !holdsLock {
 			outputMutex.Lock()
 			holdsLock = true
+			if self.prefix != "" { output.Write([]byte(self.prefix)) }
 		}
 	}, func() {
 		if holdsLock {
@@ -235,9 +454,21 @@ func (self *ClientMode) redirectConsoleOutput(config *util.Config, input io.Read
 	defer unlock()
 
 	restartTriggered := false
+	console, pending := self.console, []byte{}
 
 	for {
 		line, isPrefix, err := reader.ReadLine()
+		completed := ""
+
+		if pending = append(pending, line...); !isPrefix || err != nil {
+			if len(pending) > 0 || err == nil {
+				completed = string(pending)
+				if console != nil { console.Add(completed) }
+				if capture := self.currentCapture(); capture != nil { capture.add(completed) }
+				self.trackConnectionState(completed)
+			}
+			pending = pending[:0]
+		}
 
 		if len(line) > 0 || holdsLock {
 			lock()
@@ -249,14 +480,15 @@ func (self *ClientMode) redirectConsoleOutput(config *util.Config, input io.Read
 				output.Write([]byte("\n"))
 				unlock()
 			}
+		}
 
-			if config.ClientMonitorConsole && !restartTriggered && config.ConsoleMonitor.IsRestartTriggered(string(line)) {
-				go func() {
-					time.Sleep(time.Second * 1)
-					go self.Stop()
-					util.GOut("client", "WARN: %s found in console output. Client state may be invalid, forced a restart.", "RESTART TOKEN")
-				}()
-				restartTriggered = true
+		// Rules are applied to complete lines, only the first restart action of a run is performed.
+		if config.ClientMonitorConsole && completed != "" {
+			for _, rule := range config.ConsoleMonitor.TriggeredRules(completed, time.Now()) {
+				if restartTriggered && isConsoleRestartAction(rule.Action) {
+					continue
+				}
+				restartTriggered = self.performConsoleRuleAction(ctx, config, rule, completed) || restartTriggered
 			}
 		}
 
@@ -275,12 +507,12 @@ func (self *ClientMode) getSecretFromJenkins(config *util.Config) string {
 				return self.extractSecret(content)
 			}
 		} else {
-			util.GOut("client", "ERROR: Failed fetching secret key from Jenkins. Cause: %v", response.Status)
+			util.GOut(self.group, "ERROR: Failed fetching secret key from Jenkins. Cause: %v", response.Status)
 		}
 	}
 
 	if err != nil {
-		util.GOut("client", "ERROR: Failed fetching secret key from Jenkins. Cause: %v", err)
+		util.GOut(self.group, "ERROR: Failed fetching secret key from Jenkins. Cause: %v", err)
 	}
 
 	return ""
@@ -306,12 +538,12 @@ func (self *ClientMode) getCustomizedAgentJnlp(config *util.Config) []byte {
 				return self.applyCustomJnlpArgs(config, content)
 			}
 		} else {
-			util.GOut("client", "ERROR: Failed JNLP config from Jenkins. Cause: %v", response.Status)
+			util.GOut(self.group, "ERROR: Failed JNLP config from Jenkins. Cause: %v", response.Status)
 		}
 	}
 
 	if err != nil {
-		util.GOut("client", "ERROR: Failed JNLP config from Jenkins. Cause: %v", err)
+		util.GOut(self.group, "ERROR: Failed JNLP config from Jenkins. Cause: %v", err)
 	}
 
 	return nil
@@ -344,7 +576,7 @@ nextToken:
 				t = xmlNode
 
 				if nextIsArgumentContent {
-					if _, overridesArgument := util.JnlpArgs[string(xmlNode)]; overridesArgument {
+					if _, overridesArgument := config.State().JnlpArgs[string(xmlNode)]; overridesArgument {
 						skipArguments = 2
 					} else if (skipArguments == 0) {
 						xmlWriter.EncodeToken(argumentStart)
@@ -358,7 +590,7 @@ nextToken:
 				}
 
 				if xmlNode.Name.Local == "application-desc" {
-					for argName, argValue := range util.JnlpArgs {
+					for argName, argValue := range config.State().JnlpArgs {
 						for _, value := range []string{argName, argValue} {
 							xmlWriter.EncodeToken(argumentStart)
 							xmlWriter.EncodeToken(xml.CharData(value))
@@ -4,10 +4,17 @@
 package modes
 
 import (
+	"context"
 	"testing"
 	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
 	"regexp"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 var jenkinsNodePageHTML = `
@@ -33,8 +40,8 @@ func TestCanExtractSecretKey(t *testing.T) {
 
 func TestCommandlineIsFilteredForPasswords(t *testing.T) {
 	mode := new(ClientMode)
-	in := mode.createFilteredCommands([]string{"-a", "aval", "xyz", "-Auth", "123", "-b", "bval"})
-	out := []string{util.Java, "-a", "aval", "xyz", "-Auth", "***", "-b", "bval"}
+	in := mode.createFilteredCommands("java", []string{"-a", "aval", "xyz", "-Auth", "123", "-b", "bval"})
+	out := []string{"java", "-a", "aval", "xyz", "-Auth", "***", "-b", "bval"}
 
 	if fmt.Sprintf("%v", in) != fmt.Sprintf("%v", out) {
 		t.Errorf("mode.createFilteredCommands([]string(..., '-Auth', '123', ...)) = %v, want %v", in, out)
@@ -44,8 +51,8 @@ func TestCommandlineIsFilteredForPasswords(t *testing.T) {
 func TestCanCustomizeAgentConfigJNLP(t *testing.T) {
 	mode := new(ClientMode)
 	config := &util.Config{RunMode:"client"}
-	util.JnlpArgs["-url"] = "http://my-jenkins-host/my-ci/"
-	util.JnlpArgs["-tunnel"] = "127.0.0.1:12345"
+	config.State().JnlpArgs["-url"] = "http://my-jenkins-host/my-ci/"
+	config.State().JnlpArgs["-tunnel"] = "127.0.0.1:12345"
 
 	in, out := mode.applyCustomJnlpArgs(config, []byte(`<jnlp spec="1.0+" codebase="https://jenkins/ci/computer/jenkins-vb-test/">
   <information>
@@ -102,3 +109,261 @@ func TestCanCustomizeAgentConfigJNLP(t *testing.T) {
 		t.Errorf("mode.processCustomizedAgentJNLP(config, ...) = %v, want %v", string(in), string(out))
 	}
 }
+
+func TestStopReasonKeepsFirstCause(t *testing.T) {
+	mode := new(ClientMode)
+	mode.resetStopReason()
+	mode.recordStopCause(util.RestartReasonPeriodic)
+	mode.recordStopCause(util.RestartReasonManual)
+	mode.recordProcessExit(nil)
+
+	reason := mode.StopReason()
+	in, out := reason.String(), util.RestartReasonPeriodic
+	if in != out {
+		t.Errorf("mode.StopReason().String() = %v, want %v", in, out)
+	}
+}
+
+func TestCanCustomizeClientEnvironment(t *testing.T) {
+	mode := new(ClientMode)
+	config := &util.Config{}
+	config.EnvironmentVariables = []util.EnvironmentVariable{
+		{Name: "A", Value: "a-${B}"},
+		{Name: "B", Action: "unset"},
+		{Name: "P", Action: "prepend", Separator: ":", Value: "/first"},
+		{Name: "Q", Action: "append", Separator: ":", Value: "/last"},
+	}
+
+	in := mode.createEnvironment(config, []string{"B=b", "C=c", "P=/x", "Q=/y"})
+	out := []string{"A=a-b", "C=c", "P=/first:/x", "Q=/y:/last"}
+	if fmt.Sprintf("%v", in) != fmt.Sprintf("%v", out) {
+		t.Errorf("mode.createEnvironment(config, ...) = %v, want %v", in, out)
+	}
+}
+
+func TestCanCreateCleanClientEnvironment(t *testing.T) {
+	mode := new(ClientMode)
+	config := &util.Config{}
+	config.CleanEnvironment = true
+	config.AllowedEnvironmentVariables = []string{"PATH"}
+	config.EnvironmentVariables = []util.EnvironmentVariable{{Name: "X", Value: "${HOME}"}}
+
+	in := mode.createEnvironment(config, []string{"PATH=/bin", "HOME=/home/x", "OTHER=1"})
+	out := []string{"PATH=/bin", "X=/home/x"}
+	if fmt.Sprintf("%v", in) != fmt.Sprintf("%v", out) {
+		t.Errorf("mode.createEnvironment(config, ...) = %v, want %v", in, out)
+	}
+}
+
+func TestSensitiveEnvironmentValuesAreFiltered(t *testing.T) {
+	mode := new(ClientMode)
+	config := &util.Config{}
+	config.EnvironmentVariables = []util.EnvironmentVariable{{Name: "API_TOKEN", Value: "abc123"},
+		{Name: "NEXUS_KEY", Value: "n3xus", Sensitive: true}, {Name: "X", Value: "visible"}}
+
+	in := mode.createFilteredCommands("java", []string{"-Dtoken=abc123", "-DNEXUS_KEY=n3xus", "-Dx=visible", "-Dbuild=abc123"},
+		mode.getSensitiveNames(config)...)
+	out := []string{"java", "-Dtoken=***", "-DNEXUS_KEY=***", "-Dx=visible", "-Dbuild=abc123"}
+	if fmt.Sprintf("%v", in) != fmt.Sprintf("%v", out) {
+		t.Errorf("mode.createFilteredCommands(...) = %v, want %v", in, out)
+	}
+}
+
+func TestCrashSnapshotsAreWrittenAndPruned(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "crashes")
+	defer os.RemoveAll(dir)
+
+	config := &util.Config{}
+	config.CrashSnapshotsEnabled, config.CrashSnapshotDirectory, config.CrashSnapshotsToKeep = true, dir, 2
+
+	mode := NewClientMode()
+	mode.console = util.NewLineRingBuffer(10)
+	mode.console.Add("java.lang.OutOfMemoryError: Java heap space")
+
+	commands := mode.createFilteredCommands("java", []string{"-jar", "agent.jar", "-secret", "6319b6e88be1a627",
+		"-jnlpCredentials", "user:pass", "-proxyCredentials", "proxy:pass"})
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		mode.resetStopReason()
+		mode.recordStopCause(util.RestartReasonCrash)
+		now = now.Add(time.Millisecond * 10) // Snapshots written within the same second must not overwrite each other.
+		if path := mode.writeCrashSnapshot(config, commands, now.Add(-time.Hour), now); path == "" {
+			t.Fatalf("mode.writeCrashSnapshot(...) did not write a snapshot.")
+		} else if content, _ := ioutil.ReadFile(path); !regexp.MustCompile(`(?s)crash.+OutOfMemoryError`).Match(content) {
+			t.Errorf("Snapshot %v is missing stop reason or console lines: %s", path, content)
+		} else if regexp.MustCompile(`6319b6e88be1a627|pass`).Match(content) {
+			t.Errorf("Snapshot %v contains secrets of the command line: %s", path, content)
+		}
+	}
+
+	if snapshots, _ := filepath.Glob(filepath.Join(dir, "*")); len(snapshots) != 2 {
+		t.Errorf("Found %v snapshots, want 2", len(snapshots))
+	}
+
+	mode.resetStopReason()
+	mode.recordStopCause(util.RestartReasonManual)
+	if path := mode.writeCrashSnapshot(config, nil, now, now.Add(time.Minute)); path != "" {
+		t.Errorf("mode.writeCrashSnapshot(...) wrote %v for a manual restart.", path)
+	}
+}
+
+func TestThreadDumpIsCapturedFromConsole(t *testing.T) {
+	defer func(quiet, timeout time.Duration) { threadDumpQuietPeriod, threadDumpTimeout = quiet, timeout }(threadDumpQuietPeriod, threadDumpTimeout)
+	threadDumpQuietPeriod, threadDumpTimeout = time.Millisecond * 200, time.Second * 5
+
+	mode := NewClientMode()
+	content, err := mode.captureThreadDump(func() error {
+		go func() {
+			for _, line := range []string{"INFO: Connected", "Full thread dump OpenJDK 64-Bit Server VM:", `"main" #1 prio=5`} {
+				mode.currentCapture().add(line)
+			}
+		}()
+		return nil
+	})
+
+	if out := "Full thread dump OpenJDK 64-Bit Server VM:\n\"main\" #1 prio=5\n"; string(content) != out || err != nil {
+		t.Errorf("mode.captureThreadDump(...) = %q, %v, want %q, nil", content, err, out)
+	}
+
+	if mode.currentCapture() != nil {
+		t.Errorf("Console capture was not removed after the thread dump.")
+	}
+}
+
+func TestRemotingLogIsReadFromWorkDir(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "remoting")
+	defer os.RemoveAll(dir)
+
+	config := &util.Config{}
+	config.RemotingWorkDir = dir
+
+	logs := filepath.Join(dir, "remoting", "logs")
+	os.MkdirAll(logs, 0755)
+	ioutil.WriteFile(filepath.Join(logs, "remoting.log.0"), []byte("line 1\nline 2\nline 3\n"), 0644)
+
+	path, lines := NewClientMode().readRemotingLog(config, 2)
+	if out := filepath.Join(logs, "remoting.log.0"); path != out || fmt.Sprintf("%v", lines) != "[line 2 line 3]" {
+		t.Errorf("mode.readRemotingLog(config, 2) = %v, %v, want %v, [line 2 line 3]", path, lines, out)
+	}
+}
+
+func TestAgentsGetTheirOwnClientMode(t *testing.T) {
+	main, agent := util.NewDefaultConfig(), util.NewDefaultConfig()
+	agent.Agent = util.NewAgentState("docker", "")
+
+	if GetConfiguredMode(main) == GetConfiguredMode(agent) {
+		t.Errorf("GetConfiguredMode(...) returned the same mode for main config and agent 'docker'.")
+	}
+	if mode := GetConfiguredMode(agent).(*ClientMode); mode != GetConfiguredMode(agent) || mode.group != "client:docker" {
+		t.Errorf("GetConfiguredMode(agent) = %v (group %v), want the same instance with group client:docker", mode, mode.group)
+	}
+}
+
+func TestConnectionStateIsTrackedFromConsole(t *testing.T) {
+	mode := NewClientMode()
+	mode.status.Set(ModeConnecting)
+
+	for _, step := range []struct{ line string; status int32 }{
+		{"INFO: Locating server among [http://jenkins/ci/]", ModeConnecting},
+		{"INFO: Connected", ModeConnected},
+		{"INFO: Connected to 3 executors", ModeConnected},
+		{"INFO: Terminated", ModeConnecting},
+		{"INFO: Connecting to jenkins:50000", ModeConnecting},
+		{"Connected", ModeConnected},
+	} {
+		if mode.trackConnectionState(step.line); mode.status.Get() != step.status {
+			t.Errorf("Status after %q = %v, want %v", step.line, mode.status.Get(), step.status)
+		}
+	}
+}
+
+func TestConsoleRulesMatchLinesLongerThanTheReadBuffer(t *testing.T) {
+	defer func(delay time.Duration) { consoleRestartDelay = delay }(consoleRestartDelay)
+	consoleRestartDelay = 0
+
+	config := util.NewDefaultConfig()
+	config.ClientMonitorConsole, config.RestartTriggerTokens = true, []string{"OutOfMemoryError"}
+
+	mode := NewClientMode()
+	mode.status.Set(ModeConnected)
+
+	line := strings.Repeat("x", 4080) + " java.lang.OutOfMemoryError\n" // The token spans 2 reads.
+	mode.redirectConsoleOutput(context.Background(), config, ioutil.NopCloser(strings.NewReader(line)), ioutil.Discard, new(sync.Mutex))
+
+	for deadline := time.Now().Add(time.Second * 5); mode.status.Get() != ModeStopping && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if reason := mode.StopReason(); reason.Cause != util.RestartReasonConsoleToken {
+		t.Errorf("mode.StopReason().Cause = %v, want %v", reason.Cause, util.RestartReasonConsoleToken)
+	}
+}
+
+func TestRestartWhenIdleDoesNotStopALaterRun(t *testing.T) {
+	defer func(interval time.Duration) { consoleIdlePollInterval = interval }(consoleIdlePollInterval)
+	consoleIdlePollInterval = time.Millisecond * 10
+
+	config := util.NewDefaultConfig()
+	mode := NewClientMode()
+	mode.status.Set(ModeConnected)
+
+	run, endRun := context.WithCancel(context.Background())
+	mode.performConsoleRuleAction(run, config, util.ConsoleRule{Action: util.ConsoleActionRestartWhenIdle}, "")
+
+	endRun()
+	config.State().NodeIsIdle.Set(true)
+	time.Sleep(consoleIdlePollInterval * 5)
+
+	if reason := mode.StopReason(); reason.Cause != "" || mode.status.Get() != ModeConnected {
+		t.Errorf("mode.StopReason().Cause = %v, want the next run to keep running", reason.Cause)
+	}
+}
+
+func TestConnectTimeoutAppliesUntilConnected(t *testing.T) {
+	mode, config := NewClientMode(), &util.Config{}
+
+	mode.status.Set(ModeConnecting)
+	if mode.connectTimeout(config) != nil {
+		t.Errorf("mode.connectTimeout(config) != nil without a configured timeout")
+	}
+
+	config.ClientConnectTimeoutSeconds = 60
+	if mode.connectTimeout(config) == nil {
+		t.Errorf("mode.connectTimeout(config) = nil while connecting")
+	}
+
+	mode.status.Set(ModeConnected)
+	if mode.connectTimeout(config) != nil {
+		t.Errorf("mode.connectTimeout(config) != nil when connected")
+	}
+}
+
+func TestModeContextCancelsThePreviousRun(t *testing.T) {
+	mode := new(modeContext)
+	first := mode.startContext(context.Background())
+	second := mode.startContext(context.Background())
+
+	if first.Err() == nil || second.Err() != nil {
+		t.Errorf("first.Err() = %v, second.Err() = %v; want only the first run to be cancelled", first.Err(), second.Err())
+	}
+}
+
+func TestListenersAreNotifiedAboutStopWhenTheStartIsAborted(t *testing.T) {
+	config := util.NewDefaultConfig()
+	config.Agent = util.NewAgentState("aborted", "")
+
+	statuses := []string{}
+	RegisterModeListenerFor(config, func(mode ExecutableMode, nextStatus int32, config *util.Config, reason *StopReason) {
+		if nextStatus == ModeStarting {
+			AbortStart(mode, fmt.Errorf("aborted by test"))
+		}
+		statuses = append(statuses, StatusName(nextStatus))
+		if reason != nil { statuses = append(statuses, reason.Cause) }
+	})
+
+	RunConfiguredMode(context.Background(), config)
+
+	if out := fmt.Sprint([]string{StatusName(ModeStarting), StatusName(ModeStopped), util.RestartReasonStartAborted}); fmt.Sprint(statuses) != out {
+		t.Errorf("Listener was notified about %v, want %v", statuses, out)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package modes
+
+import (
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Returns true if the client environment is customized within the specified config.
+func (self *ClientMode) hasCustomEnvironment(config *util.Config) bool {
+	return config.CleanEnvironment || len(config.EnvironmentVariables) > 0
+}
+
+// Creates the environment ("name=value") of the client process by applying the configured
+// modifications on the given base environment (usually "os.Environ()").
+func (self *ClientMode) createEnvironment(config *util.Config, baseEnvironment []string) []string {
+	base, names := map[string]string{}, map[string]string{}
+	for _, entry := range baseEnvironment {
+		if pair := strings.SplitN(entry, "=", 2); len(pair) == 2 {
+			base[self.environmentKey(pair[0])], names[self.environmentKey(pair[0])] = pair[1], pair[0]
+		}
+	}
+
+	values := base
+	if config.CleanEnvironment {
+		values = map[string]string{}
+		for _, name := range config.AllowedEnvironmentVariables {
+			if value, found := base[self.environmentKey(name)]; found {
+				values[self.environmentKey(name)] = value
+			}
+		}
+	}
+
+	expand := func(value string) string {
+		return os.Expand(value, func(name string) string {
+			if value, found := values[self.environmentKey(name)]; found {
+				return value
+			}
+			return base[self.environmentKey(name)]
+		})
+	}
+
+	for _, variable := range config.EnvironmentVariables {
+		key := self.environmentKey(variable.Name)
+		if key == "" {
+			continue
+		}
+
+		if _, found := names[key]; !found {
+			names[key] = variable.Name
+		}
+
+		separator := variable.Separator
+		if separator == "" {
+			separator = string(os.PathListSeparator)
+		}
+
+		value := expand(variable.Value)
+		current, exists := values[key]
+
+		switch strings.ToLower(variable.Action) {
+		case util.EnvironmentActionUnset:
+			delete(values, key)
+		case util.EnvironmentActionPrepend:
+			if exists && current != "" {
+				value = value + separator + current
+			}
+			values[key] = value
+		case util.EnvironmentActionAppend:
+			if exists && current != "" {
+				value = current + separator + value
+			}
+			values[key] = value
+		default:
+			values[key] = value
+		}
+	}
+
+	environment := make([]string, 0, len(values))
+	for key, value := range values {
+		environment = append(environment, names[key] + "=" + value)
+	}
+	sort.Strings(environment)
+
+	return environment
+}
+
+// Returns the names of all variables whose values must not appear in console output.
+func (self *ClientMode) getSensitiveNames(config *util.Config) (names []string) {
+	for _, variable := range config.EnvironmentVariables {
+		if variable.IsSensitive() {
+			names = append(names, variable.Name)
+		}
+	}
+	return
+}
+
+// Returns a printable list of the configured environment modifications with sensitive values masked.
+func (self *ClientMode) describeEnvironmentChanges(config *util.Config) (changes []string) {
+	for _, variable := range config.EnvironmentVariables {
+		action := strings.ToLower(variable.Action)
+		if action == "" { action = util.EnvironmentActionSet }
+
+		value := variable.Value
+		if variable.IsSensitive() { value = "***" }
+
+		if action == util.EnvironmentActionUnset {
+			changes = append(changes, action + " " + variable.Name)
+		} else {
+			changes = append(changes, action + " " + variable.Name + "=" + value)
+		}
+	}
+
+	if config.CleanEnvironment {
+		changes = append([]string{"clean (allowed: " + strings.Join(config.AllowedEnvironmentVariables, ", ") + ")"}, changes...)
+	}
+	return
+}
+
+// Returns the key that is used to identify environment variables (which are case insensitive on windows).
+func (self *ClientMode) environmentKey(name string) string {
+	if runtime.GOOS == "windows" {
+		return strings.ToUpper(name)
+	}
+	return name
+}
@@ -0,0 +1,47 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package modes
+
+import (
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+	"regexp"
+	"time"
+)
+
+var (
+	// Matches status lines that remoting prints once the connection with Jenkins is established.
+	remotingConnectedPattern = regexp.MustCompile(`(?:^|: )Connected\s*$`)
+	// Matches status lines that remoting prints while (re)connecting or after the connection was lost.
+	remotingConnectingPattern = regexp.MustCompile(`(?:^|: )(?:Locating server|Connecting to |Trying protocol|Terminated\s*$)`)
+)
+
+// Updates the connection state of the running client from a line of its console output.
+func (self *ClientMode) trackConnectionState(line string) {
+	changed := false
+	if remotingConnectedPattern.MatchString(line) {
+		if changed = self.status.CompareAndSet(ModeConnecting, ModeConnected); changed {
+			util.GOut(self.group, "Jenkins client is connected.")
+		}
+	} else if remotingConnectingPattern.MatchString(line) {
+		if changed = self.status.CompareAndSet(ModeConnected, ModeConnecting); changed {
+			util.GOut(self.group, "WARN: Jenkins client lost the connection, waiting for it to reconnect.")
+		}
+	}
+
+	if changed {
+		select {
+		case self.connectionChanged <- true:
+		default:
+		}
+	}
+}
+
+// Returns a channel that receives a value when the configured connect timeout elapsed
+// or nil if the client is connected or no timeout is configured.
+func (self *ClientMode) connectTimeout(config *util.Config) <-chan time.Time {
+	if config.ClientConnectTimeoutSeconds <= 0 || self.status.Get() == ModeConnected {
+		return nil
+	}
+	return time.After(time.Second * time.Duration(config.ClientConnectTimeoutSeconds))
+}
@@ -0,0 +1,78 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package modes
+
+import (
+	"context"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The time after which console rule hook commands are killed.
+var consoleHookTimeout = time.Minute * 5
+
+// The delay before the client is restarted by a console rule (gives the client time to write more output).
+var consoleRestartDelay = time.Second * 1
+
+// The interval in which the IDLE state is checked before restarting the client by a console rule.
+var consoleIdlePollInterval = time.Second * 30
+
+// Returns true if the console rule action restarts the client.
+func isConsoleRestartAction(action string) bool {
+	return action == util.ConsoleActionRestart || action == util.ConsoleActionRestartWhenIdle || action == ""
+}
+
+// Performs the action of a console rule that was triggered by the given line of the run that ends with ctx.
+// Returns true if the action restarts the client. Restarts are skipped when the run ended in the meantime.
+func (self *ClientMode) performConsoleRuleAction(ctx context.Context, config *util.Config, rule util.ConsoleRule, line string) (restarts bool) {
+	switch rule.Action {
+	case util.ConsoleActionRestart, "":
+		go func() {
+			if util.Sleep(ctx, consoleRestartDelay) {
+				util.GOut("console", "WARN: %s found in console output. Client state may be invalid, forced a restart.", rule.Pattern)
+				self.Stop(util.RestartReasonConsoleToken)
+			}
+		}()
+		return true
+
+	case util.ConsoleActionRestartWhenIdle:
+		util.GOut("console", "WARN: %s found in console output. Restarting the client when the node is IDLE.", rule.Pattern)
+		go func() {
+			for !config.State().NodeIsIdle.Get() {
+				if !util.Sleep(ctx, consoleIdlePollInterval) {
+					return
+				}
+			}
+			if ctx.Err() == nil {
+				self.Stop(util.RestartReasonConsoleToken)
+			}
+		}()
+		return true
+
+	case util.ConsoleActionMarkOffline:
+		message := fmt.Sprintf(util.OfflineMessagePrefix + "Console output matched '%s': %s", rule.Pattern, strings.TrimSpace(line))
+		util.GOut("console", "WARN: %s found in console output. Marking the node offline in Jenkins.", rule.Pattern)
+		go func() {
+			if err := config.SetNodeTemporarilyOffline(config.ClientName, true, message); err != nil {
+				util.GOut("console", "ERROR: Failed marking the node offline in Jenkins. Cause: %v", err)
+			}
+		}()
+
+	case util.ConsoleActionHook:
+		util.GOut("console", "WARN: %s found in console output. Running: %s", rule.Pattern, rule.Command)
+		go func() {
+			environment := []string{"JCL_NODE_NAME=" + config.ClientName, "JCL_CONSOLE_LINE=" + line}
+			if err := util.RunShellCommand("console", rule.Command, environment, consoleHookTimeout); err != nil {
+				util.GOut("console", "WARN: Command '%s' failed: %v", rule.Command, err)
+			}
+		}()
+
+	default:
+		util.GOut("console", "WARN: %s found in console output: %s", rule.Pattern, strings.TrimSpace(line))
+	}
+
+	return false
+}
@@ -0,0 +1,89 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package modes
+
+import (
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Is the prefix of crash snapshot file names.
+const crashSnapshotPrefix = "crash-"
+
+// Writes a snapshot of the last console lines and the stop reason of the client when
+// the client stopped without being asked to. Returns the path of the snapshot or "" if none was written.
+func (self *ClientMode) writeCrashSnapshot(config *util.Config, commands []string, started, stopped time.Time) string {
+	reason := self.StopReason()
+	if !config.CrashSnapshotsEnabled || self.console == nil || util.IsRequestedRestartReason(reason.Cause) {
+		return ""
+	}
+
+	directory := config.State().Path(config.CrashSnapshotDirectory)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		util.GOut(self.group, "ERROR: Failed creating crash snapshot directory %v. Cause: %v", directory, err)
+		return ""
+	}
+
+	content := &bytes.Buffer{}
+	fmt.Fprintf(content, "Node:         %v\n", config.ClientName)
+	fmt.Fprintf(content, "Stop reason:  %v\n", reason.Cause)
+	fmt.Fprintf(content, "Exit code:    %v\n", reason.ExitCode)
+	fmt.Fprintf(content, "Signal:       %v\n", reason.Signal)
+	fmt.Fprintf(content, "Started:      %v\n", started.Format(time.RFC3339))
+	fmt.Fprintf(content, "Stopped:      %v\n", stopped.Format(time.RFC3339))
+	fmt.Fprintf(content, "Uptime:       %v\n", stopped.Sub(started))
+	fmt.Fprintf(content, "Command line: %s\n", strings.Join(commands, " "))
+	fmt.Fprintf(content, "\n---- Last %v lines of console output ----\n", len(self.console.Lines()))
+	for _, line := range self.console.Lines() {
+		content.WriteString(line)
+		content.WriteString("\n")
+	}
+
+	if remotingLog, lines := self.readRemotingLog(config, config.CrashSnapshotLines); remotingLog != "" {
+		fmt.Fprintf(content, "\n---- Last %v lines of %v ----\n", len(lines), remotingLog)
+		for _, line := range lines {
+			content.WriteString(line)
+			content.WriteString("\n")
+		}
+	}
+
+	path := filepath.Join(directory, crashSnapshotPrefix + stopped.Format("20060102-150405.000") + ".log")
+	if err := ioutil.WriteFile(path, content.Bytes(), 0600); err != nil {
+		util.GOut(self.group, "ERROR: Failed writing crash snapshot %v. Cause: %v", path, err)
+		return ""
+	}
+
+	util.GOut(self.group, "Crash snapshot was written to %v", path)
+	pruneFiles(filepath.Join(directory, crashSnapshotPrefix + "*.log"), config.CrashSnapshotsToKeep)
+
+	return path
+}
+
+// Removes the oldest files matching the glob pattern exceeding the number of files to keep.
+// The file names must contain a sortable timestamp.
+func pruneFiles(pattern string, keep int) {
+	if keep <= 0 {
+		return
+	}
+
+	files, err := filepath.Glob(pattern)
+	if err != nil || len(files) <= keep {
+		return
+	}
+
+	// Names contain the timestamp, sorting them sorts by age.
+	sort.Strings(files)
+	for _, path := range files[:len(files) - keep] {
+		if err := os.Remove(path); err != nil {
+			util.GOut("client", "WARN: Failed removing %v. Cause: %v", path, err)
+		}
+	}
+}
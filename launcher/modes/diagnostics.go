@@ -0,0 +1,212 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package modes
+
+import (
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Is the prefix of thread dump file names.
+	threadDumpPrefix = "threaddump-"
+	// Is the prefix of heap histogram file names.
+	heapHistogramPrefix = "heaphisto-"
+	// Is the prefix of file names containing a copy of the remoting log.
+	remotingLogPrefix = "remoting-"
+	// Is the number of remoting log lines that are included in diagnostics.
+	remotingLogLines = 1000
+	// Limits the number of console lines that are captured for a single thread dump.
+	maxCapturedLines = 100000
+)
+
+// Defines how long to wait for the JVM to print a thread dump to the console.
+var threadDumpQuietPeriod, threadDumpTimeout = time.Second * 2, time.Second * 20
+
+// Collects the thread dump and heap histogram of the running client as enabled in the config.
+func (self *ClientMode) CollectDiagnostics(config *util.Config) (paths []string) {
+	pid := self.Pid()
+	if pid <= 0 {
+		return
+	}
+
+	if config.ThreadDumpBeforeRestart {
+		util.GOut(self.group, "Creating a thread dump of the Jenkins client (pid %v).", pid)
+		if content, err := self.requestThreadDump(config.State().Java, pid); err == nil {
+			if path := self.writeDiagnostics(config, threadDumpPrefix, content); path != "" {
+				paths = append(paths, path)
+			}
+		} else {
+			util.GOut(self.group, "WARN: Failed creating a thread dump of the Jenkins client. Cause: %v", err)
+		}
+	}
+
+	if config.HeapHistogramBeforeRestart {
+		util.GOut(self.group, "Creating a heap histogram of the Jenkins client (pid %v).", pid)
+		if content, err := runJcmd(config.State().Java, pid, "GC.class_histogram"); err == nil {
+			if path := self.writeDiagnostics(config, heapHistogramPrefix, content); path != "" {
+				paths = append(paths, path)
+			}
+		} else {
+			util.GOut(self.group, "WARN: Failed creating a heap histogram of the Jenkins client. Cause: %v", err)
+		}
+	}
+
+	if path, lines := self.readRemotingLog(config, remotingLogLines); path != "" {
+		content := "---- " + path + " ----\n" + strings.Join(lines, "\n") + "\n"
+		if path := self.writeDiagnostics(config, remotingLogPrefix, []byte(content)); path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	self.recordDiagnostics(paths...)
+	return
+}
+
+// Returns the path and the last lines of the newest remoting log or "" if there is none.
+func (self *ClientMode) readRemotingLog(config *util.Config, maxLines int) (path string, lines []string) {
+	directory := config.RemotingLogsPath()
+	if directory == "" {
+		return
+	}
+
+	logs, _ := filepath.Glob(filepath.Join(directory, "remoting.log*"))
+	var newest time.Time
+	for _, log := range logs {
+		if info, err := os.Stat(log); err == nil && !info.IsDir() && info.ModTime().After(newest) {
+			path, newest = log, info.ModTime()
+		}
+	}
+
+	if path == "" {
+		return
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil
+	}
+
+	lines = strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	if len(lines) > maxLines {
+		lines = lines[len(lines) - maxLines:]
+	}
+	return
+}
+
+// Writes the content to a timestamped file inside the diagnostics directory and returns its path ("" on failure).
+func (self *ClientMode) writeDiagnostics(config *util.Config, prefix string, content []byte) string {
+	directory := config.State().Path(config.DiagnosticsDirectory)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		util.GOut(self.group, "ERROR: Failed creating diagnostics directory %v. Cause: %v", directory, err)
+		return ""
+	}
+
+	path := filepath.Join(directory, prefix + time.Now().Format("20060102-150405.000") + ".log")
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		util.GOut(self.group, "ERROR: Failed writing %v. Cause: %v", path, err)
+		return ""
+	}
+
+	util.GOut(self.group, "Diagnostics were written to %v", path)
+	pruneFiles(filepath.Join(directory, prefix + "*.log"), config.DiagnosticsToKeep)
+
+	return path
+}
+
+// Captures the thread dump that the JVM prints to the console after being asked for it by "request".
+func (self *ClientMode) captureThreadDump(request func() error) ([]byte, error) {
+	capture := &consoleCapture{}
+	self.setCapture(capture)
+	defer self.setCapture(nil)
+
+	if err := request(); err != nil {
+		return nil, err
+	}
+
+	lines := capture.await(threadDumpQuietPeriod, threadDumpTimeout)
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("No thread dump appeared in the console output within %v.", threadDumpTimeout)
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+func (self *ClientMode) setCapture(capture *consoleCapture) {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	self.capture = capture
+}
+
+func (self *ClientMode) currentCapture() *consoleCapture {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	return self.capture
+}
+
+// Runs "jcmd" (next to the given java executable or from PATH) with the given command
+// against the JVM with the specified pid and returns its output.
+func runJcmd(java string, pid int, command ...string) ([]byte, error) {
+	name := "jcmd"
+	if runtime.GOOS == "windows" { name += ".exe" }
+
+	jcmd := filepath.Join(filepath.Dir(java), name)
+	if _, err := os.Stat(jcmd); err != nil {
+		if jcmd, err = exec.LookPath(name); err != nil {
+			return nil, fmt.Errorf("jcmd was not found (requires a JDK).")
+		}
+	}
+
+	output, err := exec.Command(jcmd, append([]string{strconv.Itoa(pid)}, command...)...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, bytes.TrimSpace(output))
+	}
+	return output, nil
+}
+
+// Collects console lines starting with the header of a Java thread dump.
+type consoleCapture struct {
+	mutex   sync.Mutex
+	lines   []string
+	started bool
+	updated time.Time
+}
+
+func (self *consoleCapture) add(line string) {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	if !self.started {
+		if !strings.HasPrefix(line, "Full thread dump") {
+			return
+		}
+		self.started = true
+	}
+
+	if len(self.lines) < maxCapturedLines {
+		self.lines = append(self.lines, line)
+	}
+	self.updated = time.Now()
+}
+
+// Waits until the thread dump started and no new lines were added for "quietPeriod" or "timeout" elapsed
+// and returns the captured lines.
+func (self *consoleCapture) await(quietPeriod, timeout time.Duration) []string {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(time.Millisecond * 100) {
+		self.mutex.Lock()
+		done := self.started && time.Since(self.updated) >= quietPeriod
+		self.mutex.Unlock()
+
+		if done { break }
+	}
+
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	return append([]string{}, self.lines...)
+}
@@ -0,0 +1,17 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+// +build !windows
+
+package modes
+
+import (
+	"syscall"
+)
+
+// Asks the JVM to print a thread dump to its console (SIGQUIT) and captures it.
+func (self *ClientMode) requestThreadDump(java string, pid int) ([]byte, error) {
+	return self.captureThreadDump(func() error {
+		return syscall.Kill(pid, syscall.SIGQUIT)
+	})
+}
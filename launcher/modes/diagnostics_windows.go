@@ -0,0 +1,9 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package modes
+
+// Creates a thread dump using "jcmd" as windows offers no signal to request it.
+func (self *ClientMode) requestThreadDump(java string, pid int) ([]byte, error) {
+	return runJcmd(java, pid, "Thread.print")
+}
@@ -5,9 +5,11 @@ package modes
 
 import (
 	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+	"context"
+	"fmt"
 	"os"
-	"os/signal"
-	"time"
+	"sync"
+	"syscall"
 )
 
 const (
@@ -16,10 +18,64 @@ const (
 	ModeStarted
 	ModeStopping
 	ModeStopped
+	// The process of the mode runs but is not (yet) connected with Jenkins (client mode only).
+	ModeConnecting
+	// The process of the mode runs and is connected with Jenkins (client mode only).
+	ModeConnected
 )
 
+var statusNames = []string{"none", "starting", "started", "stopping", "stopped", "connecting", "connected"}
+
+// Returns the name of the status (e.g. "connected").
+func StatusName(status int32) string {
+	if status >= 0 && int(status) < len(statusNames) {
+		return statusNames[status]
+	}
+	return fmt.Sprintf("unknown(%d)", status)
+}
+
+// Returns true if the status describes a mode that runs (ModeStarted, ModeConnecting or ModeConnected).
+func IsRunning(status int32) bool {
+	return status == ModeStarted || status == ModeConnecting || status == ModeConnected
+}
+
+// Returns true if the status describes a mode that runs and is usable (ModeStarted or ModeConnected).
+func IsConnected(status int32) bool {
+	return status == ModeStarted || status == ModeConnected
+}
+
+// Marks a mode that is connecting as connected (e.g. when Jenkins shows the node online)
+// and returns true if the status was changed.
+func MarkConnected(mode ExecutableMode) bool {
+	return mode.Status().CompareAndSet(ModeConnecting, ModeConnected)
+}
+
+// Describes why a mode stopped.
+type StopReason struct {
+	// Is the cause of the stop (one of util.RestartReason*).
+	Cause    string
+	// Is the exit code of the process that was run by the mode (-1 if not available).
+	ExitCode int
+	// Is the name of the signal that terminated the process (empty if not terminated by a signal).
+	Signal   string
+	// Contains the paths of diagnostic files (crash snapshots, thread or heap dumps) related to the stop.
+	Diagnostics []string
+}
+
+// Returns a one line summary of the stop reason.
+func (self *StopReason) String() string {
+	if self.Signal != "" {
+		return fmt.Sprintf("%s (signal: %s)", self.Cause, self.Signal)
+	} else if self.ExitCode >= 0 {
+		return fmt.Sprintf("%s (exit code: %d)", self.Cause, self.ExitCode)
+	}
+	return self.Cause
+}
+
 // Defines a callback that is notified when a mode is before start, started or stopped.
-type ExecutableModeListener func(mode ExecutableMode, nextStatus int32, config *util.Config)
+// "reason" is only set when nextStatus is ModeStopped and is nil otherwise.
+// Every ModeStarting is followed by ModeStopped, also when the start was aborted or failed.
+type ExecutableModeListener func(mode ExecutableMode, nextStatus int32, config *util.Config, reason *StopReason)
 
 // Defines an interface for implementations of a run mode of this util.
 type ExecutableMode interface {
@@ -29,10 +85,141 @@ util.ConfigVerifier
 	Name() (string)
 	// Returns the status of the mode.
 	Status() (*util.AtomicInt32)
-	// Start the mode and returns after the mode has been started.
-	Start(config *util.Config) (error)
-	// Stops the mode.
-	Stop()
+	// Starts the mode and returns a handle that signals when the mode stopped.
+	// The mode stops when Stop is called or when the context is done.
+	Start(ctx context.Context, config *util.Config) (*ModeHandle, error)
+	// Stops the mode, "cause" describes why the mode is stopped (one of util.RestartReason*).
+	Stop(cause string)
+	// Returns the reason of the last stop.
+	StopReason() (StopReason)
+}
+
+// Is implemented by modes that can run more than one agent at the same time.
+type InstantiableMode interface {
+	// Returns a new instance of the mode that runs the agent of the specified config.
+	NewInstance(config *util.Config) (ExecutableMode)
+}
+
+// Is implemented by modes that run an external process.
+type ProcessRunner interface {
+	// Returns the process id of the running process or 0 if no process is running.
+	Pid() (int)
+}
+
+// Is implemented by modes that can collect diagnostics (e.g. thread dumps) of the process they run.
+type DiagnosticsCollector interface {
+	// Collects the diagnostics that are enabled within the config and returns the paths of the written files.
+	// The paths are also added to the next StopReason.
+	CollectDiagnostics(config *util.Config) ([]string)
+}
+
+// Is returned when a mode was started and signals when the mode stopped.
+type ModeHandle struct {
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func newModeHandle() *ModeHandle {
+	return &ModeHandle{done: make(chan struct{})}
+}
+
+// Returns a channel that is closed when the mode stopped.
+func (self *ModeHandle) Done() <-chan struct{} {
+	return self.done
+}
+
+// Returns the error that stopped the mode (nil if the mode stopped regularly or is still running).
+func (self *ModeHandle) Err() error {
+	select {
+	case <-self.done:
+		return self.err
+	default:
+		return nil
+	}
+}
+
+// Marks the mode as stopped with the specified error (may be nil).
+func (self *ModeHandle) finish(err error) {
+	self.once.Do(func() {
+		self.err = err
+		close(self.done)
+	})
+}
+
+// Helper to use by modes to run with a context that is cancelled by Stop.
+type modeContext struct {
+	contextMutex sync.Mutex
+	cancel       context.CancelFunc
+}
+
+// Creates the context that a mode runs with, to be called when the mode starts.
+// The context of the previous run is cancelled (releasing its resources).
+func (self *modeContext) startContext(parent context.Context) context.Context {
+	self.contextMutex.Lock(); defer self.contextMutex.Unlock()
+	if self.cancel != nil {
+		self.cancel()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	self.cancel = cancel
+	return ctx
+}
+
+// Cancels the context of the running mode (if any).
+func (self *modeContext) cancelContext() {
+	self.contextMutex.Lock(); defer self.contextMutex.Unlock()
+	if self.cancel != nil {
+		self.cancel()
+	}
+}
+
+// Helper to use by modes to keep track of why they stopped.
+type stopReasonRecorder struct {
+	mutex  sync.Mutex
+	reason StopReason
+}
+
+// Clears the recorded stop reason (to be called when the mode starts).
+func (self *stopReasonRecorder) resetStopReason() {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	self.reason = StopReason{ExitCode: -1}
+}
+
+// Records the cause of a stop request, the first cause that is recorded wins.
+func (self *stopReasonRecorder) recordStopCause(cause string) {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	if self.reason.Cause == "" {
+		self.reason.Cause = cause
+	}
+}
+
+// Records the exit code and signal of a process that was run by the mode.
+// The cause is set to util.RestartReasonCrash if the mode wasn't asked to stop.
+func (self *stopReasonRecorder) recordProcessExit(state *os.ProcessState) {
+	self.recordStopCause(util.RestartReasonCrash)
+	if state == nil {
+		return
+	}
+
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	if status, ok := state.Sys().(syscall.WaitStatus); ok {
+		if status.Signaled() {
+			self.reason.Signal = status.Signal().String()
+		} else {
+			self.reason.ExitCode = status.ExitStatus()
+		}
+	}
+}
+
+// Records the paths of diagnostic files that were collected while the mode was running or stopping.
+func (self *stopReasonRecorder) recordDiagnostics(paths ...string) {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	self.reason.Diagnostics = append(self.reason.Diagnostics, paths...)
+}
+
+func (self *stopReasonRecorder) StopReason() StopReason {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	return self.reason
 }
 
 var AllModes = []ExecutableMode{}
@@ -44,75 +231,130 @@ func RegisterMode(mode ExecutableMode) ExecutableMode {
 }
 
 var allModeListeners = []ExecutableModeListener{}
+var allModeListenersMutex sync.Mutex
 
 // Registers a mode listener.
 func RegisterModeListener(listener ExecutableModeListener) ExecutableModeListener {
+	allModeListenersMutex.Lock(); defer allModeListenersMutex.Unlock()
 	allModeListeners = append(allModeListeners, listener)
 	return listener
 }
 
-func callListeners(mode ExecutableMode, nextStatus int32, config *util.Config) {
-	for _, listener := range allModeListeners {
-		listener(mode, nextStatus, config)
+// Registers a mode listener that is only notified about the mode running the agent of the specified config.
+func RegisterModeListenerFor(config *util.Config, listener ExecutableModeListener) ExecutableModeListener {
+	agent := config.State()
+	return RegisterModeListener(func(mode ExecutableMode, nextStatus int32, config *util.Config, reason *StopReason) {
+		if config.State() == agent {
+			listener(mode, nextStatus, config, reason)
+		}
+	})
+}
+
+func callListeners(mode ExecutableMode, nextStatus int32, config *util.Config, reason *StopReason) {
+	allModeListenersMutex.Lock()
+	listeners := allModeListeners[:]
+	allModeListenersMutex.Unlock()
+
+	for _, listener := range listeners {
+		listener(mode, nextStatus, config, reason)
 	}
 }
 
+var agentModes = map[*util.AgentState]ExecutableMode{}
+var agentModesMutex sync.Mutex
+
 // Returns the mode that is activated within the specified config instance.
+// Additional agents get their own instance of the mode if the mode implements InstantiableMode.
 func GetConfiguredMode(config *util.Config) ExecutableMode {
 	for _, mode := range AllModes {
 		if config.RunMode == mode.Name() {
+			if instantiable, ok := mode.(InstantiableMode); ok && config.State().Name != "" {
+				agentModesMutex.Lock(); defer agentModesMutex.Unlock()
+				if _, found := agentModes[config.State()]; !found {
+					agentModes[config.State()] = instantiable.NewInstance(config)
+				}
+				return agentModes[config.State()]
+			}
 			return mode
 		}
 	}
 	panic("The configured mode '" + config.RunMode + "' is not implemented.")
 }
 
-// Runs the mode that is activated within the specified config instance,
-// returning false if the mode stopped due to a kill or interrupt and true when the mode stopped due to an error.
-func RunConfiguredMode(config *util.Config) bool {
-	exitRequested := make(chan bool, 2)
+var startAbortCauses = map[ExecutableMode]error{}
+var startAbortMutex = &sync.Mutex{}
+
+// Aborts the start of a mode, to be called by listeners while they are notified about ModeStarting.
+func AbortStart(mode ExecutableMode, cause error) {
+	startAbortMutex.Lock(); defer startAbortMutex.Unlock()
+	if startAbortCauses[mode] == nil {
+		startAbortCauses[mode] = cause
+	}
+}
+
+// Returns the cause given with AbortStart (if any) and clears it.
+func takeStartAbortCause(mode ExecutableMode) (cause error) {
+	startAbortMutex.Lock(); defer startAbortMutex.Unlock()
+	cause = startAbortCauses[mode]
+	delete(startAbortCauses, mode)
+	return
+}
+
+// Stops the mode that is activated within the specified config instance, using the given cause (one of util.RestartReason*).
+func StopConfiguredMode(config *util.Config, cause string) {
+	GetConfiguredMode(config).Stop(cause)
+}
+
+// Collects diagnostics of the mode that is activated within the specified config instance (if supported)
+// and stops it afterwards. To be used when the mode appears to hang.
+func StopConfiguredModeWithDiagnostics(config *util.Config, cause string) {
+	mode := GetConfiguredMode(config)
+	if collector, ok := mode.(DiagnosticsCollector); ok && IsRunning(mode.Status().Get()) {
+		collector.CollectDiagnostics(config)
+	}
+	mode.Stop(cause)
+}
 
+// Runs the mode that is activated within the specified config instance until it stopped, returning false if
+// the mode stopped as the context is done (e.g. on kill or interrupt) and true when the mode should be restarted.
+// The second return value describes why the mode stopped.
+func RunConfiguredMode(ctx context.Context, config *util.Config) (bool, *StopReason) {
 	// Getting the configured run mode
 	executableMode := GetConfiguredMode(config)
-	util.Out("Starting mode %v", executableMode.Name())
-	callListeners(executableMode, ModeStarting, config)
-	err := executableMode.Start(config)
+	name := executableMode.Name()
+	if config.State().Name != "" { name += " (agent " + config.State().Name + ")" }
 
-	if err != nil {
-		util.Out("ERROR: Failed to start mode '%v'; Cause: %v", executableMode.Name(), err)
-		return false
-	} else {
-		callListeners(executableMode, ModeStarted, config)
-		defer callListeners(executableMode, ModeStopped, config)
+	util.Out("Starting mode %v", name)
+	takeStartAbortCause(executableMode)
+	callListeners(executableMode, ModeStarting, config, nil)
+
+	if cause := takeStartAbortCause(executableMode); cause != nil {
+		util.Out("ERROR: Start of mode '%v' was aborted; Cause: %v", name, cause)
+		reason := StopReason{Cause: util.RestartReasonStartAborted, ExitCode: -1}
+		callListeners(executableMode, ModeStopped, config, &reason)
+		return true, &reason
 	}
 
-	// Waiting on Interrupt or Kill and stop the run mode when received.
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt, os.Kill)
+	handle, err := executableMode.Start(ctx, config)
 
-	go func() {
-		sig := <-signals // This channel receives only Interrupt or Kill and blocks until one is received.
-		util.Out("Received signal: %v, stopping...", sig)
-		exitRequested <- true
-		if executableMode.Status().Get() != ModeStopped {
-			executableMode.Stop()
-		}
-	}()
+	if err != nil {
+		util.Out("ERROR: Failed to start mode '%v'; Cause: %v", name, err)
+		reason := StopReason{Cause: util.RestartReasonCrash, ExitCode: -1}
+		callListeners(executableMode, ModeStopped, config, &reason)
+		return false, &reason
+	} else {
+		callListeners(executableMode, ModeStarted, config, nil)
+	}
 
-	util.Out("STARTED mode %v", executableMode.Name())
+	util.Out("STARTED mode %v", name)
 
-	// Waiting for the run mode to stop
-	for executableMode.Status().Get() != ModeStopped {
-		time.Sleep(time.Millisecond * 100)
-	}
-	exitRequested <- false
-	signals <- os.Interrupt
+	// Waiting for the run mode to stop (it stops by itself when the context is done).
+	<-handle.Done()
 
-	util.Out("STOPPED mode %v", executableMode.Name())
+	reason := executableMode.StopReason()
+	util.Out("STOPPED mode %v, reason: %v", name, reason.String())
+	callListeners(executableMode, ModeStopped, config, &reason)
 
 	// Returning true if we want to re-run.
-	isExistRequested := <-exitRequested
-	<-exitRequested
-
-	return !isExistRequested
+	return ctx.Err() == nil, &reason
 }
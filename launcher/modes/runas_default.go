@@ -0,0 +1,167 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+// +build !windows
+
+package modes
+
+import (
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// Describes the user and groups that the client process runs as.
+type runAsCredential struct {
+	user   *user.User
+	uid    uint32
+	gid    uint32
+	groups []uint32
+}
+
+// Checks that the launcher is privileged to start processes as the configured user.
+func (self *ClientMode) checkRunAsPrivileges(config *util.Config) error {
+	credential, err := self.lookupRunAsCredential(config)
+	if err != nil {
+		return err
+	}
+
+	if os.Geteuid() != 0 && uint32(os.Geteuid()) != credential.uid {
+		return fmt.Errorf("The launcher runs as uid %v and lacks the privileges to switch to uid %v (root is required).", os.Geteuid(), credential.uid)
+	}
+	return nil
+}
+
+// Configures the command to run as the configured user, hands over the paths the client needs
+// and returns the base environment with HOME, USER and LOGNAME of the user.
+func (self *ClientMode) applyRunAs(config *util.Config, command *exec.Cmd, environment []string) ([]string, error) {
+	if err := self.checkRunAsPrivileges(config); err != nil {
+		return environment, err
+	}
+
+	credential, err := self.lookupRunAsCredential(config)
+	if err != nil {
+		return environment, err
+	}
+
+	command.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: credential.uid, Gid: credential.gid, Groups: credential.groups},
+	}
+
+	// The client must be able to read the jar and the JNLP file (which contains the secret and is therefore handed over).
+	if self.pathExists(config.State().ClientJar) {
+		if err = os.Chmod(config.State().ClientJar, 0644); err != nil {
+			return environment, err
+		}
+	}
+	if jnlpPath := config.State().Path(CustomizedJnlpName); self.pathExists(jnlpPath) {
+		if err = os.Chown(jnlpPath, int(credential.uid), int(credential.gid)); err != nil {
+			return environment, err
+		}
+		os.Chmod(jnlpPath, 0600)
+	}
+
+	writablePaths := append([]string{}, config.RunAsOwnedPaths...)
+	writablePaths = append(writablePaths, config.State().WritableDirectories...)
+	for _, path := range []string{config.RemotingWorkDirPath(), config.RemotingJarCachePath()} {
+		if path != "" {
+			writablePaths = append(writablePaths, path)
+		}
+	}
+
+	for _, path := range writablePaths {
+		path = os.Expand(path, func(name string) string {
+			if name == "HOME" { return credential.user.HomeDir }
+			return os.Getenv(name)
+		})
+		if err := self.handOverDirectory(path, credential); err != nil {
+			return environment, fmt.Errorf("Failed changing owner of %v. Cause: %v", path, err)
+		}
+	}
+
+	util.GOut(self.group, "Running the Jenkins client as user %v (uid: %v, gid: %v).", credential.user.Username, credential.uid, credential.gid)
+
+	return append(environment,
+		"HOME=" + credential.user.HomeDir,
+		"USER=" + credential.user.Username,
+		"LOGNAME=" + credential.user.Username), nil
+}
+
+// Looks up uid, gid and supplementary groups of the configured user.
+func (self *ClientMode) lookupRunAsCredential(config *util.Config) (credential *runAsCredential, err error) {
+	credential = new(runAsCredential)
+
+	if credential.user, err = user.Lookup(config.RunAsUser); err != nil {
+		if credential.user, err = user.LookupId(config.RunAsUser); err != nil {
+			return nil, fmt.Errorf("Unknown user '%v'", config.RunAsUser)
+		}
+	}
+
+	if credential.uid, err = self.parseId(credential.user.Uid); err != nil {
+		return nil, err
+	}
+
+	gid := credential.user.Gid
+	if config.RunAsGroup != "" {
+		if group, e := user.LookupGroup(config.RunAsGroup); e == nil {
+			gid = group.Gid
+		} else if group, e := user.LookupGroupId(config.RunAsGroup); e == nil {
+			gid = group.Gid
+		} else {
+			return nil, fmt.Errorf("Unknown group '%v'", config.RunAsGroup)
+		}
+	}
+
+	if credential.gid, err = self.parseId(gid); err != nil {
+		return nil, err
+	}
+
+	if groupIds, err := credential.user.GroupIds(); err == nil {
+		for _, groupId := range groupIds {
+			if id, err := self.parseId(groupId); err == nil {
+				credential.groups = append(credential.groups, id)
+			}
+		}
+	}
+
+	return credential, nil
+}
+
+func (self *ClientMode) pathExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (self *ClientMode) parseId(id string) (uint32, error) {
+	value, err := strconv.ParseUint(id, 10, 32)
+	return uint32(value), err
+}
+
+// Creates the directory if missing and hands it over to the specified user.
+// Directories that are owned by the user already are not walked again (e.g. on restarts).
+func (self *ClientMode) handOverDirectory(path string, credential *runAsCredential) error {
+	if info, err := os.Stat(path); err == nil {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && uint32(stat.Uid) == credential.uid {
+			return nil
+		}
+	} else if err = os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+
+	return self.chownRecursive(path, credential)
+}
+
+// Changes the owner of path and everything below to the specified user.
+func (self *ClientMode) chownRecursive(path string, credential *runAsCredential) error {
+	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err == nil {
+			err = os.Lchown(path, int(credential.uid), int(credential.gid))
+		}
+		return err
+	})
+}
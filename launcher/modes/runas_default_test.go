@@ -0,0 +1,39 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+// +build !windows
+
+package modes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOwnedDirectoriesAreCreatedAndHandedOver(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "runas")
+	defer os.RemoveAll(dir)
+
+	mode := new(ClientMode)
+	credential := &runAsCredential{uid: uint32(os.Getuid()), gid: uint32(os.Getgid())}
+
+	path := filepath.Join(dir, "heapdumps", "nested")
+	if err := mode.handOverDirectory(path, credential); err != nil {
+		t.Fatalf("mode.handOverDirectory(%v) failed: %v", path, err)
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		t.Errorf("mode.handOverDirectory(%v) did not create the directory: %v", path, err)
+	}
+
+	// Owned by the user already, the directory must not be walked (an unreadable child would fail the walk).
+	unreadable := filepath.Join(path, "unreadable")
+	os.MkdirAll(filepath.Join(unreadable, "child"), 0755)
+	os.Chmod(unreadable, 0)
+	defer os.Chmod(unreadable, 0755)
+
+	if err := mode.handOverDirectory(path, credential); err != nil {
+		t.Errorf("mode.handOverDirectory(%v) walked a directory that is owned by the user: %v", path, err)
+	}
+}
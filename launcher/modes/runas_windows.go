@@ -0,0 +1,20 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package modes
+
+import (
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+	"fmt"
+	"os/exec"
+)
+
+// Running the client as a different user is not supported on windows.
+func (self *ClientMode) checkRunAsPrivileges(config *util.Config) error {
+	return fmt.Errorf("Running the Jenkins client as a different user is not supported on Windows.")
+}
+
+// Running the client as a different user is not supported on windows.
+func (self *ClientMode) applyRunAs(config *util.Config, command *exec.Cmd, environment []string) ([]string, error) {
+	return environment, self.checkRunAsPrivileges(config)
+}
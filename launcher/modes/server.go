@@ -4,6 +4,7 @@
 package modes
 
 import (
+	"context"
 	"golang.org/x/crypto/ssh/terminal"
 	"golang.org/x/crypto/ssh"
 	"fmt"
@@ -15,6 +16,8 @@ import (
 )
 
 type ServerMode struct {
+	stopReasonRecorder
+	modeContext
 	status *util.AtomicInt32
 	config *util.Config
 }
@@ -38,12 +41,13 @@ func (self *ServerMode) IsConfigAcceptable(config *util.Config) (bool) {
 	return true;
 }
 
-func (self *ServerMode) Start(config *util.Config) (error) {
+func (self *ServerMode) Start(ctx context.Context, config *util.Config) (*ModeHandle, error) {
 	if self.status.Get() != ModeNone {
 		panic("Cannot start mode whose state is != ModeNone")
 	}
 
 	self.config = config;
+	self.resetStopReason()
 	self.status.Set(ModeStarting)
 
 	var keySearchPaths = []string {
@@ -71,15 +75,18 @@ func (self *ServerMode) Start(config *util.Config) (error) {
 	}
 
 	if (err == nil) {
-		go self.execute(key)
-		return nil
+		handle := newModeHandle()
+		go self.execute(self.startContext(ctx), key, handle)
+		return handle, nil
 	} else {
-		return err
+		return nil, err
 	}
 }
 
-func (self *ServerMode) Stop() {
+func (self *ServerMode) Stop(cause string) {
+	self.recordStopCause(cause)
 	self.status.Set(ModeStopping)
+	self.cancelContext()
 }
 
 func (self *ServerMode) createPrivateKey(privateKeyFile string) (*ssh.Signer, error) {
@@ -97,7 +104,7 @@ func (self *ServerMode) readPrivateKey(privateKeyFile string) (ssh.Signer, error
 	return private, err
 }
 
-func (self *ServerMode) execute(privateKey ssh.Signer) {
+func (self *ServerMode) execute(ctx context.Context, privateKey ssh.Signer, handle *ModeHandle) {
 	// An SSH server is represented by a ServerConfig, which holds
 	// certificate details and handles authentication of ServerConns.
 	config := &ssh.ServerConfig{
@@ -135,10 +142,13 @@ func (self *ServerMode) execute(privateKey ssh.Signer) {
 		defer func() {
 			listener.Close()
 			self.status.Set(ModeStopped)
+			handle.finish(nil)
 		}()
 	}
 
+	listenerClosed := make(chan bool)
 	go func() {
+		defer close(listenerClosed)
 		for {
 			connection, err := listener.Accept()
 			if err != nil {
@@ -151,10 +161,13 @@ func (self *ServerMode) execute(privateKey ssh.Signer) {
 		}
 	}()
 
-	// Entering main loop and remain there until the terminal is stopped and the deferred channel close is triggered.
+	// Remaining here until the mode is stopped (or the listener failed) and the deferred close is triggered.
 	self.status.Set(ModeStarted)
-	for self.status.Get() == ModeStarted {
-		time.Sleep(time.Millisecond * 100)
+	select {
+	case <-ctx.Done():
+		self.recordStopCause(util.RestartReasonShutdown)
+	case <-listenerClosed:
+		self.recordStopCause(util.RestartReasonCrash)
 	}
 }
 
@@ -0,0 +1,93 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package launcher
+
+import (
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Keeps track of restarts and computes how long to sleep before the next restart
+// using the restart policy that applies to the reason of a restart.
+type RestartScheduler struct {
+	lastStart     time.Time
+	attempts      map[string]int
+	restartTimes  map[string][]time.Time
+	random        *rand.Rand
+}
+
+// Creates a new scheduler.
+func NewRestartScheduler() *RestartScheduler {
+	self := new(RestartScheduler)
+	self.lastStart = time.Now()
+	self.attempts = map[string]int{}
+	self.restartTimes = map[string][]time.Time{}
+	self.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	return self
+}
+
+// Is to be called whenever the client was (re-)started.
+func (self *RestartScheduler) Started(now time.Time) {
+	self.lastStart = now
+}
+
+// Clears all recorded restarts of the specified reason.
+func (self *RestartScheduler) Reset(reason string) {
+	delete(self.attempts, reason)
+	delete(self.restartTimes, reason)
+}
+
+// Records a restart for the given policy and returns the time to sleep before restarting.
+// "crashLoop" is true when the policy's restart limit was exceeded, in this case the returned
+// sleep time is the cooldown period and the recorded restarts of the reason are cleared.
+func (self *RestartScheduler) NextRestart(policy util.RestartPolicy, now time.Time) (sleepTime time.Duration, crashLoop bool) {
+	reason := policy.Reason
+
+	if policy.ResetAfterMinutes > 0 && self.lastStart.Before(now.Add(-time.Minute * time.Duration(policy.ResetAfterMinutes))) {
+		self.attempts[reason] = 0
+	}
+
+	// Counting the restarts inside the window.
+	restartTimes := append(self.restartTimes[reason], now)
+	if policy.WindowMinutes > 0 {
+		windowStart := now.Add(-time.Minute * time.Duration(policy.WindowMinutes))
+		for len(restartTimes) > 0 && restartTimes[0].Before(windowStart) {
+			restartTimes = restartTimes[1:]
+		}
+	}
+	self.restartTimes[reason] = restartTimes
+
+	if policy.MaxRestartsPerWindow > 0 && len(restartTimes) > policy.MaxRestartsPerWindow {
+		self.Reset(reason)
+		return time.Minute * time.Duration(policy.CrashLoopCooldownMinutes), true
+	}
+
+	attempt := self.attempts[reason]
+	self.attempts[reason] = attempt + 1
+
+	return self.backoff(policy, attempt), false
+}
+
+// Returns the sleep time for the n-th restart attempt in a row (starting with 0).
+func (self *RestartScheduler) backoff(policy util.RestartPolicy, attempt int) time.Duration {
+	if policy.SleepTimeSeconds <= 0 {
+		return 0
+	}
+
+	multiplier := policy.SleepTimeMultiplier
+	if multiplier < 1 { multiplier = 1 }
+
+	seconds := float64(policy.SleepTimeSeconds) * math.Pow(multiplier, float64(attempt))
+	if policy.MaxSleepTimeSeconds > 0 && seconds > float64(policy.MaxSleepTimeSeconds) {
+		seconds = float64(policy.MaxSleepTimeSeconds)
+	}
+
+	if jitter := math.Min(policy.SleepTimeJitter, 1); jitter > 0 {
+		seconds += seconds * jitter * (self.random.Float64()*2 - 1)
+	}
+
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,90 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package launcher
+
+import (
+	"testing"
+	"time"
+	"github.com/jkellerer/jenkins-client-launcher/launcher/util"
+)
+
+var testPolicy = util.RestartPolicy{
+	Reason: util.RestartReasonCrash,
+	SleepTimeSeconds: 10,
+	MaxSleepTimeSeconds: 60,
+	SleepTimeMultiplier: 2,
+	MaxRestartsPerWindow: 5,
+	WindowMinutes: 60,
+	CrashLoopCooldownMinutes: 30,
+	ResetAfterMinutes: 120,
+}
+
+func TestSleepTimeIsRampedUpAndCapped(t *testing.T) {
+	scheduler, now := NewRestartScheduler(), time.Now()
+	scheduler.Started(now)
+
+	for _, seconds := range []int64{10, 20, 40, 60, 60} {
+		in, crashLoop := scheduler.NextRestart(testPolicy, now)
+		out := time.Second * time.Duration(seconds)
+		if in != out || crashLoop {
+			t.Errorf("scheduler.NextRestart(testPolicy) = %v, %v, want %v, false", in, crashLoop, out)
+		}
+	}
+}
+
+func TestCrashLoopIsDetectedWhenLimitIsExceeded(t *testing.T) {
+	scheduler, now := NewRestartScheduler(), time.Now()
+	scheduler.Started(now)
+
+	for i := 0; i < testPolicy.MaxRestartsPerWindow; i++ {
+		if _, crashLoop := scheduler.NextRestart(testPolicy, now); crashLoop {
+			t.Errorf("Restart %v was detected as crash loop.", i)
+		}
+	}
+
+	in, crashLoop := scheduler.NextRestart(testPolicy, now)
+	if out := time.Minute * 30; in != out || !crashLoop {
+		t.Errorf("scheduler.NextRestart(testPolicy) = %v, %v, want %v, true", in, crashLoop, out)
+	}
+
+	if in, _ := scheduler.NextRestart(testPolicy, now); in != time.Second * 10 {
+		t.Errorf("Restart attempts were not cleared after crash loop, sleep time is %v.", in)
+	}
+}
+
+func TestRestartsOutsideOfWindowAreNotCounted(t *testing.T) {
+	scheduler, now := NewRestartScheduler(), time.Now()
+	scheduler.Started(now)
+
+	for i := 0; i < testPolicy.MaxRestartsPerWindow * 2; i++ {
+		now = now.Add(time.Minute * 15)
+		scheduler.Started(now)
+		if _, crashLoop := scheduler.NextRestart(testPolicy, now); crashLoop {
+			t.Errorf("Restart %v was detected as crash loop.", i)
+		}
+	}
+}
+
+func TestAttemptsAreResetAfterLongRunTime(t *testing.T) {
+	scheduler, now := NewRestartScheduler(), time.Now()
+	scheduler.Started(now)
+	scheduler.NextRestart(testPolicy, now)
+	scheduler.NextRestart(testPolicy, now)
+
+	now = now.Add(time.Hour * 3)
+	if in, _ := scheduler.NextRestart(testPolicy, now); in != time.Second * 10 {
+		t.Errorf("scheduler.NextRestart(testPolicy) = %v, want %v", in, time.Second * 10)
+	}
+}
+
+func TestJitterStaysWithinBounds(t *testing.T) {
+	scheduler, policy := NewRestartScheduler(), testPolicy
+	policy.SleepTimeJitter = 0.5
+
+	for i := 0; i < 20; i++ {
+		if in := scheduler.backoff(policy, 0); in < time.Second * 5 || in > time.Second * 15 {
+			t.Errorf("scheduler.backoff(policy, 0) = %v, want 5s - 15s", in)
+		}
+	}
+}
@@ -5,11 +5,15 @@ package util
 
 import (
 	"encoding/xml"
+	"encoding/hex"
+	"crypto/rand"
 	"os"
+	"net"
 	"net/http"
 	"crypto/tls"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 	"io"
 	"io/ioutil"
@@ -33,19 +37,57 @@ func (_ *AnyConfigAcceptor) IsConfigAcceptable(config *Config) (bool) {
 	return true
 }
 
+const (
+	ConsoleMonitorDescription = `
+<console>
+  Configures how the console output of the Jenkins client is monitored
+  (requires "client>monitoring>console" to be enabled):
+
+  - errorTokens>token:  Text that triggers an immediate restart when found in the console output.
+
+  - rules>rule:         Regular expressions with an action to perform when matched:
+
+                          <rules>
+                            <rule>
+                              <pattern>java\.net\.SocketTimeoutException</pattern>
+                              <action>restartWhenIdle</action>
+                              <rateLimit><matches>3</matches><minutes>10</minutes></rateLimit>
+                            </rule>
+                          </rules>
+
+                        - action:     One of "restart" (restart now), "restartWhenIdle",
+                                      "markOffline" (mark the node temporarily offline in Jenkins),
+                                      "warn" (print a warning only) or "hook" (runs "command").
+                        - rateLimit:  Triggers the action only when the pattern matched
+                                      "matches" times within "minutes" (default: every match).
+
+  - ignore>pattern:     Regular expressions of lines that are never matched against tokens or rules.
+</console>
+`)
+
+const (
+	ConsoleActionRestart         = "restart"
+	ConsoleActionRestartWhenIdle = "restartWhenIdle"
+	ConsoleActionMarkOffline     = "markOffline"
+	ConsoleActionWarn            = "warn"
+	ConsoleActionHook            = "hook"
+)
+
 // Allows to configure console monitoring.
 type ConsoleMonitor struct {
-	RestartTriggerTokens []string `xml:"console>errorTokens>token"`
+	RestartTriggerTokens []string      `xml:"console>errorTokens>token"`
+	Rules                []ConsoleRule `xml:"console>rules>rule"`
+	IgnorePatterns       []string      `xml:"console>ignore>pattern"`
+	state                *consoleRuleState
 }
 
-// Returns true if the given line contains a restart trigger token.
-func (self *ConsoleMonitor) IsRestartTriggered(line string) bool {
-	for _, token := range self.RestartTriggerTokens {
-		if strings.Contains(line, token) {
-			return true
-		}
-	}
-	return false
+// Defines a regular expression that triggers an action when found in the console output.
+type ConsoleRule struct {
+	Pattern       string `xml:"pattern"`
+	Action        string `xml:"action"`
+	Command       string `xml:"command,omitempty"`
+	Matches       int    `xml:"rateLimit>matches,omitempty"`
+	WindowMinutes int64  `xml:"rateLimit>minutes,omitempty"`
 }
 
 const (
@@ -174,25 +216,78 @@ const (
 <java>
   Configures the Java environment that is used to bootstrap the Jenkins Client:
 
+  - home:          Path to the java installation (JDK or JRE) to use. When empty or when the
+                   version doesn't match, JCL searches JAVA_HOME, PATH and common install
+                   directories and selects the highest matching version.
+
+  - version:       Requirements on the java version:
+
+                     <version>
+                       <min>1.8</min>
+                       <max>17</max>
+                       <preferred>11</preferred>
+                     </version>
+
+                   - min:        Min version (default 1.6.0).
+                   - max:        Max version including its updates (e.g. 17 accepts 17.0.2).
+                   - preferred:  Installations of this version are selected over newer ones.
+                   Both legacy (1.8.0_292) and modern (17.0.2) version formats are accepted.
+
+  - install:       Installs java from a JDK or JRE tarball (Linux only), e.g. from a local mirror:
+
+                     <install>
+                       <source>https://mirror.local/java/jdk-17.0.2_linux-x64_bin.tar.gz</source>
+                       <sha256>0022753d0cceecacdd3a795dd4cea2bd7ffdf9dc06e22ffd1be98411742fbb44</sha256>
+                       <directory>java</directory>
+                     </install>
+
+                   - source:     URL (http, https, file) or local path of the ".tar.gz" archive.
+                   - sha256:     Checksum of the archive (required for downloads).
+                   - directory:  Directory that receives the installation. The installation is
+                                 updated when source or checksum change, the previous one is kept
+                                 and used as fallback when the current one stops working.
+
   - args>arg:      Enumerates additional options (each wrapped in one <arg>OPT</arg>) that are used
                    to start java.
                    The default options try to optimise GC for low footprint instead of performance in
                    order to leave more memory for IO and forked build tasks.
 
-  - maxMemory:     Allows to set the max memory that java will attempt to use.
-                   When not specified, 25% of the OS RAM are used. Accepted values are: 524288k, 512m, 1g, ...
+  - maxMemory:     Allows to set the max memory (-Xmx) that java will attempt to use.
+                   Accepted values are: 524288k, 512m, 1g, ... or a percentage (e.g. 30%) of the
+                   available memory. The available memory is the OS RAM or the cgroup memory limit
+                   (of a container or of <client><cgroup>) when it is lower.
+                   When empty (default), no -Xmx is passed and the JVM applies its defaults.
+
+  - maxMemoryBounds: Limits the computed max memory (e.g. when using percentages):
+
+                     <maxMemoryBounds>
+                       <min>256m</min>
+                       <max>8g</max>
+                     </maxMemoryBounds>
 
   - forceFullGC:   Allows to enable periodic calls to "System.gc()" to reduce the overall memory
-                   usage of the Jenkins Client.
+                   usage of the Jenkins Client. Besides the intervals (used when the node is busy
+                   or IDLE) a "schedule" (cron expression or maintenance window, see <maintenance>)
+                   may trigger the call regardless of the node state.
 </java>
 `)
 
 type JavaOptions struct {
+	JavaHome                        string   `xml:"java>home"`
+	JavaMinVersion                  string   `xml:"java>version>min"`
+	JavaMaxVersion                  string   `xml:"java>version>max"`
+	JavaPreferredVersion            string   `xml:"java>version>preferred"`
+	JavaInstallSource               string   `xml:"java>install>source"`
+	JavaInstallSHA256               string   `xml:"java>install>sha256"`
+	JavaInstallDirectory            string   `xml:"java>install>directory"`
 	JavaArgs                        []string `xml:"java>args>arg"`
 	JavaMaxMemory                   string   `xml:"java>maxMemory"`
+	JavaMaxMemoryLowerBound         string   `xml:"java>maxMemoryBounds>min"`
+	JavaMaxMemoryUpperBound         string   `xml:"java>maxMemoryBounds>max"`
 	ForceFullGC                     bool     `xml:"java>forceFullGC>enabled"`
 	ForceFullGCIntervalMinutes      int64    `xml:"java>forceFullGC>interval>minutes"`
 	ForceFullGCIDLEIntervalMinutes  int64    `xml:"java>forceFullGC>idleInterval>minutes"`
+	ForceFullGCSchedule             string   `xml:"java>forceFullGC>schedule"`
 }
 
 const (
@@ -212,6 +307,22 @@ const (
                                     triggers a restart when the node appears offline.
                    - console:       When enabled JCL watches the console output and triggers
                                     a restart when one of the configured error tokens are found.
+                   - connect:       Restarts the client when it is not connected with Jenkins
+                                    within "timeout>seconds" after starting or after losing the
+                                    connection (0 disables the timeout). The connection state is
+                                    detected from the console output and the node state on Jenkins.
+                   - localIdle:     When "stateOnServer" is disabled the IDLE state of the node
+                                    (used by cleanups and restarts that run "onlyWhenIdle") is
+                                    detected locally: The node is busy while the Jenkins client has
+                                    child processes (except for "ignore>process" names, GLOB style)
+                                    or files in the workspace were modified within the last
+                                    "workspaceQuietMinutes". When disabled the node is always IDLE.
+
+                                    <localIdle>
+                                      <enabled>true</enabled>
+                                      <workspaceQuietMinutes>10</workspaceQuietMinutes>
+                                      <ignore><process>conhost.exe</process></ignore>
+                                    </localIdle>
 
   - restart:       Controls how restarts of the Jenkins client are triggered.
                    - handleReconnects:  When enabled let JCL handle reconnects on server outage
@@ -219,9 +330,176 @@ const (
                                         itself.
                    - sleepOnFailure:    Number of seconds to sleep between 2 attempts to restart.
                                         This sleep time is ramped up (multiplied) with the number
-                                        of restart attempts in a row.
+                                        of restart attempts in a row:
+                                        - maxSeconds:  Caps the ramped up sleep time.
+                                        - multiplier:  Factor applied with every attempt in a row.
+                                        - jitter:      Random deviation (0.0 - 1.0) applied to the
+                                                       sleep time to avoid synchronous restarts.
+                   - limit:             Max number of restarts ("maxRestarts") within a time window
+                                        ("windowMinutes"). Exceeding it is considered a crash loop.
+                   - crashLoop:         Number of minutes to wait ("cooldownMinutes") before
+                                        restarting a client that is in a crash loop.
+                   - resetAfter:        Number of minutes a client must run before restart attempts
+                                        are no longer counted as attempts in a row.
+                   - policies:          Overrides the settings above per restart reason, e.g.:
+                                          <policy reason="outOfMemory">
+                                            <sleepOnFailure><seconds>5</seconds></sleepOnFailure>
+                                          </policy>
+                                        Known reasons are: crash, outOfMemory, consoleToken,
+                                        monitorOffline, tunnelLost, periodic, manual,
+                                        startAborted, cgroupOutOfMemory, connectTimeout.
+                                        Unset values default to 0 (= no sleep or no limit).
                    - periodic:          Allows to trigger a restart per interval
-                                        (e.g. once a week).
+                                        (e.g. once a week) or per "schedule" (a cron expression
+                                        or the name of a maintenance window, see <maintenance>).
+                                        A schedule takes precedence over the interval.
+                   - outOfMemory:       Restarts the client when the JVM signals an OutOfMemoryError.
+                                        Optionally a heap dump is written on the error:
+                                          <heapDump>
+                                            <enabled>true</enabled>
+                                            <directory>heapdumps</directory>
+                                            <compress>true</compress>
+                                            <keep>3</keep>
+                                            <maxTotalMB>0</maxTotalMB>
+                                          </heapDump>
+                                        - compress:    Compresses dumps (gzip) after the restart.
+                                        - keep:        Number of dumps to keep (newest first).
+                                        - maxTotalMB:  Removes the oldest dumps when the dumps use
+                                                       more space (0 = no limit).
+                   - drain:             Applies to periodic and outOfMemory restarts that wait for the
+                                        node to become IDLE ("onlyWhenIdle"). When enabled the node is
+                                        marked temporarily offline in Jenkins, so that no new builds
+                                        start, running builds may finish within "timeout>minutes"
+                                        (0 = no limit) and the client is restarted afterwards.
+                                        The node is brought back online once the client reconnected.
+
+  - hooks:         Commands that are executed before the Jenkins client starts ("preStart") and
+                   after it stopped ("postStop"). Commands run inside the OS shell and receive
+                   the variables JCL_HOOK, JCL_NODE_NAME, JCL_CI_URL, JCL_RUN_MODE and
+                   (postStop only) JCL_STOP_REASON, JCL_EXIT_CODE, JCL_SIGNAL.
+                   Output of the commands is written to the launcher's console.
+
+                     <hooks>
+                       <preStart>
+                         <hook>
+                           <command>kinit -R</command>
+                           <timeout><seconds>60</seconds></timeout>
+                           <abortStartOnFailure>true</abortStartOnFailure>
+                         </hook>
+                       </preStart>
+                       <postStop>
+                         <hook><command>./collect-logs.sh</command></hook>
+                       </postStop>
+                     </hooks>
+
+                   - timeout:              Seconds until the command is killed (default 300).
+                   - abortStartOnFailure:  When enabled, a failing preStart hook aborts the
+                                           start and the client is restarted later on.
+
+  - environment:   Controls the environment variables of the Jenkins client process:
+
+                     <environment>
+                       <clean>false</clean>
+                       <allow><name>PATH</name><name>TEMP</name></allow>
+                       <variable name="JAVA_TOOL_OPTIONS">-Dfile.encoding=UTF-8</variable>
+                       <variable name="PATH" action="prepend">${HOME}/bin</variable>
+                       <variable name="HTTP_PROXY" action="unset"></variable>
+                       <variable name="NEXUS_TOKEN" sensitive="true">...</variable>
+                     </environment>
+
+                   - clean:     When enabled the client starts with an empty environment that
+                                contains only the variables listed in "allow" and "variable".
+                   - variable:  Sets ("set", default), removes ("unset"), prepends ("prepend")
+                                or appends ("append") a value. Prepend & append use the OS path
+                                list separator unless "separator" is specified.
+                                Environment variables (in ${var} format) are expanded in values.
+                                Values of variables marked "sensitive" or containing "password",
+                                "secret" or "token" in their name are masked in console output.
+                                Values in the client's commandline are masked when they are assigned
+                                to a name like this (e.g. "-DNEXUS_TOKEN=..." or "-Dnexus.token=...").
+
+  - runAs:         Runs the Jenkins client as a different user (not supported on Windows).
+                   Requires that the launcher itself runs with root privileges:
+
+                     <runAs>
+                       <user>jenkins</user>
+                       <group></group>
+                       <ownedPaths><path>${HOME}/workspace</path></ownedPaths>
+                     </runAs>
+
+                   - user:        Name or uid of the user to run the client as.
+                   - group:       Name or gid of the primary group (defaults to the user's group).
+                   - ownedPaths:  Directories that are created or recursively changed to be owned
+                                  by the user before the client starts (skipped once the user owns
+                                  them). The JNLP file, the remoting directories and the heap dump
+                                  directory are always handed over to the user, the client jar is
+                                  made readable for everyone.
+
+  - cgroup:        Places the Jenkins client and all processes it forks into a dedicated
+                   cgroup (Linux with cgroup v2 only, requires write access to the cgroup tree):
+
+                     <cgroup>
+                       <enabled>true</enabled>
+                       <parent>jenkins-client-launcher</parent>
+                       <memoryMax>8g</memoryMax>
+                       <cpuMax>2.5</cpuMax>
+                       <pidsMax>4096</pidsMax>
+                     </cgroup>
+
+                   - parent:     Path of the parent group relative to the cgroup root.
+                   - memoryMax:  Max memory of all processes (e.g. 512m, 8g; empty = unlimited).
+                                 OOM kills inside the group trigger a restart.
+                   - cpuMax:     Max number of CPUs to use (e.g. 0.5, 2; 0 = unlimited).
+                   - pidsMax:    Max number of processes (0 = unlimited).
+
+  - remoting:      Controls the directories used by the Jenkins client (remoting):
+
+                     <remoting>
+                       <workDir></workDir>
+                       <jarCache></jarCache>
+                     </remoting>
+
+                   - workDir:   Passed as "-workDir" when set (empty by default, keeping the
+                                behaviour of remoting unchanged). Remoting keeps its internal
+                                logs in "workDir/remoting/logs" and (by default) the jar cache
+                                in "workDir/remoting/jarCache". Opt in by setting a path,
+                                e.g. <workDir>remoting</workDir> (relative to the launcher).
+                   - jarCache:  Passed as "-jar-cache" when set.
+                   The special variables "${remoting_workdir}" and "${jar_cache}" can be used in
+                   <maintenance><cleanup> locations to prune these directories once configured,
+                   e.g. <location>${jar_cache}</location> with <ttl><hours>720</hours></ttl>.
+
+  - crashSnapshots: Keeps the last lines of the client's console output in memory and writes
+                   them to a snapshot file whenever the client stops without being asked to
+                   (crashes, OOM, monitor or console triggered restarts):
+
+                     <crashSnapshots>
+                       <enabled>true</enabled>
+                       <lines>500</lines>
+                       <directory>crashes</directory>
+                       <keep>20</keep>
+                     </crashSnapshots>
+
+                   - lines:      Number of console lines (stdout & stderr) that are kept.
+                   - directory:  Directory that receives the snapshots (relative to the
+                                 launcher's working directory).
+                   - keep:       Number of snapshots to keep, older ones are removed.
+
+  - diagnostics:   Collects diagnostics of a hanging client before it is restarted by the node
+                   monitor or the SSH tunnel monitor:
+
+                     <diagnostics>
+                       <directory>diagnostics</directory>
+                       <threadDumpBeforeRestart>true</threadDumpBeforeRestart>
+                       <heapHistogramBeforeRestart>false</heapHistogramBeforeRestart>
+                       <keep>20</keep>
+                     </diagnostics>
+
+                   - threadDumpBeforeRestart:     Writes a Java thread dump (via SIGQUIT or
+                                                  "jcmd Thread.print" on Windows) to the directory.
+                   - heapHistogramBeforeRestart:  Writes a heap histogram (via "jcmd
+                                                  GC.class_histogram", requires a JDK).
+                   - keep:                        Number of files to keep per kind.
 </client>
 `)
 
@@ -233,13 +511,193 @@ type ClientOptions struct {
 	ClientMonitorStateOnServer            bool   `xml:"client>monitoring>stateOnServer>enabled"`
 	ClientMonitorStateOnServerMaxFailures int16  `xml:"client>monitoring>stateOnServer>maxFailures"`
 	ClientMonitorConsole                  bool   `xml:"client>monitoring>console>enabled"`
+	ClientConnectTimeoutSeconds           int64  `xml:"client>monitoring>connect>timeout>seconds"`
+	ClientLocalIdleDetection              bool   `xml:"client>monitoring>localIdle>enabled"`
+	ClientLocalIdleQuietMinutes           int64  `xml:"client>monitoring>localIdle>workspaceQuietMinutes"`
+	ClientLocalIdleIgnoredProcesses       []string `xml:"client>monitoring>localIdle>ignore>process"`
 	HandleReconnectsInLauncher            bool   `xml:"client>restart>handleReconnects"`
 	SleepTimeSecondsBetweenFailures       int64  `xml:"client>restart>sleepOnFailure>seconds"`
+	MaxSleepTimeSecondsBetweenFailures    int64  `xml:"client>restart>sleepOnFailure>maxSeconds"`
+	SleepTimeMultiplier                   float64 `xml:"client>restart>sleepOnFailure>multiplier"`
+	SleepTimeJitter                       float64 `xml:"client>restart>sleepOnFailure>jitter"`
+	MaxRestartsPerWindow                  int    `xml:"client>restart>limit>maxRestarts"`
+	RestartWindowMinutes                  int64  `xml:"client>restart>limit>windowMinutes"`
+	CrashLoopCooldownMinutes              int64  `xml:"client>restart>crashLoop>cooldownMinutes"`
+	ResetRestartCountAfterMinutes         int64  `xml:"client>restart>resetAfter>minutes"`
+	RestartPolicies                       []RestartPolicy `xml:"client>restart>policies>policy"`
 	PeriodicClientRestartEnabled          bool   `xml:"client>restart>periodic>enabled"`
 	PeriodicClientRestartOnlyWhenIDLE     bool   `xml:"client>restart>periodic>onlyWhenIdle"`
 	PeriodicClientRestartIntervalHours    int64  `xml:"client>restart>periodic>interval>hours"`
+	PeriodicClientRestartSchedule         string `xml:"client>restart>periodic>schedule"`
 	OutOfMemoryRestartEnabled             bool   `xml:"client>restart>outOfMemory>enabled"`
 	OutOfMemoryRestartOnlyWhenIDLE        bool   `xml:"client>restart>outOfMemory>onlyWhenIdle"`
+	HeapDumpOnOutOfMemoryEnabled          bool   `xml:"client>restart>outOfMemory>heapDump>enabled"`
+	HeapDumpDirectory                     string `xml:"client>restart>outOfMemory>heapDump>directory"`
+	HeapDumpCompress                      bool   `xml:"client>restart>outOfMemory>heapDump>compress"`
+	HeapDumpsToKeep                       int    `xml:"client>restart>outOfMemory>heapDump>keep"`
+	HeapDumpMaxTotalMB                    int64  `xml:"client>restart>outOfMemory>heapDump>maxTotalMB"`
+	PlannedRestartDrainEnabled            bool   `xml:"client>restart>drain>enabled"`
+	PlannedRestartDrainTimeoutMinutes     int64  `xml:"client>restart>drain>timeout>minutes"`
+	PreStartHooks                         []Hook `xml:"client>hooks>preStart>hook"`
+	PostStopHooks                         []Hook `xml:"client>hooks>postStop>hook"`
+	CleanEnvironment                      bool   `xml:"client>environment>clean"`
+	AllowedEnvironmentVariables           []string `xml:"client>environment>allow>name"`
+	EnvironmentVariables                  []EnvironmentVariable `xml:"client>environment>variable"`
+	RunAsUser                             string `xml:"client>runAs>user"`
+	RunAsGroup                            string `xml:"client>runAs>group"`
+	RunAsOwnedPaths                       []string `xml:"client>runAs>ownedPaths>path"`
+	CGroupEnabled                         bool   `xml:"client>cgroup>enabled"`
+	CGroupParent                          string `xml:"client>cgroup>parent"`
+	CGroupMemoryMax                       string `xml:"client>cgroup>memoryMax"`
+	CGroupCPUMax                          float64 `xml:"client>cgroup>cpuMax"`
+	CGroupPidsMax                         int64  `xml:"client>cgroup>pidsMax"`
+	RemotingWorkDir                       string `xml:"client>remoting>workDir"`
+	RemotingJarCache                      string `xml:"client>remoting>jarCache"`
+	CrashSnapshotsEnabled                 bool   `xml:"client>crashSnapshots>enabled"`
+	CrashSnapshotLines                    int    `xml:"client>crashSnapshots>lines"`
+	CrashSnapshotDirectory                string `xml:"client>crashSnapshots>directory"`
+	CrashSnapshotsToKeep                  int    `xml:"client>crashSnapshots>keep"`
+	DiagnosticsDirectory                  string `xml:"client>diagnostics>directory"`
+	ThreadDumpBeforeRestart               bool   `xml:"client>diagnostics>threadDumpBeforeRestart"`
+	HeapHistogramBeforeRestart            bool   `xml:"client>diagnostics>heapHistogramBeforeRestart"`
+	DiagnosticsToKeep                     int    `xml:"client>diagnostics>keep"`
+}
+
+const (
+	EnvironmentActionSet     = "set"
+	EnvironmentActionUnset   = "unset"
+	EnvironmentActionPrepend = "prepend"
+	EnvironmentActionAppend  = "append"
+)
+
+// Returns the absolute path of the remoting work directory or "" if not configured.
+func (self *Config) RemotingWorkDirPath() string {
+	if self.RemotingWorkDir == "" {
+		return ""
+	}
+	path, _ := filepath.Abs(self.State().Path(os.ExpandEnv(self.RemotingWorkDir)))
+	return path
+}
+
+// Returns the absolute path of the directory where remoting caches jar files or "" if unknown.
+func (self *Config) RemotingJarCachePath() string {
+	if self.RemotingJarCache != "" {
+		path, _ := filepath.Abs(self.State().Path(os.ExpandEnv(self.RemotingJarCache)))
+		return path
+	} else if workDir := self.RemotingWorkDirPath(); workDir != "" {
+		return filepath.Join(workDir, "remoting", "jarCache")
+	}
+	return ""
+}
+
+// Returns the absolute path of the directory containing the internal logs of remoting or "" if unknown.
+func (self *Config) RemotingLogsPath() string {
+	if workDir := self.RemotingWorkDirPath(); workDir != "" {
+		return filepath.Join(workDir, "remoting", "logs")
+	}
+	return ""
+}
+
+// Defines a modification of an environment variable of the client process.
+type EnvironmentVariable struct {
+	Name      string `xml:"name,attr"`
+	Action    string `xml:"action,attr,omitempty"`
+	Separator string `xml:"separator,attr,omitempty"`
+	Sensitive bool   `xml:"sensitive,attr,omitempty"`
+	Value     string `xml:",chardata"`
+}
+
+// Returns true if the value of the variable must not be shown in console output.
+func (self *EnvironmentVariable) IsSensitive() bool {
+	return self.Sensitive || IsSensitiveName(self.Name)
+}
+
+// Returns an error if the action of the variable is unknown.
+func (self *EnvironmentVariable) validateAction() error {
+	switch strings.ToLower(self.Action) {
+	case EnvironmentActionSet, EnvironmentActionUnset, EnvironmentActionPrepend, EnvironmentActionAppend, "":
+		return nil
+	}
+	return fmt.Errorf("Invalid action '%s' of environment variable '%s' (allowed are %s, %s, %s and %s).", self.Action, self.Name,
+		EnvironmentActionSet, EnvironmentActionUnset, EnvironmentActionPrepend, EnvironmentActionAppend)
+}
+
+// Returns true if a variable or property with the given name holds a value that must not be shown in console output.
+func IsSensitiveName(name string) bool {
+	name = strings.ToLower(name)
+	return strings.Contains(name, "password") || strings.Contains(name, "secret") || strings.Contains(name, "token")
+}
+
+// Defines a command that is executed before the client starts or after it stopped.
+type Hook struct {
+	Command             string `xml:"command"`
+	TimeoutSeconds      int64  `xml:"timeout>seconds"`
+	AbortStartOnFailure bool   `xml:"abortStartOnFailure"`
+}
+
+const (
+	// The client stopped by itself (e.g. crashed or lost the connection).
+	RestartReasonCrash = "crash"
+	// The JVM signaled an OutOfMemoryError.
+	RestartReasonOutOfMemory = "outOfMemory"
+	// A restart token was found in the console output.
+	RestartReasonConsoleToken = "consoleToken"
+	// The node appeared offline in Jenkins.
+	RestartReasonMonitorOffline = "monitorOffline"
+	// The SSH tunnel to Jenkins was lost.
+	RestartReasonTunnelLost = "tunnelLost"
+	// The periodic restart was triggered.
+	RestartReasonPeriodic = "periodic"
+	// The restart was requested by the user.
+	RestartReasonManual = "manual"
+	// A process inside the client's cgroup was killed as the cgroup ran out of memory.
+	RestartReasonCGroupOutOfMemory = "cgroupOutOfMemory"
+	// A preStart hook failed and aborted the start of the client.
+	RestartReasonStartAborted = "startAborted"
+	// The launcher is shutting down, no restart follows.
+	RestartReasonShutdown = "shutdown"
+	// The client did not connect with Jenkins within the connect timeout.
+	RestartReasonConnectTimeout = "connectTimeout"
+)
+
+// Returns true if the restart reason describes a stop that was asked for (and not caused by a failure).
+func IsRequestedRestartReason(reason string) bool {
+	return reason == RestartReasonManual || reason == RestartReasonPeriodic || reason == RestartReasonShutdown
+}
+
+// Defines how restarts are delayed and limited for a certain restart reason.
+type RestartPolicy struct {
+	Reason                   string  `xml:"reason,attr"`
+	SleepTimeSeconds         int64   `xml:"sleepOnFailure>seconds"`
+	MaxSleepTimeSeconds      int64   `xml:"sleepOnFailure>maxSeconds"`
+	SleepTimeMultiplier      float64 `xml:"sleepOnFailure>multiplier"`
+	SleepTimeJitter          float64 `xml:"sleepOnFailure>jitter"`
+	MaxRestartsPerWindow     int     `xml:"limit>maxRestarts"`
+	WindowMinutes            int64   `xml:"limit>windowMinutes"`
+	CrashLoopCooldownMinutes int64   `xml:"crashLoop>cooldownMinutes"`
+	ResetAfterMinutes        int64   `xml:"resetAfter>minutes"`
+}
+
+// Returns the restart policy that applies to the specified restart reason.
+// Reasons without a dedicated policy use the general restart settings of the client.
+func (self *ClientOptions) RestartPolicyFor(reason string) RestartPolicy {
+	for _, policy := range self.RestartPolicies {
+		if strings.EqualFold(policy.Reason, reason) {
+			return policy
+		}
+	}
+
+	return RestartPolicy{
+		Reason: reason,
+		SleepTimeSeconds: self.SleepTimeSecondsBetweenFailures,
+		MaxSleepTimeSeconds: self.MaxSleepTimeSecondsBetweenFailures,
+		SleepTimeMultiplier: self.SleepTimeMultiplier,
+		SleepTimeJitter: self.SleepTimeJitter,
+		MaxRestartsPerWindow: self.MaxRestartsPerWindow,
+		WindowMinutes: self.RestartWindowMinutes,
+		CrashLoopCooldownMinutes: self.CrashLoopCooldownMinutes,
+		ResetAfterMinutes: self.ResetRestartCountAfterMinutes,
+	}
 }
 
 const (
@@ -253,7 +711,8 @@ const (
                Location: Envionment variables (in ${var} format) and asterisk symbols
                are allowed inside the specified location.
                The special variable "${workspace}" references the workspace folder of this
-               Jenkins node.
+               Jenkins node, "${remoting_workdir}" and "${jar_cache}" reference the directories
+               configured in <client><remoting>.
 
                Mode: This value controls how the specified TTL is applied:
                 - TTLPerFile: Cleans every file that exceeds the TTL.
@@ -262,6 +721,9 @@ const (
                Exclusions: Files can be excluded from cleaning using GLOB style patterns,
                following the syntax defined for "http://golang.org/pkg/path/filepath/#Match".
 
+               Schedule: Runs the cleanup per "schedule" instead of per "interval>hours"
+               (a cron expression or the name of a maintenance window, see below).
+
                Example "Cleanup Temp Location":
 
                  <cleanup>
@@ -278,11 +740,43 @@ const (
                      <exclusion>*\mypath\*</exclusion>
                    </exclusions>
                  </cleanup>
+
+  - windows:   Defines named maintenance windows (local time) that can be used as "schedule"
+               of periodic restarts, cleanups and forced GCs. Scheduled tasks run when the
+               window opens and must start before it closes: restarts and cleanups that still
+               wait for the node to become IDLE (or drain it) are aborted when the window
+               closes and are retried in the next window. Days are "daily", "weekdays",
+               "weekends" or a list of weekdays (e.g. "mon,wed-fri"). Windows ending before
+               they start end on the next day.
+
+                 <windows>
+                   <window name="nightly">
+                     <days>weekdays</days>
+                     <from>02:00</from>
+                     <to>04:00</to>
+                   </window>
+                 </windows>
+
+               Instead of a window name a "schedule" may contain a cron expression
+               ("minute hour day-of-month month day-of-week", local time), e.g. "30 2 * * sun"
+               or one of "@hourly", "@daily", "@weekly", "@monthly".
+               The next run times are listed in the launcher's status output ([S]+Return).
+
+  - pauseWhileHeldOffline:
+               Skips periodic restarts, cleanups and forced GCs while a user or administrator
+               holds the node temporarily offline in Jenkins (default: false).
 </maintenance>
 `)
 
 type Maintenance struct {
 	CleanupSettingsList    []CleanupSettings `xml:"maintenance>cleanup"`
+	MaintenanceWindows     []MaintenanceWindow `xml:"maintenance>windows>window"`
+	PauseWhileHeldOffline  bool `xml:"maintenance>pauseWhileHeldOffline"`
+}
+
+// Returns true if scheduled maintenance is paused as the node of the agent is held offline by a user.
+func (self *Config) IsMaintenancePaused() bool {
+	return self.PauseWhileHeldOffline && self.State().HeldOffline.Get()
 }
 
 type CleanupSettings struct {
@@ -290,11 +784,297 @@ type CleanupSettings struct {
 	Location        string   `xml:"location"`
 	OnlyWhenIDLE    bool     `xml:"onlyWhenIdle"`
 	IntervalHours   int64    `xml:"interval>hours"`
+	Schedule        string   `xml:"schedule"`
 	TTLHours        int64    `xml:"ttl>hours"`
 	Mode            string   `xml:"ttl>mode"`
 	Exclusions      []string `xml:"exclusions>exclusion"`
 }
 
+// Returns the schedule defined by "expression" (name of a maintenance window or cron expression)
+// or an IntervalSchedule using "interval" when the expression is empty (nil if the interval is not positive).
+func (self *Maintenance) Schedule(expression string, interval time.Duration) (Schedule, error) {
+	if expression = strings.TrimSpace(expression); expression == "" {
+		if interval <= 0 {
+			return nil, nil
+		}
+		return IntervalSchedule{Interval: interval}, nil
+	}
+
+	for _, window := range self.MaintenanceWindows {
+		if strings.EqualFold(window.Name, expression) {
+			if err := window.init(); err != nil {
+				return nil, err
+			}
+			return &window, nil
+		}
+	}
+
+	schedule, err := ParseCronSchedule(expression)
+	if err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+const (
+	HealthChecksDescription = `
+<health>
+  Configures checks of the host that mark the node temporarily offline in Jenkins when a
+  threshold is exceeded (no new builds start) and bring it back online after the host was
+  healthy for "recoverAfter>checks" checks in a row:
+
+    <health>
+      <enabled>true</enabled>
+      <interval><seconds>60</seconds></interval>
+      <disk>
+        <locations>
+          <location>${workspace}</location>
+          <location>${temp}</location>
+        </locations>
+        <minFree>2g</minFree>
+        <minFreeInodes>5%</minFreeInodes>
+      </disk>
+      <memory><minFree>5%</minFree></memory>
+      <load><maxPerCPU>4.0</maxPerCPU></load>
+      <clockSkew><maxSeconds>120</maxSeconds></clockSkew>
+      <recoverAfter><checks>3</checks></recoverAfter>
+    </health>
+
+  - disk:       Free space and free inodes of the filesystems containing the locations, given
+                as size (e.g. 2g), count (inodes) or percentage of the filesystem (e.g. 5%).
+                "${workspace}" references the workspace folder of this Jenkins node, "${temp}"
+                the temporary directory, other variables are read from the environment.
+                Inodes are not checked on Windows.
+  - memory:     Memory that is available for new processes (size or percentage of the RAM).
+  - load:       Max load average (5 minutes) per CPU. Not checked on Windows.
+  - clockSkew:  Max difference between the local clock and the "Date" header sent by Jenkins.
+
+  Empty values or 0 disable a check. Nodes that were marked offline by somebody else are not
+  brought back online.
+</health>
+`)
+
+type HealthChecks struct {
+	HealthChecksEnabled           bool     `xml:"health>enabled"`
+	HealthCheckIntervalSeconds    int64    `xml:"health>interval>seconds"`
+	HealthDiskLocations           []string `xml:"health>disk>locations>location"`
+	HealthMinFreeDiskSpace        string   `xml:"health>disk>minFree"`
+	HealthMinFreeInodes           string   `xml:"health>disk>minFreeInodes"`
+	HealthMinFreeMemory           string   `xml:"health>memory>minFree"`
+	HealthMaxLoadPerCPU           float64  `xml:"health>load>maxPerCPU"`
+	HealthMaxClockSkewSeconds     int64    `xml:"health>clockSkew>maxSeconds"`
+	HealthRecoverAfterChecks      int      `xml:"health>recoverAfter>checks"`
+}
+
+// Returns the threshold defined by "value" which is either a size or count (e.g. 2g, 10000)
+// or a percentage of "total" (e.g. 5%). Returns 0 if the value is empty.
+func ParseThreshold(value string, total int64) (int64, error) {
+	if value = strings.TrimSpace(value); value == "" {
+		return 0, nil
+	} else if strings.HasSuffix(value, "%") {
+		percentage, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, "%")), 64)
+		if err != nil || percentage < 0 || percentage > 100 {
+			return 0, fmt.Errorf("Invalid percentage '%s', expected a value like 5%%.", value)
+		}
+		return int64(float64(total) * percentage / 100), nil
+	}
+	return ParseByteSize(value)
+}
+
+const (
+	MetricsDescription = `
+<metrics>
+  Serves metrics of the launcher and its agents in the Prometheus text format (e.g. mode status,
+  uptime, restarts by reason, node monitor failures, SSH tunnel state, memory and CPU usage of
+  the Jenkins client on Linux, bytes freed by cleanups and client jar downloads):
+
+    <metrics>
+      <enabled>true</enabled>
+      <address>127.0.0.1:9404</address>
+      <path>/metrics</path>
+    </metrics>
+
+  - address:  The local address (host:port) to listen on. Must be a loopback address
+              (e.g. 127.0.0.1, [::1] or localhost) as the API controls the launcher. Use ":9404" to listen on all interfaces.
+</metrics>
+`)
+
+type Metrics struct {
+	MetricsEnabled                bool     `xml:"metrics>enabled"`
+	MetricsAddress                string   `xml:"metrics>address"`
+	MetricsPath                   string   `xml:"metrics>path"`
+}
+
+const (
+	ControlDescription = `
+<control>
+  Serves a local HTTP/JSON API to query the status of the launcher and to trigger actions:
+
+    <control>
+      <enabled>true</enabled>
+      <address>127.0.0.1:9405</address>
+      <token>...</token>
+    </control>
+
+  - address:  The local address (host:port) to listen on. Must be a loopback address
+              (e.g. 127.0.0.1, [::1] or localhost) as the API controls the launcher.
+  - token:    Must be sent with every request as "Authorization: Bearer [token]".
+              A random token is generated and saved when it is empty.
+
+  Changes of these settings are applied when the launcher is restarted (not on reload).
+
+  Endpoints:
+    GET  /status            Mode and node state, restart history and next scheduled runs of all agents.
+    GET  /config            The effective config with passwords, keys and tokens masked.
+    POST /restart[?agent=]  Restarts the Jenkins client (of all agents or the named agent).
+    POST /stop              Stops all agents and exits the launcher.
+    POST /cleanup           Runs the enabled cleanup settings now.
+    POST /gc                Forces a full GC in the Jenkins client.
+    GET  /stacks            Returns the stack traces of all go routines of the launcher.
+    POST /reload            Reloads the config file and restarts all agents with the new config.
+</control>
+`)
+
+type Control struct {
+	ControlEnabled                bool     `xml:"control>enabled"`
+	ControlAddress                string   `xml:"control>address"`
+	ControlToken                  string   `xml:"control>token"`
+}
+
+// Returns an error if the control API is enabled and the address is not a loopback address.
+func (self *Control) validateAddress() error {
+	if !self.ControlEnabled {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(self.ControlAddress)
+	if err != nil {
+		return fmt.Errorf("Invalid control address '%s'. Cause: %v", self.ControlAddress, err)
+	}
+	if ip := net.ParseIP(host); strings.EqualFold(host, "localhost") || (ip != nil && ip.IsLoopback()) {
+		return nil
+	}
+	return fmt.Errorf("Invalid control address '%s' (only loopback addresses like 127.0.0.1:9405 are allowed).", self.ControlAddress)
+}
+
+// Generates a random control token when the control API is enabled and no token is set.
+func (self *Control) GenerateControlTokenIfMissing() (generated bool) {
+	if self.ControlEnabled && self.ControlToken == "" {
+		token := make([]byte, 24)
+		if _, err := rand.Read(token); err != nil {
+			panic(fmt.Sprintf("Failed generating a control token. Cause: %v", err))
+		}
+		self.ControlToken = hex.EncodeToString(token)
+		return true
+	}
+	return false
+}
+
+const (
+	NotificationsDescription = `
+<notifications>
+  Posts events of the launcher to webhooks (e.g. chat tools or incident management):
+
+    <notifications>
+      <webhook>
+        <url>https://chat.example.com/hooks/...</url>
+        <events>crashLoop,offline,stopped</events>
+        <template>{"text": {{json (printf "%s: %s" .Node .Message)}}}</template>
+        <header name="Authorization">Bearer ...</header>
+      </webhook>
+      <retries>3</retries>
+      <retryDelaySeconds>10</retryDelaySeconds>
+      <timeoutSeconds>10</timeoutSeconds>
+    </notifications>
+
+  - events:       Comma separated names of the events to post (all events when empty):
+                  started, stopped, restart, crashLoop, offline, tunnelLost, cleanup, configReloaded.
+  - template:     A Go text/template that renders the payload (posts the event as JSON when empty).
+                  Available are .Event, .Time, .Node, .Agent, .Host, .Message and .Details
+                  (e.g. {{.Details.cause}}), {{json value}} renders a value as JSON.
+  - contentType:  The content type of the payload (defaults to "application/json").
+  - retries:      The number of retries when posting fails, the delay doubles with every retry.
+</notifications>
+`)
+
+// The names of events that are posted to webhooks.
+const (
+	EventStarted        = "started"
+	EventStopped        = "stopped"
+	EventRestart        = "restart"
+	EventCrashLoop      = "crashLoop"
+	EventOffline        = "offline"
+	EventTunnelLost     = "tunnelLost"
+	EventCleanup        = "cleanup"
+	EventConfigReloaded = "configReloaded"
+)
+
+var AllEvents = []string{EventStarted, EventStopped, EventRestart, EventCrashLoop, EventOffline, EventTunnelLost,
+	EventCleanup, EventConfigReloaded}
+
+// Defines a webhook that receives events of the launcher.
+type Webhook struct {
+	URL         string          `xml:"url"`
+	Events      string          `xml:"events,omitempty"`
+	Template    string          `xml:"template,omitempty"`
+	ContentType string          `xml:"contentType,omitempty"`
+	Headers     []WebhookHeader `xml:"header"`
+}
+
+type WebhookHeader struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+// Returns true if the webhook receives the named event.
+func (self *Webhook) Accepts(event string) bool {
+	if strings.TrimSpace(self.Events) == "" {
+		return true
+	}
+	for _, name := range strings.Split(self.Events, ",") {
+		if strings.EqualFold(strings.TrimSpace(name), event) {
+			return true
+		}
+	}
+	return false
+}
+
+type Notifications struct {
+	Webhooks                      []Webhook `xml:"notifications>webhook"`
+	NotificationRetries           int      `xml:"notifications>retries"`
+	NotificationRetryDelaySeconds int64    `xml:"notifications>retryDelaySeconds"`
+	NotificationTimeoutSeconds    int64    `xml:"notifications>timeoutSeconds"`
+}
+
+const (
+	AgentsDescription = `
+<agents>
+  Allows to run additional Jenkins agents (clients) from this launcher (only for run mode 'client').
+  Every agent inherits all settings of this config and may override them inside its element:
+
+    <agents>
+      <agent name="docker">
+        <client>
+          <secretKey>...</secretKey>
+        </client>
+        <java><maxMemory>1g</maxMemory></java>
+      </agent>
+    </agents>
+
+  - name:  Identifies the agent and is used as node name unless "client>name" is set.
+           Agents keep their files (client jar, logs, snapshots, etc.) in "agents/[name]".
+           Lists that are specified by an agent replace the inherited lists.
+</agents>
+`)
+
+// Defines an additional agent that is run by the launcher.
+type AgentDefinition struct {
+	Name     string `xml:"name,attr"`
+	Settings string `xml:",innerxml"`
+}
+
+var agentNamePattern = regexp.MustCompile("^[A-Za-z0-9._-]+$")
+
 const (
 	ConfigDescription = `
 
@@ -302,12 +1082,12 @@ Configuration file for Jenkins Client Launcher (JCL)
 `)
 
 type Config struct {
-	XMLName           xml.Name `xml:"config"`
+	XMLName           xml.Name `xml:"config" json:"-"`
 	RunMode           string   `xml:"runMode,attr"`
 	Autostart         bool     `xml:"autostart,attr"`
-	ConfigDescription string   `xml:",comment"`
+	ConfigDescription string   `xml:",comment" json:"-"`
 
-	NeedsSave         bool      `xml:"-"`
+	NeedsSave         bool      `xml:"-" json:"-"`
 
 	JenkinsConnection
 	ClientOptions
@@ -315,6 +1095,13 @@ type Config struct {
 	SSHServer
 	ConsoleMonitor
 	Maintenance
+	HealthChecks
+	Metrics
+	Control
+	Notifications
+
+	Agents            []AgentDefinition `xml:"agents>agent"`
+	Agent             *AgentState       `xml:"-" json:"-"`
 }
 
 // Returns a new instance of config with default values.
@@ -330,8 +1117,14 @@ func NewDefaultConfig() *Config {
 				JenkinsConnectionDescription +
 				ClientOptionsDescription +
 				JavaOptionsDescription +
+				ConsoleMonitorDescription +
 				SSHServerDescription +
-				MaintenanceDescription,
+				MaintenanceDescription +
+				HealthChecksDescription +
+				MetricsDescription +
+				ControlDescription +
+				NotificationsDescription +
+				AgentsDescription,
 		JenkinsConnection: JenkinsConnection{
 			CIHostURI: "",
 			CIUsername: "admin", CIPassword: "changeit", CIAcceptAnyCert: false,
@@ -341,18 +1134,65 @@ func NewDefaultConfig() *Config {
 			ClientMonitorStateOnServer: true,
 			ClientMonitorStateOnServerMaxFailures: 2,
 			ClientMonitorConsole: true,
+			ClientConnectTimeoutSeconds: 60 * 5,
+			ClientLocalIdleDetection: true,
+			ClientLocalIdleQuietMinutes: 10,
+			ClientLocalIdleIgnoredProcesses: []string{"conhost.exe"},
 			SecretKey: "",
 			PassCIAuth: false,
 			CreateClientIfMissing: false,
 			HandleReconnectsInLauncher: false,
 			SleepTimeSecondsBetweenFailures: 30,
+			MaxSleepTimeSecondsBetweenFailures: 60 * 15,
+			SleepTimeMultiplier: 2,
+			SleepTimeJitter: 0.2,
+			MaxRestartsPerWindow: 10,
+			RestartWindowMinutes: 60,
+			CrashLoopCooldownMinutes: 30,
+			ResetRestartCountAfterMinutes: 60 * 2,
+			RestartPolicies: []RestartPolicy{
+				RestartPolicy{
+					Reason: RestartReasonOutOfMemory,
+					SleepTimeSeconds: 5,
+					MaxSleepTimeSeconds: 60 * 5,
+					SleepTimeMultiplier: 2,
+					SleepTimeJitter: 0.2,
+					MaxRestartsPerWindow: 5,
+					WindowMinutes: 60,
+					CrashLoopCooldownMinutes: 60,
+					ResetAfterMinutes: 60 * 2,
+				},
+				RestartPolicy{Reason: RestartReasonPeriodic},
+				RestartPolicy{Reason: RestartReasonManual},
+			},
 			PeriodicClientRestartEnabled: false,
 			PeriodicClientRestartOnlyWhenIDLE: true,
 			PeriodicClientRestartIntervalHours: 48,
 			OutOfMemoryRestartEnabled: true,
 			OutOfMemoryRestartOnlyWhenIDLE: true,
+			HeapDumpOnOutOfMemoryEnabled: false,
+			HeapDumpDirectory: "heapdumps",
+			HeapDumpCompress: true,
+			HeapDumpsToKeep: 3,
+			PlannedRestartDrainEnabled: true,
+			PlannedRestartDrainTimeoutMinutes: 120,
+			CGroupEnabled: false,
+			CGroupParent: "jenkins-client-launcher",
+			RemotingWorkDir: "",
+			RemotingJarCache: "",
+			CrashSnapshotsEnabled: true,
+			CrashSnapshotLines: 500,
+			CrashSnapshotDirectory: "crashes",
+			CrashSnapshotsToKeep: 20,
+			DiagnosticsDirectory: "diagnostics",
+			ThreadDumpBeforeRestart: true,
+			HeapHistogramBeforeRestart: false,
+			DiagnosticsToKeep: 20,
 		},
 		JavaOptions: JavaOptions{
+			JavaHome: "",
+			JavaMinVersion: "1.6.0",
+			JavaInstallDirectory: "java",
 			// Configuring java to spend more time in garbage collection instead of using more memory.
 			// We want the memory for IO cache and other build processes and not to be wasted in unused heap.
 			JavaArgs: []string {
@@ -362,6 +1202,8 @@ func NewDefaultConfig() *Config {
 				"-XX:+UseMaximumCompactionOnSystemGC",
 			},
 			JavaMaxMemory: "",
+			JavaMaxMemoryLowerBound: "256m",
+			JavaMaxMemoryUpperBound: "",
 			ForceFullGC: true,
 			ForceFullGCIntervalMinutes: 3,
 			ForceFullGCIDLEIntervalMinutes: 5,
@@ -399,9 +1241,39 @@ func NewDefaultConfig() *Config {
 					Mode: "TTLPerLocation",
 				},
 			},
+			PauseWhileHeldOffline: false,
+		},
+		HealthChecks: HealthChecks{
+			HealthChecksEnabled: false,
+			HealthCheckIntervalSeconds: 60,
+			HealthDiskLocations: []string{"${workspace}", "${temp}"},
+			HealthMinFreeDiskSpace: "2g",
+			HealthMinFreeInodes: "5%",
+			HealthMinFreeMemory: "",
+			HealthMaxLoadPerCPU: 0,
+			HealthMaxClockSkewSeconds: 120,
+			HealthRecoverAfterChecks: 3,
+		},
+		Metrics: Metrics{
+			MetricsEnabled: false,
+			MetricsAddress: "127.0.0.1:9404",
+			MetricsPath: "/metrics",
+		},
+		Control: Control{
+			ControlEnabled: false,
+			ControlAddress: "127.0.0.1:9405",
+			ControlToken: "",
+		},
+		Notifications: Notifications{
+			Webhooks: []Webhook{},
+			NotificationRetries: 3,
+			NotificationRetryDelaySeconds: 10,
+			NotificationTimeoutSeconds: 10,
 		},
 	}
 
+	config.Agent = NewAgentState("", "")
+
 	return config;
 }
 
@@ -411,29 +1283,159 @@ type any interface {
 // Returns a new instance that is initialized from the specified file.
 // If the file cannot be loaded the returned config will be similar to what NewDefaultConfig() returns.
 func NewConfig(fileName string) *Config {
-	config := NewDefaultConfig();
+	config, err := LoadConfig(fileName)
+
+	if err != nil {
+		Out("WARN: Using default configuration. Loading '%v' failed: %v", fileName, err)
+		config = NewDefaultConfig()
+	}
+
+	return config;
+}
 
+// Returns a new instance that is loaded from the specified file or an error if the file cannot be read.
+func LoadConfig(fileName string) (*Config, error) {
 	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
 	defer file.Close()
 
-	if err == nil {
-		Out("Loading configuration from %v", fileName)
+	Out("Loading configuration from %v", fileName)
+
+	config := NewDefaultConfig()
+	if err = config.decode(file); err != nil {
+		return nil, err
+	}
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
 
-		lists := []interface{} {&config.CleanupSettingsList, &config.RestartTriggerTokens, &config.JavaArgs}
-		captures := config.captureLists(lists...)
+	config.NeedsSave = false
+	return config, nil
+}
 
-		if err = xml.NewDecoder(file).Decode(config); err == nil {
-			config.NeedsSave = false;
+// Returns an error if the config contains values that cannot be used.
+func (self *Config) Validate() error {
+	for _, rule := range self.Rules {
+		if err := validateConsoleRuleAction(rule); err != nil {
+			return err
 		}
+	}
+	for _, variable := range self.EnvironmentVariables {
+		if err := variable.validateAction(); err != nil {
+			return err
+		}
+	}
+	return self.Control.validateAddress()
+}
+
+// Returns pointers to the lists of this config that are replaced (instead of appended to) when decoding XML.
+func (self *Config) replacedLists() []interface{} {
+	return []interface{} {&self.CleanupSettingsList, &self.RestartTriggerTokens, &self.JavaArgs, &self.RestartPolicies,
+		&self.Rules, &self.IgnorePatterns, &self.HealthDiskLocations, &self.Webhooks, &self.ClientLocalIdleIgnoredProcesses}
+}
+
+// Decodes XML from the reader into this config.
+// Lists that are not contained in the XML keep their current values, lists that are contained are replaced.
+func (self *Config) decode(reader io.Reader) error {
+	lists := self.replacedLists()
+	captures := self.captureLists(lists...)
+	defer self.restoreListsIfEmpty(captures, lists...)
+
+	return xml.NewDecoder(reader).Decode(self)
+}
 
-		config.restoreListsIfEmpty(captures, lists...)
+// Returns the state of the agent that is run with this config.
+func (self *Config) State() *AgentState {
+	if self.Agent == nil {
+		self.Agent = NewAgentState("", "")
 	}
+	return self.Agent
+}
 
-	if err != nil {
-		Out("WARN: Using default configuration. Loading '%v' failed: %v", fileName, err)
+// Returns the configs of all agents that are run by the launcher, starting with this config.
+// Additional agents are created from a copy of this config with the settings of the agent applied on top.
+func (self *Config) AgentConfigs() ([]*Config, error) {
+	configs := []*Config{self}
+	names := map[string]bool{}
+
+	for _, agent := range self.Agents {
+		if !agentNamePattern.MatchString(agent.Name) {
+			return nil, fmt.Errorf("Invalid agent name '%v' (allowed are letters, digits, '.', '_' and '-').", agent.Name)
+		}
+		if names[strings.ToLower(agent.Name)] {
+			return nil, fmt.Errorf("Agent '%v' is defined more than once.", agent.Name)
+		}
+		names[strings.ToLower(agent.Name)] = true
+
+		config, err := self.clone()
+		if err != nil { return nil, err }
+
+		config.ClientName, config.SecretKey = agent.Name, ""
+		if err = config.decode(strings.NewReader("<config>" + agent.Settings + "</config>")); err != nil {
+			return nil, fmt.Errorf("Failed reading the settings of agent '%v'. Cause: %v", agent.Name, err)
+		}
+		if err = config.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid settings of agent '%v'. Cause: %v", agent.Name, err)
+		}
+
+		directory, err := filepath.Abs(filepath.Join(AgentsDirectory, agent.Name))
+		if err != nil { return nil, err }
+
+		config.Agents = nil
+		config.NeedsSave = false
+		config.Agent = NewAgentState(agent.Name, directory)
+
+		configs = append(configs, config)
 	}
 
-	return config;
+	return configs, nil
+}
+
+// Returns a copy of this config (without runtime state).
+func (self *Config) clone() (*Config, error) {
+	content, err := xml.Marshal(self)
+	if err != nil { return nil, err }
+
+	config := NewDefaultConfig()
+	config.captureLists(config.replacedLists()...)
+	if err = xml.Unmarshal(content, config); err != nil { return nil, err }
+	return config, nil
+}
+
+// The value that replaces secrets in MaskedCopy.
+const MaskedValue = "****"
+
+// Returns a copy of this config with passwords, keys, tokens and sensitive environment variables masked
+// (e.g. to show the effective config). The settings of additional agents are omitted.
+func (self *Config) MaskedCopy() (*Config, error) {
+	config, err := self.clone()
+	if err != nil { return nil, err }
+
+	for _, secret := range []*string{&config.CIPassword, &config.CITunnelSSHPassword, &config.SSHPassword,
+		&config.SecretKey, &config.ControlToken} {
+		if *secret != "" { *secret = MaskedValue }
+	}
+
+	// Webhook URLs of chat tools contain secrets.
+	for i := range config.Webhooks {
+		config.Webhooks[i].URL = MaskedValue
+		for j := range config.Webhooks[i].Headers {
+			config.Webhooks[i].Headers[j].Value = MaskedValue
+		}
+	}
+
+	for i, variable := range config.EnvironmentVariables {
+		if variable.IsSensitive() { config.EnvironmentVariables[i].Value = MaskedValue }
+	}
+
+	for i := range config.Agents {
+		config.Agents[i].Settings = ""
+	}
+
+	config.ConfigDescription, config.NeedsSave = "", false
+	return config, nil
 }
 
 // Captures the specified array lists and returns them as a single 2d array.
@@ -7,6 +7,9 @@ import (
 	"testing"
 	"os"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
 )
 
 func TestLoadsDefaultConfigWhenFileIsMissing(t *testing.T) {
@@ -65,3 +68,201 @@ func TestStringListsAreFilledWithDefaultValuesWhenEmpty(t *testing.T) {
 		t.Errorf("config.JavaArgs != %v, should be %v", in, out)
 	}
 }
+
+func TestConsoleRulesAreRateLimited(t *testing.T) {
+	monitor := &ConsoleMonitor{
+		RestartTriggerTokens: []string{"OutOfMemoryError"},
+		Rules: []ConsoleRule{{Pattern: "Socket.+Exception", Action: ConsoleActionWarn, Matches: 2, WindowMinutes: 1}},
+		IgnorePatterns: []string{"^IGNORE"},
+	}
+	now := time.Now()
+
+	tests := []struct {
+		line    string
+		offset  time.Duration
+		actions string
+	}{
+		{"java.lang.OutOfMemoryError", 0, "[restart]"},
+		{"IGNORE java.lang.OutOfMemoryError", 0, "[]"},
+		{"SocketTimeoutException", 0, "[]"},
+		{"SocketTimeoutException", time.Minute * 2, "[]"},
+		{"SocketTimeoutException", time.Minute * 2 + time.Second, "[warn]"},
+		{"SocketTimeoutException", time.Minute * 2 + time.Second * 2, "[]"},
+	}
+
+	for _, test := range tests {
+		actions := []string{}
+		for _, rule := range monitor.TriggeredRules(test.line, now.Add(test.offset)) {
+			actions = append(actions, rule.Action)
+		}
+
+		if in := fmt.Sprintf("%v", actions); in != test.actions {
+			t.Errorf("monitor.TriggeredRules(%v, +%v) = %v, want %v", test.line, test.offset, in, test.actions)
+		}
+	}
+}
+
+func TestInvalidConsoleRulesAreReported(t *testing.T) {
+	monitor := &ConsoleMonitor{Rules: []ConsoleRule{{Pattern: "(", Action: ConsoleActionWarn}}}
+	if err := monitor.CompileRules(); err == nil {
+		t.Errorf("monitor.CompileRules() did not fail for pattern '('.")
+	}
+}
+
+func TestAgentsInheritAndOverrideSettings(t *testing.T) {
+	defer os.Remove("~agents.xml")
+	ioutil.WriteFile("~agents.xml", []byte(`<config runMode="client">
+	<ci><url>http://jenkins/ci</url></ci>
+	<client><name>main</name><secretKey>abc</secretKey></client>
+	<java><maxMemory>512m</maxMemory></java>
+	<agents>
+		<agent name="docker">
+			<java><maxMemory>1g</maxMemory><args><arg>-Dx=1</arg></args></java>
+		</agent>
+		<agent name="gpu"><client><name>gpu-node</name></client></agent>
+	</agents>
+</config>`), 0600)
+
+	configs, err := NewConfig("~agents.xml").AgentConfigs()
+	if err != nil || len(configs) != 3 {
+		t.Fatalf("config.AgentConfigs() = %v configs, %v, want 3 configs", len(configs), err)
+	}
+
+	main, docker, gpu := configs[0], configs[1], configs[2]
+	if main.State().Name != "" || main.ClientName != "main" || main.SecretKey != "abc" {
+		t.Errorf("Main config was modified: %v, %v, %v", main.State().Name, main.ClientName, main.SecretKey)
+	}
+
+	if docker.CIHostURI != "http://jenkins/ci" || docker.ClientName != "docker" || docker.SecretKey != "" {
+		t.Errorf("Agent 'docker' has url %v, name %v, secret %v", docker.CIHostURI, docker.ClientName, docker.SecretKey)
+	}
+	if docker.JavaMaxMemory != "1g" || fmt.Sprintf("%v", docker.JavaArgs) != "[-Dx=1]" {
+		t.Errorf("Agent 'docker' has maxMemory %v, args %v, want 1g, [-Dx=1]", docker.JavaMaxMemory, docker.JavaArgs)
+	}
+	if gpu.ClientName != "gpu-node" || gpu.JavaMaxMemory != "512m" || len(gpu.JavaArgs) != len(main.JavaArgs) {
+		t.Errorf("Agent 'gpu' has name %v, maxMemory %v, args %v", gpu.ClientName, gpu.JavaMaxMemory, gpu.JavaArgs)
+	}
+
+	if wd, _ := os.Getwd(); docker.State().Path("slave.jar") != filepath.Join(wd, AgentsDirectory, "docker", "slave.jar") {
+		t.Errorf("Agent 'docker' resolves slave.jar to %v", docker.State().Path("slave.jar"))
+	}
+	if len(docker.Agents) != 0 || docker.State() == gpu.State() {
+		t.Errorf("Agent configs must not share agents or state.")
+	}
+}
+
+func TestAgentNamesMustBeValidAndUnique(t *testing.T) {
+	for _, names := range [][]string{{"a/b"}, {""}, {"a", "A"}} {
+		config := NewDefaultConfig()
+		for _, name := range names {
+			config.Agents = append(config.Agents, AgentDefinition{Name: name})
+		}
+		if _, err := config.AgentConfigs(); err == nil {
+			t.Errorf("config.AgentConfigs() accepted agents %v", names)
+		}
+	}
+}
+
+func TestCanParseThresholds(t *testing.T) {
+	tests := map[string]int64{
+		"": 0,
+		"2g": 2 << 30,
+		"10000": 10000,
+		"5%": 50,
+		"12.5%": 125,
+	}
+
+	for value, expected := range tests {
+		if threshold, err := ParseThreshold(value, 1000); err != nil || threshold != expected {
+			t.Errorf("ParseThreshold(%v, 1000) = %v, %v; want %v", value, threshold, err, expected)
+		}
+	}
+
+	if _, err := ParseThreshold("120%", 1000); err == nil {
+		t.Error("ParseThreshold(120%) did not fail.")
+	}
+}
+
+func TestUnknownConsoleRuleActionsAreRejected(t *testing.T) {
+	config := NewDefaultConfig()
+	config.Rules = []ConsoleRule{{Pattern: "FATAL", Action: "reboot"}}
+
+	if err := config.Validate(); err == nil {
+		t.Error("config.Validate() did not fail for action 'reboot'.")
+	}
+	if err := config.ConsoleMonitor.CompileRules(); err == nil {
+		t.Error("config.ConsoleMonitor.CompileRules() did not fail for action 'reboot'.")
+	}
+
+	config.Rules[0].Action = ConsoleActionMarkOffline
+	if err := config.Validate(); err != nil {
+		t.Errorf("config.Validate() failed: %v", err)
+	}
+}
+
+func TestUnknownEnvironmentActionsAreRejected(t *testing.T) {
+	config := NewDefaultConfig()
+	config.EnvironmentVariables = []EnvironmentVariable{{Name: "PATH", Action: "replace", Value: "/opt/bin"}}
+
+	if err := config.Validate(); err == nil {
+		t.Error("config.Validate() did not fail for environment action 'replace'.")
+	}
+
+	config.EnvironmentVariables[0].Action = "Prepend"
+	if err := config.Validate(); err != nil {
+		t.Errorf("config.Validate() failed: %v", err)
+	}
+}
+
+func TestControlAddressMustBeLoopback(t *testing.T) {
+	config := NewDefaultConfig()
+	config.ControlEnabled = true
+
+	for address, valid := range map[string]bool{"127.0.0.1:9405": true, "[::1]:9405": true, "localhost:9405": true,
+		"0.0.0.0:9405": false, ":9405": false, "10.0.0.1:9405": false, "jenkins-node:9405": false, "9405": false} {
+		config.ControlAddress = address
+		if err := config.Validate(); (err == nil) != valid {
+			t.Errorf("config.Validate() with control address '%v' = %v, want valid: %v", address, err, valid)
+		}
+	}
+}
+
+func TestCloneKeepsLists(t *testing.T) {
+	config := NewDefaultConfig()
+	config.Rules = []ConsoleRule{{Pattern: "FATAL", Action: ConsoleActionRestart}}
+	config.IgnorePatterns = []string{"ignored"}
+	config.Webhooks = []Webhook{{URL: "https://hooks.example.com"}}
+
+	clone, err := config.clone()
+	if err != nil {
+		t.Fatalf("config.clone() failed: %v", err)
+	}
+	if in, out := clone.String(), config.String(); in != out {
+		t.Errorf("config.clone() = %v, want %v", in, out)
+	}
+}
+
+func TestMaskedCopyHidesSecrets(t *testing.T) {
+	config := NewDefaultConfig()
+	config.SecretKey, config.ControlToken = "secret", "token"
+	config.EnvironmentVariables = []EnvironmentVariable{{Name: "API_TOKEN", Value: "value"}, {Name: "LANG", Value: "C"}}
+	config.Agents = []AgentDefinition{{Name: "a", Settings: "<client><secretKey>other</secretKey></client>"}}
+
+	masked, err := config.MaskedCopy()
+	if err != nil {
+		t.Fatalf("config.MaskedCopy() failed: %v", err)
+	}
+
+	if masked.CIPassword != MaskedValue || masked.SecretKey != MaskedValue || masked.ControlToken != MaskedValue {
+		t.Errorf("config.MaskedCopy() = %v, %v, %v; want masked secrets", masked.CIPassword, masked.SecretKey, masked.ControlToken)
+	}
+	if masked.EnvironmentVariables[0].Value != MaskedValue || masked.EnvironmentVariables[1].Value != "C" {
+		t.Errorf("config.MaskedCopy().EnvironmentVariables = %v; want only API_TOKEN masked", masked.EnvironmentVariables)
+	}
+	if masked.Agents[0].Settings != "" || masked.CITunnelSSHPassword != "" {
+		t.Errorf("config.MaskedCopy() kept agent settings or masked empty values.")
+	}
+	if config.SecretKey != "secret" {
+		t.Errorf("config.MaskedCopy() modified the config.")
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Holds the compiled console rules and the times when rules matched.
+type consoleRuleState struct {
+	mutex   sync.Mutex
+	rules   []ConsoleRule
+	regexps []*regexp.Regexp
+	ignored []*regexp.Regexp
+	matches map[int][]time.Time
+}
+
+// Guards the compiled state of all console monitors (rules are used by the stdout and stderr readers concurrently).
+var consoleRuleStateMutex sync.Mutex
+
+// Returns an error if the action of a console rule is unknown.
+func validateConsoleRuleAction(rule ConsoleRule) error {
+	switch rule.Action {
+	case ConsoleActionRestart, ConsoleActionRestartWhenIdle, ConsoleActionMarkOffline, ConsoleActionWarn, ConsoleActionHook, "":
+		return nil
+	}
+	return fmt.Errorf("Invalid action '%s' of console rule '%s' (allowed are %s, %s, %s, %s and %s).", rule.Action, rule.Pattern,
+		ConsoleActionRestart, ConsoleActionRestartWhenIdle, ConsoleActionMarkOffline, ConsoleActionWarn, ConsoleActionHook)
+}
+
+// Compiles the configured tokens, rules and ignore patterns and returns an error if a pattern is invalid.
+// Calling this method is optional as rules are compiled on first use.
+func (self *ConsoleMonitor) CompileRules() error {
+	state := &consoleRuleState{matches: map[int][]time.Time{}}
+
+	for _, token := range self.RestartTriggerTokens {
+		state.rules = append(state.rules, ConsoleRule{Pattern: regexp.QuoteMeta(token), Action: ConsoleActionRestart})
+	}
+	state.rules = append(state.rules, self.Rules...)
+
+	for _, rule := range state.rules {
+		if err := validateConsoleRuleAction(rule); err != nil {
+			return err
+		}
+		if expression, err := regexp.Compile(rule.Pattern); err == nil {
+			state.regexps = append(state.regexps, expression)
+		} else {
+			return fmt.Errorf("Invalid console rule pattern '%s'. Cause: %v", rule.Pattern, err)
+		}
+	}
+
+	for _, pattern := range self.IgnorePatterns {
+		if expression, err := regexp.Compile(pattern); err == nil {
+			state.ignored = append(state.ignored, expression)
+		} else {
+			return fmt.Errorf("Invalid console ignore pattern '%s'. Cause: %v", pattern, err)
+		}
+	}
+
+	consoleRuleStateMutex.Lock(); defer consoleRuleStateMutex.Unlock()
+	self.state = state
+	return nil
+}
+
+// Returns the compiled rules, compiling them on first use.
+func (self *ConsoleMonitor) compiledState() *consoleRuleState {
+	consoleRuleStateMutex.Lock()
+	state := self.state
+	consoleRuleStateMutex.Unlock()
+
+	if state == nil {
+		if err := self.CompileRules(); err != nil {
+			GOut("console", "WARN: Console rules are disabled. %v", err)
+			consoleRuleStateMutex.Lock()
+			self.state = &consoleRuleState{}
+			consoleRuleStateMutex.Unlock()
+		}
+		return self.compiledState()
+	}
+	return state
+}
+
+// Returns the rules whose action is to be performed for the given console line.
+// Restart tokens are returned as rules with action "restart".
+func (self *ConsoleMonitor) TriggeredRules(line string, now time.Time) (triggered []ConsoleRule) {
+	state := self.compiledState()
+	for _, expression := range state.ignored {
+		if expression.MatchString(line) {
+			return
+		}
+	}
+
+	state.mutex.Lock(); defer state.mutex.Unlock()
+
+	for index, expression := range state.regexps {
+		if !expression.MatchString(line) {
+			continue
+		}
+
+		rule := state.rules[index]
+		if rule.Matches <= 1 {
+			triggered = append(triggered, rule)
+			continue
+		}
+
+		// Applying the rate limit: the rule triggers after "Matches" matches within "WindowMinutes".
+		times := append(state.matches[index], now)
+		if rule.WindowMinutes > 0 {
+			windowStart := now.Add(-time.Minute * time.Duration(rule.WindowMinutes))
+			for len(times) > 0 && times[0].Before(windowStart) {
+				times = times[1:]
+			}
+		}
+
+		if len(times) >= rule.Matches {
+			triggered = append(triggered, rule)
+			times = nil
+		}
+		state.matches[index] = times
+	}
+
+	return
+}
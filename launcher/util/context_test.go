@@ -0,0 +1,42 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSleepEndsWhenContextIsDone(t *testing.T) {
+	if !Sleep(context.Background(), time.Millisecond) {
+		t.Error("Expected Sleep to return true when the duration elapsed.")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if Sleep(ctx, time.Hour) {
+		t.Error("Expected Sleep to return false when the context is done.")
+	}
+}
+
+func TestEveryStopsWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls, stopped := 0, make(chan bool)
+
+	go func() {
+		Every(ctx, time.Millisecond, func() {
+			if calls++; calls == 3 { cancel() }
+		})
+		stopped <- true
+	}()
+
+	select {
+	case <-stopped:
+		if calls != 3 { t.Errorf("Expected 3 calls before the context was done, got %v.", calls) }
+	case <-time.After(time.Second * 5):
+		t.Error("Expected Every to return when the context is done.")
+	}
+}
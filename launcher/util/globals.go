@@ -4,30 +4,102 @@
 package util
 
 import (
+	"io"
 	"os"
+	"path/filepath"
 	"runtime/pprof"
 	"sync"
 )
 
-// Points to the absolute path of the Jenkins client jar.
-var ClientJar = ""
+// Is the directory (relative to the working directory) that contains the files of additional agents.
+const AgentsDirectory = "agents"
 
-// Is updated by the server monitor with the current node state (IDLE means no build is running).
-// Note: When server side monitoring is disable the node will ALWAYS appear as idle.
-var NodeIsIdle = NewAtomicBoolean()
+// Holds the runtime state of a Jenkins agent (client) that is run by the launcher.
+type AgentState struct {
+	// Is the name of the agent ("" for the agent that is defined by the main config).
+	Name string
 
-// Points to the absolute path of the Java executable.
-var Java = ""
+	// Is the directory that contains the files of the agent ("" for the working directory).
+	Directory string
 
-// Contains additional java args that are added before the configured java args.
-var JavaArgs = []string{}
+	// Points to the absolute path of the Jenkins client jar.
+	ClientJar string
 
-// Contains additional arguments that must be injected into the JNLP config file that is downloaded from Jenkins.
-var JnlpArgs = make(map[string]string)
+	// Is updated by the server monitor with the current node state (IDLE means no build is running).
+	// Note: When server side monitoring is disable the node will ALWAYS appear as idle.
+	NodeIsIdle *AtomicBoolean
+
+	// Is true while the node is marked offline in Jenkins to let running builds finish before a planned restart.
+	Draining *AtomicBoolean
+
+	// Is true while the node is marked offline in Jenkins as the health checks of the host failed.
+	Unhealthy *AtomicBoolean
+
+	// Is true while the node is held temporarily offline in Jenkins by a user or administrator.
+	HeldOffline *AtomicBoolean
+
+	// Points to the absolute path of the Java executable.
+	Java string
+
+	// Contains additional java args that are added before the configured java args.
+	JavaArgs []string
+
+	// Contains directories that the client process writes to (handed over to the user when running as a different user).
+	WritableDirectories []string
+
+	// Points to the cgroup directory that the client process is placed in (Linux only, empty if not used).
+	ClientCGroup string
+
+	// Contains additional arguments that must be injected into the JNLP config file that is downloaded from Jenkins.
+	JnlpArgs map[string]string
+}
+
+func NewAgentState(name, directory string) *AgentState {
+	s := new(AgentState)
+	s.Name, s.Directory = name, directory
+	s.NodeIsIdle = NewAtomicBoolean()
+	s.Draining = NewAtomicBoolean()
+	s.Unhealthy = NewAtomicBoolean()
+	s.HeldOffline = NewAtomicBoolean()
+	s.JavaArgs = []string{}
+	s.JnlpArgs = make(map[string]string)
+	return s
+}
+
+// Resolves the path relative to the directory of the agent.
+func (self *AgentState) Path(path string) string {
+	if self.Directory == "" || path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(self.Directory, path)
+}
+
+var allAgents = []*AgentState{}
+var allAgentsMutex sync.Mutex
+
+// Sets the agents that are run by the launcher (replacing agents that were set before, e.g. on config reload).
+func SetAgents(agents []*AgentState) {
+	allAgentsMutex.Lock(); defer allAgentsMutex.Unlock()
+	allAgents = agents
+}
+
+// Returns true if no build is running on any of the registered agents.
+func AllAgentsAreIdle() bool {
+	allAgentsMutex.Lock(); defer allAgentsMutex.Unlock()
+	for _, agent := range allAgents {
+		if !agent.NodeIsIdle.Get() { return false }
+	}
+	return true
+}
 
 // Prints stack traces of all go routines.
 func PrintAllStackTraces() {
-	pprof.Lookup("goroutine").WriteTo(os.Stdout, 1)
+	WriteAllStackTraces(os.Stdout)
+}
+
+// Writes stack traces of all go routines to the writer.
+func WriteAllStackTraces(writer io.Writer) {
+	pprof.Lookup("goroutine").WriteTo(writer, 1)
 }
 
 // Thread save boolean value.
@@ -52,6 +124,16 @@ func (self *AtomicBoolean) Get() bool {
 	return self.value
 }
 
+// Sets the value to "update" if the current value is "expect" and returns true if the value was set.
+func (self *AtomicBoolean) CompareAndSet(expect, update bool) bool {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	if self.value == expect {
+		self.value = update
+		return true
+	}
+	return false
+}
+
 // Thread save boolean value.
 type AtomicInt32 struct {
 	value int32
@@ -74,6 +156,16 @@ func (self *AtomicInt32) Get() int32 {
 	return self.value
 }
 
+// Sets the value to "update" if the current value is "expect" and returns true if the value was set.
+func (self *AtomicInt32) CompareAndSet(expect, update int32) bool {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	if self.value == expect {
+		self.value = update
+		return true
+	}
+	return false
+}
+
 func (self *AtomicInt32) AddAndGet(delta int32) int32 {
 	self.mutex.Lock(); defer self.mutex.Unlock()
 	self.value += delta
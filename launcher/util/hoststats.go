@@ -0,0 +1,16 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+// Describes the usage of the filesystem that contains a path.
+type DiskUsage struct {
+	// Is the space in bytes that is available to unprivileged users.
+	Free int64
+	// Is the size of the filesystem in bytes.
+	Total int64
+	// Is the number of free inodes (0 if the filesystem or OS doesn't report inodes).
+	FreeInodes int64
+	// Is the number of inodes (0 if the filesystem or OS doesn't report inodes).
+	TotalInodes int64
+}
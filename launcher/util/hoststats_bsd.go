@@ -0,0 +1,27 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+// +build darwin freebsd netbsd openbsd dragonfly
+
+package util
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Returns the system load averaged over the last 5 minutes (from "sysctl vm.loadavg").
+func LoadAverage() (float64, error) {
+	output, err := exec.Command("sysctl", "-n", "vm.loadavg").Output()
+	if err != nil {
+		return 0, err
+	}
+
+	// Format is "{ 1.23 1.45 1.67 }"
+	if fields := strings.Fields(strings.Trim(strings.TrimSpace(string(output)), "{}")); len(fields) >= 2 {
+		return strconv.ParseFloat(fields[1], 64)
+	}
+	return 0, fmt.Errorf("Unexpected output of sysctl vm.loadavg: %s", output)
+}
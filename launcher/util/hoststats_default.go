@@ -0,0 +1,26 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+// +build !windows
+
+package util
+
+import (
+	"syscall"
+)
+
+// Returns the usage of the filesystem that contains the specified path (from "statfs").
+func GetDiskUsage(path string) (*DiskUsage, error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return nil, err
+	}
+
+	blockSize := int64(stat.Bsize)
+	return &DiskUsage{
+		Free: int64(stat.Bavail) * blockSize,
+		Total: int64(stat.Blocks) * blockSize,
+		FreeInodes: int64(stat.Ffree),
+		TotalInodes: int64(stat.Files),
+	}, nil
+}
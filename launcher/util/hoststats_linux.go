@@ -0,0 +1,24 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Returns the system load averaged over the last 5 minutes (from /proc/loadavg).
+func LoadAverage() (float64, error) {
+	content, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+
+	if fields := strings.Fields(string(content)); len(fields) >= 2 {
+		return strconv.ParseFloat(fields[1], 64)
+	}
+	return 0, fmt.Errorf("Unexpected content in /proc/loadavg: %s", content)
+}
@@ -0,0 +1,16 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+// +build !linux,!windows,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package util
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Returns an error as the system load cannot be read on this OS.
+func LoadAverage() (float64, error) {
+	return 0, fmt.Errorf("Reading the system load is not supported on %v.", runtime.GOOS)
+}
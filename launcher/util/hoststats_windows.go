@@ -0,0 +1,33 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// Returns the usage of the filesystem that contains the specified path (from "GetDiskFreeSpaceEx").
+// Inodes are not reported on Windows.
+func GetDiskUsage(path string) (*DiskUsage, error) {
+	pathPointer, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var free, total, totalFree uint64
+	if result, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(pathPointer)),
+		uintptr(unsafe.Pointer(&free)), uintptr(unsafe.Pointer(&total)), uintptr(unsafe.Pointer(&totalFree))); result == 0 {
+		return nil, err
+	}
+	return &DiskUsage{Free: int64(free), Total: int64(total)}, nil
+}
+
+// The load average is not available on Windows.
+func LoadAverage() (float64, error) {
+	return 0, fmt.Errorf("The load average is not supported on Windows.")
+}
@@ -0,0 +1,78 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Returns the memory that is available to processes started by the launcher, which is the smaller value
+// of the physical memory and the memory limits of the cgroups that apply to the client.
+func AvailableMemory(config *Config) (available int64, source string, err error) {
+	if available, err = TotalMemory(); err != nil {
+		return 0, "", err
+	}
+	source = "RAM"
+
+	if limit := memoryLimit(); limit > 0 && limit < available {
+		available, source = limit, "cgroup limit"
+	}
+
+	if config.CGroupEnabled && config.CGroupMemoryMax != "" {
+		if limit, err := ParseByteSize(config.CGroupMemoryMax); err == nil && limit > 0 && limit < available {
+			available, source = limit, "cgroup memoryMax"
+		}
+	}
+	return
+}
+
+// Computes the value of java's "-Xmx" option from "java>maxMemory" and its bounds.
+// Returns "" when no max memory is configured and the JVM should use its defaults.
+func (self *JavaOptions) ComputeJavaMaxMemory(available int64) (string, error) {
+	value := strings.TrimSpace(self.JavaMaxMemory)
+	if value == "" {
+		return "", nil
+	}
+
+	var maxMemory int64
+	if strings.HasSuffix(value, "%") {
+		percentage, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, "%")), 64)
+		if err != nil || percentage <= 0 || percentage > 100 {
+			return "", fmt.Errorf("Invalid percentage '%s', expected a value like 25%%.", value)
+		}
+		if available <= 0 {
+			return "", fmt.Errorf("Cannot compute %s of the memory as the available memory is unknown.", value)
+		}
+		maxMemory = int64(float64(available) * percentage / 100)
+	} else {
+		var err error
+		if maxMemory, err = ParseByteSize(value); err != nil {
+			return "", err
+		}
+	}
+
+	if self.JavaMaxMemoryLowerBound != "" {
+		if bound, err := ParseByteSize(self.JavaMaxMemoryLowerBound); err != nil {
+			return "", err
+		} else if maxMemory < bound {
+			maxMemory = bound
+		}
+	}
+
+	if self.JavaMaxMemoryUpperBound != "" {
+		if bound, err := ParseByteSize(self.JavaMaxMemoryUpperBound); err != nil {
+			return "", err
+		} else if maxMemory > bound {
+			maxMemory = bound
+		}
+	}
+
+	// Java expects sizes aligned to 1k, using megabytes keeps the value readable.
+	if maxMemory >= 1 << 20 {
+		return fmt.Sprintf("%dm", maxMemory >> 20), nil
+	}
+	return fmt.Sprintf("%dk", (maxMemory + 1023) >> 10), nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Returns the physical memory in bytes (from "sysctl hw.memsize").
+func TotalMemory() (int64, error) {
+	output, err := exec.Command("sysctl", "-n", "hw.memsize").Output()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+}
+
+var vmStatPageSizePattern = regexp.MustCompile(`page size of (\d+) bytes`)
+
+// Returns the memory in bytes that is available for starting new applications
+// (free, inactive and speculative pages reported by "vm_stat").
+func FreeMemory() (int64, error) {
+	output, err := exec.Command("vm_stat").Output()
+	if err != nil {
+		return 0, err
+	}
+
+	match := vmStatPageSizePattern.FindStringSubmatch(string(output))
+	if match == nil {
+		return 0, fmt.Errorf("Page size not found in the output of vm_stat.")
+	}
+	pageSize, _ := strconv.ParseInt(match[1], 10, 64)
+
+	pages := int64(0)
+	for _, line := range strings.Split(string(output), "\n") {
+		if parts := strings.SplitN(line, ":", 2); len(parts) == 2 {
+			switch parts[0] {
+			case "Pages free", "Pages inactive", "Pages speculative":
+				if count, err := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(parts[1]), ".")), 10, 64); err == nil {
+					pages += count
+				}
+			}
+		}
+	}
+	return pages * pageSize, nil
+}
+
+// Memory limits are not supported on OSX.
+func memoryLimit() int64 {
+	return 0
+}
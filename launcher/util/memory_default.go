@@ -0,0 +1,26 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+// +build !linux,!darwin,!windows
+
+package util
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Returns an error as the physical memory cannot be read on this OS.
+func TotalMemory() (int64, error) {
+	return 0, fmt.Errorf("Reading the physical memory is not supported on %v.", runtime.GOOS)
+}
+
+// Returns an error as the free memory cannot be read on this OS.
+func FreeMemory() (int64, error) {
+	return 0, fmt.Errorf("Reading the free memory is not supported on %v.", runtime.GOOS)
+}
+
+// Returns 0 as memory limits are not known on this OS.
+func memoryLimit() int64 {
+	return 0
+}
@@ -0,0 +1,89 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Is the location of the cgroup filesystem.
+var cgroupFilesystem = "/sys/fs/cgroup"
+
+// Returns the physical memory in bytes (from /proc/meminfo).
+func TotalMemory() (int64, error) {
+	content, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "MemTotal:" {
+			if kb, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				return kb * 1024, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("MemTotal not found in /proc/meminfo")
+}
+
+// Returns the memory in bytes that is available for starting new applications (from /proc/meminfo).
+func FreeMemory() (int64, error) {
+	content, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			if kb, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				return kb * 1024, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("MemAvailable not found in /proc/meminfo")
+}
+
+// Returns the memory limit of the cgroup that the launcher runs in (e.g. inside a container) or 0 if unlimited.
+func memoryLimit() int64 {
+	content, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return 0
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		// Format is "hierarchy-ID:controller-list:cgroup-path"
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		var file string
+		if parts[0] == "0" && parts[1] == "" {
+			file = filepath.Join(cgroupFilesystem, parts[2], "memory.max")
+		} else if strings.Contains(","+parts[1]+",", ",memory,") {
+			file = filepath.Join(cgroupFilesystem, "memory", parts[2], "memory.limit_in_bytes")
+		} else {
+			continue
+		}
+
+		if limit := readMemoryLimit(file); limit > 0 {
+			return limit
+		}
+	}
+	return 0
+}
+
+// Reads a cgroup memory limit file, returning 0 when the file is missing or the limit is not set.
+func readMemoryLimit(file string) int64 {
+	if content, err := ioutil.ReadFile(file); err == nil {
+		if limit, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64); err == nil && limit > 0 && limit < 1 << 60 {
+			return limit
+		}
+	}
+	return 0
+}
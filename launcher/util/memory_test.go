@@ -0,0 +1,41 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"testing"
+)
+
+func TestCanComputeJavaMaxMemory(t *testing.T) {
+	gb := int64(1 << 30)
+	tests := []struct {
+		options   JavaOptions
+		available int64
+		out       string
+	}{
+		{JavaOptions{JavaMaxMemory: ""}, 8 * gb, ""},
+		{JavaOptions{JavaMaxMemory: "512m"}, 8 * gb, "512m"},
+		{JavaOptions{JavaMaxMemory: "25%"}, 8 * gb, "2048m"},
+		{JavaOptions{JavaMaxMemory: "30 %"}, 10 * gb, "3072m"},
+		{JavaOptions{JavaMaxMemory: "25%", JavaMaxMemoryLowerBound: "1g"}, 2 * gb, "1024m"},
+		{JavaOptions{JavaMaxMemory: "50%", JavaMaxMemoryUpperBound: "4g"}, 64 * gb, "4096m"},
+	}
+
+	for _, test := range tests {
+		if in, err := test.options.ComputeJavaMaxMemory(test.available); in != test.out || err != nil {
+			t.Errorf("%v.ComputeJavaMaxMemory(%v) = %v, %v, want %v", test.options.JavaMaxMemory, test.available, in, err, test.out)
+		}
+	}
+
+	for _, value := range []string{"0%", "101%", "x%", "12x"} {
+		options := JavaOptions{JavaMaxMemory: value}
+		if _, err := options.ComputeJavaMaxMemory(8 * gb); err == nil {
+			t.Errorf("%v.ComputeJavaMaxMemory(...) did not fail.", value)
+		}
+	}
+
+	if _, err := (&JavaOptions{JavaMaxMemory: "25%"}).ComputeJavaMaxMemory(0); err == nil {
+		t.Errorf("ComputeJavaMaxMemory(0) did not fail for a percentage.")
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var globalMemoryStatusEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GlobalMemoryStatusEx")
+
+// Corresponds to the MEMORYSTATUSEX struct of the Windows API.
+type memoryStatusEx struct {
+	length               uint32
+	memoryLoad           uint32
+	totalPhys            uint64
+	availPhys            uint64
+	totalPageFile        uint64
+	availPageFile        uint64
+	totalVirtual         uint64
+	availVirtual         uint64
+	availExtendedVirtual uint64
+}
+
+// Returns the physical memory in bytes (from "GlobalMemoryStatusEx").
+func TotalMemory() (int64, error) {
+	status := memoryStatusEx{}
+	status.length = uint32(unsafe.Sizeof(status))
+
+	if result, _, err := globalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status))); result == 0 {
+		return 0, err
+	}
+	return int64(status.totalPhys), nil
+}
+
+// Returns the memory in bytes that is available for starting new applications (from "GlobalMemoryStatusEx").
+func FreeMemory() (int64, error) {
+	status := memoryStatusEx{}
+	status.length = uint32(unsafe.Sizeof(status))
+
+	if result, _, err := globalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status))); result == 0 {
+		return 0, err
+	}
+	return int64(status.availPhys), nil
+}
+
+// Memory limits (job objects) are not evaluated on Windows.
+func memoryLimit() int64 {
+	return 0
+}
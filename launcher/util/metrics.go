@@ -0,0 +1,142 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Names of the metrics that are exported by the launcher.
+const (
+	MetricLauncherUptime     = "jcl_launcher_uptime_seconds"
+	MetricConfigLoaded       = "jcl_config_loaded_timestamp_seconds"
+	MetricModeStatus         = "jcl_mode_status"
+	MetricClientUptime       = "jcl_client_uptime_seconds"
+	MetricClientRestarts     = "jcl_client_restarts_total"
+	MetricClientMemory       = "jcl_client_resident_memory_bytes"
+	MetricClientCPU          = "jcl_client_cpu_seconds_total"
+	MetricClientJarDownloads = "jcl_client_jar_downloads_total"
+	MetricMonitorFailures    = "jcl_node_monitor_failures_total"
+	MetricTunnelConnected    = "jcl_ssh_tunnel_connected"
+	MetricCleanupFreedBytes  = "jcl_cleanup_freed_bytes_total"
+)
+
+// Contains type and help text per metric.
+var metricDefinitions = map[string][2]string{
+	MetricLauncherUptime:     {"gauge", "Seconds since the launcher was started."},
+	MetricConfigLoaded:       {"gauge", "Unix time when the launcher config was loaded."},
+	MetricModeStatus:         {"gauge", "Status of the run mode (1 for the current status)."},
+	MetricClientUptime:       {"gauge", "Seconds since the run mode was started (0 when stopped)."},
+	MetricClientRestarts:     {"counter", "Number of times the run mode stopped and was restarted, by reason."},
+	MetricClientMemory:       {"gauge", "Resident memory of the Jenkins client process in bytes."},
+	MetricClientCPU:          {"counter", "CPU time used by the Jenkins client process in seconds."},
+	MetricClientJarDownloads: {"counter", "Number of Jenkins client jar downloads, by result."},
+	MetricMonitorFailures:    {"counter", "Number of times the node monitor found the node offline or Jenkins unreachable."},
+	MetricTunnelConnected:    {"gauge", "1 if the SSH tunnel to Jenkins is connected."},
+	MetricCleanupFreedBytes:  {"counter", "Bytes freed by cleaning expired files."},
+}
+
+// Contains the samples per metric and rendered label set.
+var metricSamples = map[string]map[string]float64{}
+var metricCollectors = []func(){}
+var metricsMutex sync.Mutex
+
+// Sets the metric with the specified labels (pairs of name and value) to "value".
+func SetMetric(name string, value float64, labels ...string) {
+	metricsMutex.Lock(); defer metricsMutex.Unlock()
+	samples(name)[formatLabels(labels)] = value
+}
+
+// Adds "delta" to the metric with the specified labels (pairs of name and value).
+func AddMetric(name string, delta float64, labels ...string) {
+	metricsMutex.Lock(); defer metricsMutex.Unlock()
+	samples(name)[formatLabels(labels)] += delta
+}
+
+// Increments the metric with the specified labels (pairs of name and value) by one.
+func CountMetric(name string, labels ...string) {
+	AddMetric(name, 1, labels...)
+}
+
+// Removes all samples and collectors (used by tests).
+func resetMetrics() {
+	metricsMutex.Lock(); defer metricsMutex.Unlock()
+	metricSamples, metricCollectors = map[string]map[string]float64{}, []func(){}
+}
+
+// Registers a function that updates metrics before they are written.
+func RegisterMetricsCollector(collector func()) {
+	metricsMutex.Lock(); defer metricsMutex.Unlock()
+	metricCollectors = append(metricCollectors, collector)
+}
+
+// Writes all metrics in the Prometheus text format.
+func WriteMetrics(writer io.Writer) error {
+	metricsMutex.Lock()
+	collectors := metricCollectors
+	metricsMutex.Unlock()
+
+	for _, collector := range collectors {
+		collector()
+	}
+
+	metricsMutex.Lock(); defer metricsMutex.Unlock()
+
+	names := []string{}
+	for name := range metricSamples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		definition := metricDefinitions[name]
+		if _, err := fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", name, definition[1], name, definition[0]); err != nil {
+			return err
+		}
+
+		labelSets := []string{}
+		for labels := range metricSamples[name] {
+			labelSets = append(labelSets, labels)
+		}
+		sort.Strings(labelSets)
+
+		for _, labels := range labelSets {
+			value := strconv.FormatFloat(metricSamples[name][labels], 'g', -1, 64)
+			if _, err := fmt.Fprintf(writer, "%s%s %s\n", name, labels, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func samples(name string) map[string]float64 {
+	if _, defined := metricDefinitions[name]; !defined {
+		panic("Undefined metric " + name)
+	}
+	if metricSamples[name] == nil {
+		metricSamples[name] = map[string]float64{}
+	}
+	return metricSamples[name]
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Formats label pairs as "{name="value",...}" (or "" without labels).
+func formatLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+
+	pairs := []string{}
+	for i := 0; i + 1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelValueEscaper.Replace(labels[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
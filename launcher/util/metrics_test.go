@@ -0,0 +1,38 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsAreWrittenInPrometheusFormat(t *testing.T) {
+	resetMetrics()
+	defer resetMetrics()
+
+	CountMetric(MetricClientRestarts, "node", "my-node", "reason", RestartReasonCrash)
+	CountMetric(MetricClientRestarts, "node", "my-node", "reason", RestartReasonCrash)
+	AddMetric(MetricCleanupFreedBytes, 1024, "node", `a"b\c`)
+	RegisterMetricsCollector(func() { SetMetric(MetricLauncherUptime, 1.5) })
+
+	buffer := new(bytes.Buffer)
+	if err := WriteMetrics(buffer); err != nil {
+		t.Fatalf("WriteMetrics(...) failed: %v", err)
+	}
+
+	expected := []string{
+		"# HELP jcl_cleanup_freed_bytes_total Bytes freed by cleaning expired files.\n# TYPE jcl_cleanup_freed_bytes_total counter\n",
+		`jcl_cleanup_freed_bytes_total{node="a\"b\\c"} 1024` + "\n",
+		"# TYPE jcl_client_restarts_total counter\n" + `jcl_client_restarts_total{node="my-node",reason="crash"} 2` + "\n",
+		"# TYPE jcl_launcher_uptime_seconds gauge\njcl_launcher_uptime_seconds 1.5\n",
+	}
+
+	for _, text := range expected {
+		if !strings.Contains(buffer.String(), text) {
+			t.Errorf("WriteMetrics(...) = %v, missing %v", buffer.String(), text)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	NodeOfflineStateURI = "computer/%s/api/xml?tree=temporarilyOffline"
+	NodeToggleOfflineURI = "computer/%s/toggleOffline?offlineMessage=%s"
+)
+
+// Starts the offline message when the launcher marks a node temporarily offline.
+const OfflineMessagePrefix = "JCL: "
+
+// Returns true if the offline message was set by the launcher (and not by a user or administrator).
+func IsLauncherOfflineMessage(message string) bool {
+	return strings.HasPrefix(message, OfflineMessagePrefix)
+}
+
+// Returns true if the node is marked temporarily offline in Jenkins.
+func (self *JenkinsConnection) IsNodeTemporarilyOffline(nodeName string) (bool, error) {
+	response, err := self.CIGet(fmt.Sprintf(NodeOfflineStateURI, nodeName))
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return false, fmt.Errorf(response.Status)
+	}
+
+	state := &struct {
+		TemporarilyOffline bool `xml:"temporarilyOffline"`
+	}{}
+	err = xml.NewDecoder(response.Body).Decode(state)
+	return state.TemporarilyOffline, err
+}
+
+// Marks the node temporarily offline in Jenkins using the given message as offline cause (offline = true)
+// or brings it back online (offline = false). Does nothing if the node is in the requested state already.
+func (self *JenkinsConnection) SetNodeTemporarilyOffline(nodeName string, offline bool, message string) error {
+	if isOffline, err := self.IsNodeTemporarilyOffline(nodeName); err != nil {
+		return err
+	} else if isOffline == offline {
+		return nil
+	}
+
+	request, err := self.CIRequest("POST", fmt.Sprintf(NodeToggleOfflineURI, nodeName, url.QueryEscape(message)), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := self.CIClient().Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return fmt.Errorf("Toggling the offline state failed. Jenkins returned %v", response.Status)
+	}
+	return nil
+}
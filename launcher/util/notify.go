@@ -0,0 +1,170 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Is an event of the launcher that is posted to webhooks.
+type Event struct {
+	Event   string                 `json:"event"`
+	Time    time.Time              `json:"time"`
+	Node    string                 `json:"node"`
+	Agent   string                 `json:"agent,omitempty"`
+	Host    string                 `json:"host"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Contains the functions that can be used in webhook templates.
+var webhookTemplateFunctions = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		content, err := json.Marshal(value)
+		return string(content), err
+	},
+}
+
+// Returns the name of the webhook at the specified index of the config (used in logs instead of the URL).
+func WebhookName(index int) string {
+	return fmt.Sprintf("webhook-%d", index + 1)
+}
+
+// Returns the webhook URL without path, query and user info (which often contain secrets) for logging.
+func (self *Webhook) RedactedURL() string {
+	if target, err := url.Parse(self.URL); err == nil && target.Host != "" {
+		return target.Scheme + "://" + target.Host
+	}
+	return MaskedValue
+}
+
+// Returns the cause of a failed request without the request URL (which may contain secrets).
+func redactRequestError(err error) error {
+	if urlError, ok := err.(*url.Error); ok {
+		return fmt.Errorf("%s failed: %v", urlError.Op, urlError.Err)
+	}
+	return err
+}
+
+// Parses the template of the webhook with the specified name (returns nil if no template is set).
+func (self *Webhook) ParseTemplate(name string) (*template.Template, error) {
+	if self.Template == "" {
+		return nil, nil
+	}
+	return template.New(name).Funcs(webhookTemplateFunctions).Parse(self.Template)
+}
+
+// Returns the payload of the event as it is posted to the webhook with the specified name.
+func (self *Webhook) Payload(name string, event *Event) ([]byte, error) {
+	tpl, err := self.ParseTemplate(name)
+	if err != nil {
+		return nil, err
+	} else if tpl == nil {
+		return json.Marshal(event)
+	}
+
+	buffer := new(bytes.Buffer)
+	if err = tpl.Execute(buffer, event); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Tracks notifications that are still being delivered.
+var pendingNotifications sync.WaitGroup
+
+// Posts an event with the specified name (one of Event*) to all webhooks of the config that accept the event.
+// Delivery happens in the background and is retried according to the config.
+func Notify(config *Config, name, message string, details map[string]interface{}) {
+	if len(config.Webhooks) == 0 {
+		return
+	}
+
+	host, _ := Hostname()
+	event := &Event{Event: name, Time: time.Now(), Node: config.ClientName, Agent: config.State().Name,
+		Host: host, Message: message, Details: details}
+
+	for index, webhook := range config.Webhooks {
+		if !webhook.Accepts(name) {
+			continue
+		}
+
+		pendingNotifications.Add(1)
+		go func(webhookName string, webhook Webhook) {
+			defer pendingNotifications.Done()
+			if err := deliverNotification(config, webhookName, &webhook, event); err != nil {
+				GOut("notify", "ERROR: Failed posting event '%v' to %v (%v). Cause: %v", name, webhookName, webhook.RedactedURL(), err)
+			}
+		}(WebhookName(index), webhook)
+	}
+}
+
+// Waits until pending notifications were delivered or the timeout elapsed (e.g. before the launcher exits).
+func WaitForNotifications(timeout time.Duration) {
+	done := make(chan bool)
+	go func() {
+		pendingNotifications.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		GOut("notify", "WARN: Not all notifications were delivered within %v.", timeout)
+	}
+}
+
+// Posts the event to the webhook, retrying with increasing delays on failures.
+func deliverNotification(config *Config, webhookName string, webhook *Webhook, event *Event) error {
+	payload, err := webhook.Payload(webhookName, event)
+	if err != nil {
+		return err
+	}
+
+	contentType := webhook.ContentType
+	if contentType == "" { contentType = "application/json" }
+
+	client := &http.Client{Timeout: time.Second * time.Duration(config.NotificationTimeoutSeconds)}
+	delay := time.Second * time.Duration(config.NotificationRetryDelaySeconds)
+
+	for attempt := 0; ; attempt++ {
+		if err = postNotification(client, webhook, contentType, payload); err == nil || attempt >= config.NotificationRetries {
+			return err
+		}
+
+		GOut("notify", "WARN: Posting event '%v' to %v failed, retrying in %v. Cause: %v", event.Event, webhookName, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func postNotification(client *http.Client, webhook *Webhook, contentType string, payload []byte) error {
+	request, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return redactRequestError(err)
+	}
+
+	request.Header.Set("Content-Type", contentType)
+	for _, header := range webhook.Headers {
+		request.Header.Set(header.Name, header.Value)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return redactRequestError(err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Webhook responded with %v", response.Status)
+	}
+	return nil
+}
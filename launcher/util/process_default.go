@@ -0,0 +1,15 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+// +build !linux
+
+package util
+
+import (
+	"fmt"
+)
+
+// Process statistics are only supported on Linux.
+func ProcessStats(pid int) (residentBytes int64, cpuSeconds float64, err error) {
+	return 0, 0, fmt.Errorf("Process statistics are not supported on this OS.")
+}
@@ -0,0 +1,41 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The number of clock ticks per second used by /proc/[pid]/stat (USER_HZ is 100 on all common platforms).
+const clockTicksPerSecond = 100
+
+// Returns the resident memory in bytes and the used CPU time in seconds of a process (from /proc/[pid]).
+func ProcessStats(pid int) (residentBytes int64, cpuSeconds float64, err error) {
+	statm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	if fields := strings.Fields(string(statm)); len(fields) >= 2 {
+		pages, _ := strconv.ParseInt(fields[1], 10, 64)
+		residentBytes = pages * int64(os.Getpagesize())
+	}
+
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// The command name (2nd field) may contain spaces, fields are counted after its closing bracket.
+	content := string(stat)
+	if fields := strings.Fields(content[strings.LastIndex(content, ")") + 1:]); len(fields) >= 13 {
+		userTicks, _ := strconv.ParseInt(fields[11], 10, 64)
+		systemTicks, _ := strconv.ParseInt(fields[12], 10, 64)
+		cpuSeconds = float64(userTicks + systemTicks) / clockTicksPerSecond
+	}
+	return
+}
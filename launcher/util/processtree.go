@@ -0,0 +1,39 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+// Describes a process of the OS.
+type ProcessInfo struct {
+	Pid       int
+	ParentPid int
+	// Is the name of the executable (without path).
+	Name      string
+}
+
+// Returns all processes that were started by the specified process (children, grand children, etc.).
+func DescendantProcesses(pid int) ([]ProcessInfo, error) {
+	processes, err := listProcesses()
+	if err != nil {
+		return nil, err
+	}
+
+	children := map[int][]ProcessInfo{}
+	for _, process := range processes {
+		if process.Pid != process.ParentPid {
+			children[process.ParentPid] = append(children[process.ParentPid], process)
+		}
+	}
+
+	descendants, parents := []ProcessInfo{}, []int{pid}
+	for len(parents) > 0 {
+		parent := parents[0]
+		parents = parents[1:]
+
+		for _, child := range children[parent] {
+			descendants = append(descendants, child)
+			parents = append(parents, child.Pid)
+		}
+	}
+	return descendants, nil
+}
@@ -0,0 +1,32 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+// +build !linux,!windows
+
+package util
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Returns all running processes (from "ps").
+func listProcesses() ([]ProcessInfo, error) {
+	output, err := exec.Command("ps", "-A", "-o", "pid=,ppid=,comm=").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	processes := []ProcessInfo{}
+	for _, line := range strings.Split(string(output), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 3 {
+			pid, _ := strconv.Atoi(fields[0])
+			ppid, _ := strconv.Atoi(fields[1])
+			name := filepath.Base(strings.Join(fields[2:], " "))
+			processes = append(processes, ProcessInfo{Pid: pid, ParentPid: ppid, Name: name})
+		}
+	}
+	return processes, nil
+}
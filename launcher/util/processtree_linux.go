@@ -0,0 +1,45 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Returns all running processes (from /proc/[pid]/stat).
+func listProcesses() ([]ProcessInfo, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	processes := []ProcessInfo{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		// Processes may end while reading, these are skipped.
+		stat, err := ioutil.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+
+		// Format is "pid (name) state ppid ...", the name may contain spaces and brackets.
+		content := string(stat)
+		start, end := strings.Index(content, "("), strings.LastIndex(content, ")")
+		if start < 0 || end < start {
+			continue
+		}
+
+		if fields := strings.Fields(content[end + 1:]); len(fields) >= 2 {
+			ppid, _ := strconv.Atoi(fields[1])
+			processes = append(processes, ProcessInfo{Pid: pid, ParentPid: ppid, Name: content[start + 1:end]})
+		}
+	}
+	return processes, nil
+}
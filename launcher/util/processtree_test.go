@@ -0,0 +1,33 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+// +build !windows
+
+package util
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestDescendantProcessesContainsChildren(t *testing.T) {
+	command := exec.Command("/bin/sh", "-c", "sleep 5")
+	if err := command.Start(); err != nil {
+		t.Fatalf("Failed starting child process: %v", err)
+	}
+	defer command.Wait()
+	defer command.Process.Kill()
+
+	processes, err := DescendantProcesses(os.Getpid())
+	if err != nil {
+		t.Fatalf("DescendantProcesses(...) failed: %v", err)
+	}
+
+	for _, process := range processes {
+		if process.Pid == command.Process.Pid {
+			return
+		}
+	}
+	t.Errorf("DescendantProcesses(...) = %v, want to contain pid %v", processes, command.Process.Pid)
+}
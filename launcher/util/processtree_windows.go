@@ -0,0 +1,34 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Returns all running processes (from a snapshot of the process list).
+func listProcesses() ([]ProcessInfo, error) {
+	snapshot, err := syscall.CreateToolhelp32Snapshot(syscall.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.CloseHandle(snapshot)
+
+	entry := syscall.ProcessEntry32{}
+	entry.Size = uint32(unsafe.Sizeof(entry))
+
+	processes := []ProcessInfo{}
+	for err = syscall.Process32First(snapshot, &entry); err == nil; err = syscall.Process32Next(snapshot, &entry) {
+		processes = append(processes, ProcessInfo{
+			Pid: int(entry.ProcessID), ParentPid: int(entry.ParentProcessID),
+			Name: syscall.UTF16ToString(entry.ExeFile[:]),
+		})
+	}
+
+	if err != syscall.ERROR_NO_MORE_FILES {
+		return nil, err
+	}
+	return processes, nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"sync"
+)
+
+// Thread save buffer that keeps the last N lines that were added to it.
+type LineRingBuffer struct {
+	lines []string
+	next  int
+	full  bool
+	mutex sync.Mutex
+}
+
+// Creates a new buffer that keeps up to "size" lines.
+func NewLineRingBuffer(size int) *LineRingBuffer {
+	if size < 1 { size = 1 }
+	b := new(LineRingBuffer)
+	b.lines = make([]string, size)
+	return b
+}
+
+// Adds a line, overwriting the oldest line when the buffer is full.
+func (self *LineRingBuffer) Add(line string) {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	self.lines[self.next] = line
+	if self.next = (self.next + 1) % len(self.lines); self.next == 0 {
+		self.full = true
+	}
+}
+
+// Returns the buffered lines, oldest first.
+func (self *LineRingBuffer) Lines() []string {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	if !self.full {
+		return append([]string{}, self.lines[:self.next]...)
+	}
+	return append(append([]string{}, self.lines[self.next:]...), self.lines[:self.next]...)
+}
+
+// Removes all lines from the buffer.
+func (self *LineRingBuffer) Clear() {
+	self.mutex.Lock(); defer self.mutex.Unlock()
+	self.next, self.full = 0, false
+}
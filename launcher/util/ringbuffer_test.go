@@ -0,0 +1,35 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLineRingBufferKeepsLastLines(t *testing.T) {
+	buffer := NewLineRingBuffer(3)
+
+	tests := []struct {
+		add   string
+		lines string
+	}{
+		{"a", "[a]"},
+		{"b", "[a b]"},
+		{"c", "[a b c]"},
+		{"d", "[b c d]"},
+		{"e", "[c d e]"},
+	}
+
+	for _, test := range tests {
+		buffer.Add(test.add)
+		if in := fmt.Sprintf("%v", buffer.Lines()); in != test.lines {
+			t.Errorf("buffer.Lines() after Add(%v) = %v, want %v", test.add, in, test.lines)
+		}
+	}
+
+	if buffer.Clear(); len(buffer.Lines()) != 0 {
+		t.Errorf("buffer.Lines() after Clear() = %v, want []", buffer.Lines())
+	}
+}
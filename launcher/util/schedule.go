@@ -0,0 +1,334 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defines when a scheduled task runs.
+type Schedule interface {
+	// Returns the next run time after the specified time.
+	Next(after time.Time) time.Time
+	// Describes the schedule.
+	String() string
+}
+
+// Is implemented by schedules whose runs must complete within a time span (e.g. maintenance windows).
+type BoundedSchedule interface {
+	Schedule
+	// Returns the time when the run that started at the specified time must be complete.
+	Closes(run time.Time) time.Time
+}
+
+// Runs a task in fixed intervals counted from the start of the launcher.
+type IntervalSchedule struct {
+	Interval time.Duration
+}
+
+func (self IntervalSchedule) Next(after time.Time) time.Time {
+	return after.Add(self.Interval)
+}
+
+func (self IntervalSchedule) String() string {
+	return "every " + self.Interval.String()
+}
+
+// Runs a task at the times matched by a cron expression ("minute hour day-of-month month day-of-week", local time).
+type CronSchedule struct {
+	expression                         string
+	minutes, hours, days, months, week []bool
+	anyDay, anyWeekday                 bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+var cronMonthNames = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cronWeekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Parses a cron expression with 5 fields, e.g. "30 2 * * mon-fri" or one of "@hourly", "@daily", "@weekly", "@monthly".
+// Fields support "*", lists ("1,15"), ranges ("1-5"), steps ("*/15") and the names of months and weekdays.
+func ParseCronSchedule(expression string) (*CronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) == 1 {
+		if macro, found := cronMacros[strings.ToLower(fields[0])]; found {
+			fields = strings.Fields(macro)
+		}
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid cron expression '%v', expected 5 fields (minute hour day-of-month month day-of-week).", expression)
+	}
+
+	var err error
+	schedule := &CronSchedule{expression: expression}
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil { return nil, err }
+	if schedule.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil { return nil, err }
+	if schedule.days, err = parseCronField(fields[2], 1, 31, nil); err != nil { return nil, err }
+	if schedule.months, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil { return nil, err }
+	if schedule.week, err = parseCronField(fields[4], 0, 7, cronWeekdayNames); err != nil { return nil, err }
+
+	// Both 0 and 7 mean sunday.
+	schedule.week[0] = schedule.week[0] || schedule.week[7]
+	schedule.anyDay, schedule.anyWeekday = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+
+	return schedule, nil
+}
+
+// Parses a single field of a cron expression and returns the matching values as flags (indexed by value).
+func parseCronField(field string, min, max int, names []string) ([]bool, error) {
+	values := make([]bool, max+1)
+
+	parseValue := func(value string) (int, error) {
+		for index, name := range names {
+			if name != "" && strings.EqualFold(name, value) { return index, nil }
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil || number < min || number > max {
+			return 0, fmt.Errorf("Invalid value '%v' in cron field '%v' (allowed are %v-%v).", value, field, min, max)
+		}
+		return number, nil
+	}
+
+	for _, part := range strings.Split(field, ",") {
+		step, from, to := 1, min, max
+
+		if index := strings.Index(part, "/"); index >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[index+1:]); err != nil || step < 1 {
+				return nil, fmt.Errorf("Invalid step in cron field '%v'.", field)
+			}
+			part = part[:index]
+		}
+
+		if part != "*" {
+			var err error
+			bounds := strings.SplitN(part, "-", 2)
+			if from, err = parseValue(bounds[0]); err != nil { return nil, err }
+			if to = from; len(bounds) == 2 {
+				if to, err = parseValue(bounds[1]); err != nil { return nil, err }
+			} else if step > 1 {
+				to = max
+			}
+			if to < from {
+				return nil, fmt.Errorf("Invalid range in cron field '%v'.", field)
+			}
+		}
+
+		for value := from; value <= to; value += step {
+			values[value] = true
+		}
+	}
+
+	return values, nil
+}
+
+func (self *CronSchedule) matchesDay(t time.Time) bool {
+	if !self.months[int(t.Month())] {
+		return false
+	}
+
+	day, weekday := self.days[t.Day()], self.week[int(t.Weekday())]
+	switch {
+	case self.anyDay && self.anyWeekday:
+		return true
+	case self.anyDay:
+		return weekday
+	case self.anyWeekday:
+		return day
+	default:
+		// Like in cron, a day matches when either day-of-month or day-of-week match.
+		return day || weekday
+	}
+}
+
+func (self *CronSchedule) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if !self.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		} else if !self.hours[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		} else if !self.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+		} else {
+			return t
+		}
+	}
+
+	// Expressions like "0 0 31 2 *" never match.
+	return time.Time{}
+}
+
+func (self *CronSchedule) String() string {
+	return "cron '" + self.expression + "'"
+}
+
+var windowTimePattern = regexp.MustCompile(`^([01]?\d|2[0-3]):([0-5]\d)$`)
+
+// Defines a named time window (local time) in which maintenance tasks may run.
+// Tasks scheduled by the window run once when the window opens.
+type MaintenanceWindow struct {
+	Name string `xml:"name,attr"`
+	Days string `xml:"days"`
+	From string `xml:"from"`
+	To   string `xml:"to"`
+
+	weekdays []bool
+	from, to time.Duration
+}
+
+// Validates the window and prepares it for use.
+func (self *MaintenanceWindow) init() (err error) {
+	switch days := strings.ToLower(strings.TrimSpace(self.Days)); days {
+	case "", "daily":
+		self.weekdays, err = parseCronField("*", 0, 7, cronWeekdayNames)
+	case "weekdays":
+		self.weekdays, err = parseCronField("mon-fri", 0, 7, cronWeekdayNames)
+	case "weekends":
+		self.weekdays, err = parseCronField("sat,sun", 0, 7, cronWeekdayNames)
+	default:
+		self.weekdays, err = parseCronField(days, 0, 7, cronWeekdayNames)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid days '%v' in maintenance window '%v'.", self.Days, self.Name)
+	}
+	self.weekdays[0] = self.weekdays[0] || self.weekdays[7]
+
+	parseTime := func(value string) (time.Duration, error) {
+		if match := windowTimePattern.FindStringSubmatch(strings.TrimSpace(value)); match != nil {
+			hours, _ := strconv.Atoi(match[1])
+			minutes, _ := strconv.Atoi(match[2])
+			return time.Hour*time.Duration(hours) + time.Minute*time.Duration(minutes), nil
+		}
+		return 0, fmt.Errorf("Invalid time '%v' in maintenance window '%v' (expected HH:MM).", value, self.Name)
+	}
+
+	if self.from, err = parseTime(self.From); err == nil {
+		self.to, err = parseTime(self.To)
+	}
+	return
+}
+
+// Returns the time when the window opens on the day of "t".
+func (self *MaintenanceWindow) openingOn(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).Add(self.from)
+}
+
+// Returns the length of the window (windows ending before they start end on the next day).
+func (self *MaintenanceWindow) length() time.Duration {
+	if self.to > self.from {
+		return self.to - self.from
+	}
+	return self.to + time.Hour*24 - self.from
+}
+
+// Returns true if the specified time is inside the window.
+func (self *MaintenanceWindow) Contains(t time.Time) bool {
+	return !self.Closes(t).IsZero()
+}
+
+// Returns the time when the window containing "t" closes (zero if "t" is outside the window).
+func (self *MaintenanceWindow) Closes(t time.Time) time.Time {
+	for _, opening := range []time.Time{self.openingOn(t.AddDate(0, 0, -1)), self.openingOn(t)} {
+		if closing := opening.Add(self.length()); self.weekdays[int(opening.Weekday())] && !t.Before(opening) && t.Before(closing) {
+			return closing
+		}
+	}
+	return time.Time{}
+}
+
+func (self *MaintenanceWindow) Next(after time.Time) time.Time {
+	for day := 0; day <= 7; day++ {
+		if opening := self.openingOn(after.AddDate(0, 0, day)); opening.After(after) && self.weekdays[int(opening.Weekday())] {
+			return opening
+		}
+	}
+	return time.Time{}
+}
+
+func (self *MaintenanceWindow) String() string {
+	days := self.Days
+	if days == "" { days = "daily" }
+	return fmt.Sprintf("window '%v' (%v %v-%v)", self.Name, days, self.From, self.To)
+}
+
+// Keeps the next run times of scheduled tasks for status output.
+var nextRuns = map[string]time.Time{}
+var nextRunsMutex sync.Mutex
+
+// Returns the next run times of all scheduled tasks as sorted lines of text.
+func NextRuns() []string {
+	nextRunsMutex.Lock(); defer nextRunsMutex.Unlock()
+	lines := []string{}
+	for task, next := range nextRuns {
+		lines = append(lines, fmt.Sprintf("%v: %v", task, next.Format("2006-01-02 15:04:05 MST")))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func setNextRun(task string, next time.Time) {
+	nextRunsMutex.Lock(); defer nextRunsMutex.Unlock()
+	if next.IsZero() {
+		delete(nextRuns, task)
+	} else {
+		nextRuns[task] = next
+	}
+}
+
+// Calls "fn" at the times defined by the schedule until the context is done.
+// "task" names the task in the status output and the log. The context passed to "fn" is done when
+// the launcher stops or when a bounded schedule (e.g. a maintenance window) closes.
+func RunScheduled(ctx context.Context, group, task string, schedule Schedule, fn func(ctx context.Context)) {
+	defer setNextRun(task, time.Time{})
+
+	for {
+		now := time.Now()
+		next := schedule.Next(now)
+		if next.IsZero() {
+			GOut(group, "WARN: Schedule %v of '%v' has no next run time.", schedule, task)
+			return
+		}
+
+		setNextRun(task, next)
+		GOut(group, "Next run of '%v' is at %v (%v).", task, next.Format("2006-01-02 15:04"), schedule)
+
+		if !Sleep(ctx, next.Sub(now)) {
+			return
+		}
+		runScheduledOnce(ctx, group, task, schedule, next, fn)
+	}
+}
+
+// Calls "fn" for the run of a scheduled task that started at "run".
+func runScheduledOnce(ctx context.Context, group, task string, schedule Schedule, run time.Time, fn func(ctx context.Context)) {
+	runCtx, cancel := context.WithCancel(ctx)
+	if bounded, ok := schedule.(BoundedSchedule); ok {
+		if closes := bounded.Closes(run); !closes.IsZero() {
+			runCtx, cancel = context.WithDeadline(ctx, closes)
+		}
+	}
+	defer cancel()
+
+	fn(runCtx)
+
+	if runCtx.Err() != nil && ctx.Err() == nil {
+		GOut(group, "WARN: '%v' was aborted as %v closed.", task, schedule)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Is a monday.
+var scheduleTestStart = time.Date(2014, 6, 2, 10, 30, 0, 0, time.Local)
+
+func TestCronScheduleFindsNextRun(t *testing.T) {
+	tests := map[string]time.Time{
+		"*/15 * * * *":   time.Date(2014, 6, 2, 10, 45, 0, 0, time.Local),
+		"0 2 * * *":      time.Date(2014, 6, 3, 2, 0, 0, 0, time.Local),
+		"30 2 * * sun":   time.Date(2014, 6, 8, 2, 30, 0, 0, time.Local),
+		"0 3 * * sat-7":  time.Date(2014, 6, 7, 3, 0, 0, 0, time.Local),
+		"0 0 1 jan *":    time.Date(2015, 1, 1, 0, 0, 0, 0, time.Local),
+		"0 12 15 * fri":  time.Date(2014, 6, 6, 12, 0, 0, 0, time.Local),
+		"@monthly":       time.Date(2014, 7, 1, 0, 0, 0, 0, time.Local),
+		"0 0 31 2 *":     time.Time{},
+	}
+
+	for expression, expected := range tests {
+		schedule, err := ParseCronSchedule(expression)
+		if err != nil {
+			t.Errorf("ParseCronSchedule(%v) failed: %v", expression, err)
+		} else if next := schedule.Next(scheduleTestStart); !next.Equal(expected) {
+			t.Errorf("ParseCronSchedule(%v).Next(...) = %v, want %v", expression, next, expected)
+		}
+	}
+}
+
+func TestCronScheduleRejectsInvalidExpressions(t *testing.T) {
+	for _, expression := range []string{"", "* * * *", "60 * * * *", "* 5-2 * * *", "*/0 * * * *", "* * * * funday"} {
+		if _, err := ParseCronSchedule(expression); err == nil {
+			t.Errorf("ParseCronSchedule(%v) did not fail.", expression)
+		}
+	}
+}
+
+func TestMaintenanceWindowSchedule(t *testing.T) {
+	maintenance := &Maintenance{MaintenanceWindows: []MaintenanceWindow{
+		MaintenanceWindow{Name: "nightly", Days: "weekdays", From: "22:00", To: "02:00"},
+	}}
+
+	schedule, err := maintenance.Schedule("Nightly", 0)
+	if err != nil {
+		t.Fatalf("maintenance.Schedule(nightly) failed: %v", err)
+	}
+
+	window := schedule.(*MaintenanceWindow)
+	if next, expected := window.Next(scheduleTestStart), time.Date(2014, 6, 2, 22, 0, 0, 0, time.Local); !next.Equal(expected) {
+		t.Errorf("window.Next(monday) = %v, want %v", next, expected)
+	}
+	if next, expected := window.Next(time.Date(2014, 6, 6, 23, 0, 0, 0, time.Local)), time.Date(2014, 6, 9, 22, 0, 0, 0, time.Local); !next.Equal(expected) {
+		t.Errorf("window.Next(friday night) = %v, want %v", next, expected)
+	}
+
+	for at, expected := range map[time.Time]bool{
+		time.Date(2014, 6, 2, 23, 0, 0, 0, time.Local): true,
+		time.Date(2014, 6, 3, 1, 59, 0, 0, time.Local): true,
+		time.Date(2014, 6, 3, 2, 0, 0, 0, time.Local):  false,
+		time.Date(2014, 6, 7, 1, 0, 0, 0, time.Local):  true,
+		time.Date(2014, 6, 7, 23, 0, 0, 0, time.Local): false,
+	} {
+		if window.Contains(at) != expected {
+			t.Errorf("window.Contains(%v) = %v, want %v", at, !expected, expected)
+		}
+	}
+
+	if closes, expected := window.Closes(time.Date(2014, 6, 2, 23, 0, 0, 0, time.Local)), time.Date(2014, 6, 3, 2, 0, 0, 0, time.Local); !closes.Equal(expected) {
+		t.Errorf("window.Closes(monday night) = %v, want %v", closes, expected)
+	}
+}
+
+func TestScheduleFallsBackToInterval(t *testing.T) {
+	maintenance := &Maintenance{}
+	if schedule, err := maintenance.Schedule("", time.Hour); err != nil || schedule.Next(scheduleTestStart) != scheduleTestStart.Add(time.Hour) {
+		t.Errorf("maintenance.Schedule('', 1h) = %v, %v; want interval of 1h", schedule, err)
+	}
+	if schedule, err := maintenance.Schedule("", 0); err != nil || schedule != nil {
+		t.Errorf("maintenance.Schedule('', 0) = %v, %v; want nil", schedule, err)
+	}
+	if _, err := maintenance.Schedule("unknown-window", 0); err == nil {
+		t.Error("maintenance.Schedule(unknown-window) did not fail.")
+	}
+}
+
+// Is a schedule whose runs must complete within "length".
+type boundedTestSchedule struct {
+	IntervalSchedule
+	length time.Duration
+}
+
+func (self boundedTestSchedule) Closes(run time.Time) time.Time {
+	return run.Add(self.length)
+}
+
+func TestScheduledRunsEndWhenTheScheduleCloses(t *testing.T) {
+	schedule := boundedTestSchedule{IntervalSchedule{time.Hour}, time.Millisecond * 50}
+
+	started := time.Now()
+	runScheduledOnce(context.Background(), "test", "test task", schedule, started, func(ctx context.Context) {
+		<-ctx.Done()
+	})
+
+	if elapsed := time.Since(started); elapsed > time.Second * 5 {
+		t.Errorf("Scheduled run ended after %v, want it to end when the schedule closes", elapsed)
+	}
+}
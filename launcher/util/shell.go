@@ -0,0 +1,49 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Runs the specified command line inside the OS shell with the given additional environment variables ("name=value"),
+// writes the output of the command to the console (using "group") and waits until it finished or timed out.
+// Returns an error if the command could not be started, timed out or returned a non-zero exit code.
+func RunShellCommand(group, commandline string, environment []string, timeout time.Duration) (err error) {
+	command := NewShellCommand(commandline)
+	command.Env = append(os.Environ(), environment...)
+
+	output, input := io.Pipe()
+	command.Stdout, command.Stderr = input, input
+
+	outputDone := make(chan bool)
+	go func() {
+		defer close(outputDone)
+		scanner := bufio.NewScanner(output)
+		for scanner.Scan() {
+			GOut(group, "\x1b[39m%s", scanner.Text())
+		}
+	}()
+
+	if err = command.Start(); err == nil {
+		exited := make(chan error, 1)
+		go func() { exited <- command.Wait() }()
+
+		select {
+		case err = <-exited:
+		case <-time.After(timeout):
+			KillShellCommand(command)
+			<-exited
+			err = fmt.Errorf("Timed out after %v", timeout)
+		}
+	}
+
+	input.Close()
+	<-outputDone
+	return
+}
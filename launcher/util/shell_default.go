@@ -0,0 +1,26 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+// +build !windows
+
+package util
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Returns a command that runs the specified command line inside the OS shell.
+// The command is started in its own process group, allowing to kill it including its children.
+func NewShellCommand(commandline string) *exec.Cmd {
+	command := exec.Command("/bin/sh", "-c", commandline)
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return command
+}
+
+// Kills the started shell command and all processes in its group.
+func KillShellCommand(command *exec.Cmd) {
+	if err := syscall.Kill(-command.Process.Pid, syscall.SIGKILL); err != nil {
+		command.Process.Kill()
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Returns a command that runs the specified command line inside the OS shell.
+func NewShellCommand(commandline string) *exec.Cmd {
+	return exec.Command(os.Getenv("ComSpec"), "/c", commandline)
+}
+
+// Kills the started shell command.
+func KillShellCommand(command *exec.Cmd) {
+	command.Process.Kill()
+}
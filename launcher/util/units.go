@@ -0,0 +1,48 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var byteSizeUnits = map[string]int64{
+	"": 1,
+	"b": 1,
+	"k": 1 << 10,
+	"m": 1 << 20,
+	"g": 1 << 30,
+	"t": 1 << 40,
+}
+
+// Parses a size in the format used by java's "-Xmx" option (e.g. 524288k, 512m, 1g) and returns it in bytes.
+func ParseByteSize(value string) (int64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	number, unit := strings.TrimRight(value, "bkmgt"), ""
+	if len(number) < len(value) {
+		unit = value[len(number):len(number) + 1]
+	}
+
+	if multiplier, found := byteSizeUnits[unit]; found && number != "" {
+		// ParseFloat accepts "inf" and "nan", which are no sizes.
+		if size, err := strconv.ParseFloat(number, 64); err == nil && size >= 0 && size * float64(multiplier) < math.MaxInt64 {
+			return int64(size * float64(multiplier)), nil
+		}
+	}
+
+	return 0, fmt.Errorf("Invalid size '%s', expected a value like 524288k, 512m or 1g.", value)
+}
+
+// Formats the specified number of bytes using the largest unit that keeps the value an integer (e.g. 512m).
+func FormatByteSize(bytes int64) string {
+	for _, unit := range []string{"t", "g", "m", "k"} {
+		if multiplier := byteSizeUnits[unit]; bytes >= multiplier && bytes % multiplier == 0 {
+			return fmt.Sprintf("%d%s", bytes / multiplier, unit)
+		}
+	}
+	return fmt.Sprintf("%d", bytes)
+}
@@ -0,0 +1,47 @@
+// Copyright 2014 The jenkins-client-launcher Authors. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"testing"
+)
+
+func TestCanParseByteSize(t *testing.T) {
+	tests := map[string]int64{
+		"1024": 1024,
+		"524288k": 524288 * 1024,
+		"512m": 512 * 1024 * 1024,
+		"512MB": 512 * 1024 * 1024,
+		"1g": 1024 * 1024 * 1024,
+		"1.5G": 1536 * 1024 * 1024,
+	}
+
+	for value, out := range tests {
+		if in, err := ParseByteSize(value); in != out || err != nil {
+			t.Errorf("ParseByteSize(%v) = %v, %v, want %v", value, in, err, out)
+		}
+	}
+
+	for _, value := range []string{"", "m", "12x", "-1g", "inf", "+Infg", "nan", "1e30g"} {
+		if _, err := ParseByteSize(value); err == nil {
+			t.Errorf("ParseByteSize(%v) did not fail.", value)
+		}
+	}
+}
+
+func TestCanFormatByteSize(t *testing.T) {
+	tests := map[int64]string{
+		1000: "1000",
+		1024: "1k",
+		512 * 1024 * 1024: "512m",
+		1536 * 1024 * 1024: "1536m",
+		2 * 1024 * 1024 * 1024: "2g",
+	}
+
+	for value, out := range tests {
+		if in := FormatByteSize(value); in != out {
+			t.Errorf("FormatByteSize(%v) = %v, want %v", value, in, out)
+		}
+	}
+}